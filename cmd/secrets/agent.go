@@ -0,0 +1,134 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/karimsa/secrets/internal/encrypt"
+	"github.com/urfave/cli/v2"
+)
+
+var agentSocketFlag = &cli.PathFlag{
+	Name:      "socket",
+	Usage:     "Path to the agent's socket",
+	EnvVars:   []string{"SECRETS_AGENT_SOCK"},
+	TakesFile: true,
+}
+
+var cmdAgent = &cli.Command{
+	Name:  "agent",
+	Usage: "Start an agent that holds keys derived from passphrases, so that they are only entered once",
+	Flags: []cli.Flag{
+		agentSocketFlag,
+		&cli.DurationFlag{
+			Name:  "ttl",
+			Usage: "How long keys are held for",
+			Value: encrypt.DefaultAgentTTL,
+		},
+		&cli.BoolFlag{
+			Name:  "foreground",
+			Usage: "Run the agent in the foreground instead of starting it in the background",
+		},
+		&cli.BoolFlag{
+			Name:   "detached",
+			Hidden: true,
+		},
+	},
+	Subcommands: []*cli.Command{
+		{
+			Name:  "lock",
+			Usage: "Wipe every key held by the agent",
+			Flags: []cli.Flag{
+				agentSocketFlag,
+			},
+			Action: func(ctx *cli.Context) error {
+				client, err := encrypt.DialAgent(getAgentSocket(ctx))
+				if err != nil {
+					return err
+				}
+				defer client.Close()
+				return client.Lock()
+			},
+		},
+	},
+	Action: func(ctx *cli.Context) error {
+		socket := getAgentSocket(ctx)
+		if !ctx.Bool("foreground") && !ctx.Bool("detached") {
+			return startAgent(socket, ctx.Duration("ttl"))
+		}
+
+		agent := encrypt.NewKeyAgent(ctx.Duration("ttl"))
+		listener, err := agent.Listen(socket)
+		if err != nil {
+			return err
+		}
+
+		// The agent outlives the terminal it was started from
+		if ctx.Bool("detached") {
+			signal.Ignore(syscall.SIGHUP)
+		}
+
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+		go func() {
+			<-signals
+			agent.Lock()
+			listener.Close()
+		}()
+
+		if !ctx.Bool("detached") {
+			fmt.Fprintf(os.Stderr, "Agent listening on %s\n", socket)
+		}
+		agent.Serve(listener)
+		return nil
+	},
+}
+
+func getAgentSocket(ctx *cli.Context) string {
+	if socket := ctx.String("socket"); socket != "" {
+		return socket
+	}
+	return encrypt.AgentSocketPath()
+}
+
+// startAgent runs the agent in a background process, and waits for it to
+// start listening.
+func startAgent(socket string, ttl time.Duration) error {
+	if client, err := encrypt.DialAgent(socket); err == nil {
+		client.Close()
+		return fmt.Errorf("An agent is already listening on %s", socket)
+	}
+
+	executable, err := os.Executable()
+	if err != nil {
+		return err
+	}
+
+	cmd := exec.Command(executable, "agent", "--detached", "--socket", socket, "--ttl", ttl.String())
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("Failed to start agent: %s", err)
+	}
+
+	exited := make(chan error, 1)
+	go func() {
+		exited <- cmd.Wait()
+	}()
+	for i := 0; i < 100; i++ {
+		select {
+		case err := <-exited:
+			return fmt.Errorf("Agent exited before it started listening: %v", err)
+		case <-time.After(50 * time.Millisecond):
+		}
+
+		if client, err := encrypt.DialAgent(socket); err == nil {
+			client.Close()
+			fmt.Fprintf(os.Stderr, "Agent listening on %s (pid %d)\n", socket, cmd.Process.Pid)
+			return nil
+		}
+	}
+	return fmt.Errorf("Timed out waiting for the agent to start")
+}
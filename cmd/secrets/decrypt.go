@@ -25,8 +25,27 @@ var cmdDecrypt = &cli.Command{
 		formatFlag,
 		strategyFlag,
 		passphraseFlag,
+		passphraseFileFlag,
+		passphraseFDFlag,
+		passphraseCommandFlag,
+		shareFlag,
+		publicKeyFlag,
+		privateKeyFlag,
+		keyringFlag,
+		ageRecipientFlag,
+		ageRecipientsFileFlag,
+		ageIdentityFlag,
+		agentKeyFlag,
+		pgpPublicKeyFlag,
+		pgpSecretKeyringFlag,
+		masterKeyFlag,
+		vaultKeyFlag,
+		vaultMountFlag,
+		vaultContextFlag,
 		keyFlag,
 		keyFileFlag,
+		bindFileNameFlag,
+		requireIntegrityFlag,
 		flagLogLevel,
 	},
 	Action: func(ctx *cli.Context) error {
@@ -52,6 +71,7 @@ var cmdDecrypt = &cli.Command{
 		if err != nil {
 			return err
 		}
+		defer closeCipher(cipher)
 
 		logLevel, err := getLogLevel(ctx)
 		if err != nil {
@@ -59,11 +79,13 @@ var cmdDecrypt = &cli.Command{
 		}
 
 		envFile, err := secrets.Open(secrets.OpenEnvOptions{
-			Format:      format,
-			Reader:      inFile,
-			Cipher:      cipher,
-			SecurePaths: securePaths,
-			LogLevel:    logLevel,
+			Format:           format,
+			Reader:           inFile,
+			Cipher:           cipher,
+			SecurePaths:      securePaths,
+			LogLevel:         logLevel,
+			FileName:         getBindFileName(ctx, inPath),
+			RequireIntegrity: ctx.Bool("require-integrity"),
 		})
 		if err != nil {
 			return err
@@ -17,9 +17,38 @@ var cmdEdit = &cli.Command{
 		inFlag,
 		formatFlag,
 		strategyFlag,
+		algorithmFlag,
+		deterministicFlag,
+		encodingFlag,
+		kdfTimeFlag,
+		kdfMemoryFlag,
+		kdfThreadsFlag,
 		passphraseFlag,
+		passphraseFileFlag,
+		passphraseFDFlag,
+		passphraseCommandFlag,
+		shareFlag,
+		publicKeyFlag,
+		privateKeyFlag,
+		keyringFlag,
+		ageRecipientFlag,
+		ageRecipientsFileFlag,
+		ageIdentityFlag,
+		agentKeyFlag,
+		pgpPublicKeyFlag,
+		pgpSecretKeyringFlag,
+		masterKeyFlag,
+		vaultKeyFlag,
+		vaultMountFlag,
+		vaultContextFlag,
+		ageArmorFlag,
 		keyFlag,
 		keyFileFlag,
+		bindFileNameFlag,
+		padFlag,
+		padPathFlag,
+		integrityFlag,
+		requireIntegrityFlag,
 		&cli.StringFlag{
 			Name:    "editor",
 			Usage:   "Text editor to open for temporary file",
@@ -37,10 +66,17 @@ var cmdEdit = &cli.Command{
 		if err != nil {
 			return err
 		}
+		padding, pathPadding, err := getPadding(ctx)
+		if err != nil {
+			return err
+		}
 
 		if format == "" {
 			format = getFormatFromPath(inPath)
 		}
+		if err := checkArmor(ctx, format); err != nil {
+			return err
+		}
 
 		inFile, err := os.OpenFile(inPath, os.O_RDONLY, 0)
 		if err != nil {
@@ -51,16 +87,23 @@ var cmdEdit = &cli.Command{
 		if err != nil {
 			return err
 		}
+		defer closeCipher(cipher)
 
 		envFile, err := secrets.Open(secrets.OpenEnvOptions{
-			Format:      format,
-			Reader:      inFile,
-			Cipher:      cipher,
-			SecurePaths: securePaths,
+			Format:           format,
+			Reader:           inFile,
+			Cipher:           cipher,
+			SecurePaths:      securePaths,
+			FileName:         getBindFileName(ctx, inPath),
+			Padding:          padding,
+			PathPadding:      pathPadding,
+			Integrity:        ctx.Bool("integrity"),
+			RequireIntegrity: ctx.Bool("require-integrity"),
 		})
 		if err != nil {
 			return err
 		}
+		warnWithoutIntegrity(inPath, envFile)
 
 		// Create temporary version for user edits
 		tmp, err := ioutil.TempFile("/tmp", "*")
@@ -1,62 +1,84 @@
 package main
 
 import (
-	"fmt"
+	"io"
 	"os"
-	"io/fs"
-	"io/ioutil"
 
+	"github.com/karimsa/secrets/internal/encrypt"
 	"github.com/urfave/cli/v2"
 )
 
 var cmdEncryptFile = &cli.Command{
-	Name:    "encrypt-file",
-	Usage:   "Encrypt entire file",
+	Name:  "encrypt-file",
+	Usage: "Encrypt entire file",
 	Flags: []cli.Flag{
 		inFlag,
 		outFlag,
 		strategyFlag,
+		algorithmFlag,
+		kdfTimeFlag,
+		kdfMemoryFlag,
+		kdfThreadsFlag,
 		passphraseFlag,
+		passphraseFileFlag,
+		passphraseFDFlag,
+		passphraseCommandFlag,
+		minPassphraseLengthFlag,
+		minPassphraseEntropyFlag,
+		shareFlag,
+		publicKeyFlag,
+		privateKeyFlag,
+		keyringFlag,
+		ageRecipientFlag,
+		ageRecipientsFileFlag,
+		ageIdentityFlag,
+		agentKeyFlag,
+		pgpPublicKeyFlag,
+		pgpSecretKeyringFlag,
+		masterKeyFlag,
+		vaultKeyFlag,
+		vaultMountFlag,
+		vaultContextFlag,
+		&cli.BoolFlag{
+			Name:  "base64",
+			Usage: "Write the encrypted file as base64 text instead of binary",
+		},
 		flagLogLevel,
 	},
 	Action: func(ctx *cli.Context) error {
-		inPath := ctx.String("in")
-
-		inFile, err := os.OpenFile(inPath, os.O_RDONLY, 0)
-		if err != nil {
-			return err
-		}
-
-		cipher, err := getCipher(ctx)
-		if err != nil {
-			return err
-		}
-
-		rawInput, err := ioutil.ReadAll(inFile)
+		cipher, err := getNewCipher(ctx)
 		if err != nil {
 			return err
 		}
+		defer closeCipher(cipher)
 
-		encryptedData, err := cipher.Encrypt(string(rawInput))
-		if err != nil {
-			return err
-		}
+		return streamFile(ctx, 0644, func(r io.Reader, w io.Writer) error {
+			return encrypt.EncryptStream(cipher, r, w, encrypt.StreamOptions{
+				Algorithm: ctx.String("algorithm"),
+				Base64:    ctx.Bool("base64"),
+			})
+		})
+	},
+}
 
-		outPath := ctx.String("out")
-		switch outPath {
-		case "/dev/stdout":
-			fmt.Printf(encryptedData)
-			return nil
-		case "/dev/stderr":
-			fmt.Fprintf(os.Stderr, encryptedData)
-			return nil
-		}
+// streamFile runs the input file through the given function, and writes the
+// result to the output file (which can be the input file). The output file is
+// only replaced once the whole input has been processed.
+func streamFile(ctx *cli.Context, perm os.FileMode, process func(io.Reader, io.Writer) error) error {
+	inFile, err := os.Open(ctx.String("in"))
+	if err != nil {
+		return err
+	}
+	defer inFile.Close()
 
-		// For in-place edits, overwrite the file
-		outFileMode := os.O_EXCL
-		if outPath == inPath {
-			outFileMode = os.O_WRONLY | os.O_TRUNC
-		}
-		return ioutil.WriteFile(outPath, []byte(encryptedData), fs.FileMode(outFileMode))
-	},
+	outPath := ctx.String("out")
+	switch outPath {
+	case "/dev/stdout":
+		return process(inFile, os.Stdout)
+	case "/dev/stderr":
+		return process(inFile, os.Stderr)
+	}
+	return streamFileAtomic(outPath, perm, func(w io.Writer) error {
+		return process(inFile, w)
+	})
 }
@@ -5,6 +5,7 @@ import (
 	"os"
 
 	"github.com/karimsa/secrets"
+	"github.com/karimsa/secrets/internal/logger"
 	"github.com/urfave/cli/v2"
 )
 
@@ -17,46 +18,111 @@ var cmdEncrypt = &cli.Command{
 		outFlag,
 		formatFlag,
 		strategyFlag,
+		algorithmFlag,
+		deterministicFlag,
+		encodingFlag,
+		kdfTimeFlag,
+		kdfMemoryFlag,
+		kdfThreadsFlag,
 		passphraseFlag,
+		passphraseFileFlag,
+		passphraseFDFlag,
+		passphraseCommandFlag,
+		minPassphraseLengthFlag,
+		minPassphraseEntropyFlag,
+		shareFlag,
+		publicKeyFlag,
+		privateKeyFlag,
+		keyringFlag,
+		ageRecipientFlag,
+		ageRecipientsFileFlag,
+		ageIdentityFlag,
+		agentKeyFlag,
+		pgpPublicKeyFlag,
+		pgpSecretKeyringFlag,
+		masterKeyFlag,
+		vaultKeyFlag,
+		vaultMountFlag,
+		vaultContextFlag,
+		ageArmorFlag,
 		keyFlag,
 		keyFileFlag,
+		bindFileNameFlag,
+		padFlag,
+		padPathFlag,
+		integrityFlag,
 		flagLogLevel,
 	},
 	Action: func(ctx *cli.Context) error {
 		format := ctx.String("format")
 		inPath := ctx.String("in")
+		outPath := ctx.String("out")
 
 		securePaths, err := getInputPaths(ctx)
 		if err != nil {
 			return err
 		}
+		padding, pathPadding, err := getPadding(ctx)
+		if err != nil {
+			return err
+		}
 
 		if format == "" {
 			format = getFormatFromPath(inPath)
 		}
+		if err := checkArmor(ctx, format); err != nil {
+			return err
+		}
 
 		inFile, err := os.OpenFile(inPath, os.O_RDONLY, 0)
 		if err != nil {
 			return err
 		}
 
-		cipher, err := getCipher(ctx)
+		cipher, err := getNewCipher(ctx)
 		if err != nil {
 			return err
 		}
+		defer closeCipher(cipher)
 
 		logLevel, err := getLogLevel(ctx)
 		if err != nil {
 			return err
 		}
 
-		envFile, err := secrets.New(secrets.NewEnvOptions{
-			Format:      format,
-			Reader:      inFile,
-			Cipher:      cipher,
-			LogLevel:    logLevel,
-			SecurePaths: securePaths,
-		})
+		// When writing to stdout, values are bound to the input file's name
+		bindPath := outPath
+		if outPath == "/dev/stdout" || outPath == "/dev/stderr" {
+			bindPath = inPath
+		}
+
+		// Deterministic encryption only produces the same output for a file
+		// that reuses the salt of an existing one, so an existing output file
+		// is updated (like edit) instead of being replaced
+		var envFile *secrets.EnvFile
+		outFileMode := os.O_WRONLY | os.O_CREATE | os.O_EXCL
+		if ctx.Bool("deterministic") && outPath != inPath && bindPath == outPath {
+			envFile, err = openExistingOutput(ctx, format, outPath, cipher, logLevel, securePaths, padding, pathPadding)
+			if err != nil {
+				return err
+			}
+		}
+		if envFile != nil {
+			err = envFile.UpdateFrom(format, inFile)
+			outFileMode = os.O_WRONLY
+		} else {
+			envFile, err = secrets.New(secrets.NewEnvOptions{
+				Format:      format,
+				Reader:      inFile,
+				Cipher:      cipher,
+				LogLevel:    logLevel,
+				SecurePaths: securePaths,
+				FileName:    getBindFileName(ctx, bindPath),
+				Padding:     padding,
+				PathPadding: pathPadding,
+				Integrity:   ctx.Bool("integrity"),
+			})
+		}
 		if err != nil {
 			return err
 		}
@@ -66,7 +132,6 @@ var cmdEncrypt = &cli.Command{
 			return err
 		}
 
-		outPath := ctx.String("out")
 		switch outPath {
 		case "/dev/stdout":
 			fmt.Printf(string(buff))
@@ -77,10 +142,46 @@ var cmdEncrypt = &cli.Command{
 		}
 
 		// For in-place edits, overwrite the file
-		outFileMode := os.O_EXCL
 		if outPath == inPath {
 			outFileMode = os.O_WRONLY | os.O_TRUNC
 		}
 		return envFile.ExportFile(format, outPath, outFileMode)
 	},
 }
+
+// openExistingOutput opens the file at outPath with the given cipher, so that
+// it can be updated with new plaintext. It returns nil if there is no file at
+// outPath yet.
+func openExistingOutput(
+	ctx *cli.Context,
+	format, outPath string,
+	cipher secrets.SimpleCipher,
+	logLevel logger.LogLevel,
+	securePaths []string,
+	padding secrets.PaddingPolicy,
+	pathPadding map[string]secrets.PaddingPolicy,
+) (*secrets.EnvFile, error) {
+	outFile, err := os.Open(outPath)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer outFile.Close()
+
+	envFile, err := secrets.Open(secrets.OpenEnvOptions{
+		Format:      format,
+		Reader:      outFile,
+		Cipher:      cipher,
+		LogLevel:    logLevel,
+		SecurePaths: securePaths,
+		FileName:    getBindFileName(ctx, outPath),
+		Padding:     padding,
+		PathPadding: pathPadding,
+		Integrity:   ctx.Bool("integrity"),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Failed to open existing output file %s: %s", outPath, err)
+	}
+	return envFile, nil
+}
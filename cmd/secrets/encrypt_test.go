@@ -0,0 +1,78 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/urfave/cli/v2"
+)
+
+func runEncrypt(args ...string) error {
+	app := &cli.App{
+		Name:     "secrets",
+		Commands: []*cli.Command{cmdEncrypt},
+	}
+	return app.Run(append([]string{"secrets", "encrypt"}, args...))
+}
+
+func TestEncryptDeterministic(t *testing.T) {
+	dir := t.TempDir()
+	inPath := filepath.Join(dir, "app.env")
+	outPath := filepath.Join(dir, "app.enc.env")
+	passPath := filepath.Join(dir, "passphrase")
+	if err := ioutil.WriteFile(inPath, []byte("HELLO=world\nHI=there\n"), 0644); err != nil {
+		t.Error(err)
+		return
+	}
+	if err := ioutil.WriteFile(passPath, []byte("correct horse battery staple"), 0600); err != nil {
+		t.Error(err)
+		return
+	}
+
+	args := []string{
+		"--in", inPath,
+		"--out", outPath,
+		"--format", "dotenv",
+		"--passphrase-file", passPath,
+		"--key", ".HELLO",
+		"--kdf-time", "1",
+		"--kdf-memory", "64",
+		"--kdf-threads", "1",
+		"--deterministic",
+	}
+	if err := runEncrypt(args...); err != nil {
+		t.Error(err)
+		return
+	}
+	first, err := ioutil.ReadFile(outPath)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if !bytes.Contains(first, []byte("HELLO=ENC[")) {
+		t.Errorf("Expected HELLO to be encrypted, got:\n%s", first)
+		return
+	}
+
+	if err := runEncrypt(args...); err != nil {
+		t.Error(err)
+		return
+	}
+	second, err := ioutil.ReadFile(outPath)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if !bytes.Equal(first, second) {
+		t.Errorf("Expected encrypting the same file twice to produce the same output, got:\n%s\nand:\n%s", first, second)
+		return
+	}
+
+	// Without --deterministic, an existing output file is never replaced
+	if err := runEncrypt(args[:len(args)-1]...); err == nil {
+		t.Error("Expected encrypting to an existing output file to fail")
+		return
+	}
+}
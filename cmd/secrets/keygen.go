@@ -0,0 +1,71 @@
+package main
+
+import (
+	"crypto/rand"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/karimsa/secrets/internal/shamir"
+	"github.com/urfave/cli/v2"
+)
+
+// keygenKeyLength is the length of the random keys that are split into shares
+const keygenKeyLength = 32
+
+var cmdKeygen = &cli.Command{
+	Name:  "keygen",
+	Usage: "Generate a key for symmetric encryption, split into shares that can be given to different people",
+	Flags: []cli.Flag{
+		&cli.UintFlag{
+			Name:     "shares",
+			Usage:    "Number of shares to split the key into",
+			Required: true,
+		},
+		&cli.UintFlag{
+			Name:     "threshold",
+			Usage:    "Number of shares that are required to recover the key",
+			Required: true,
+		},
+		&cli.PathFlag{
+			Name:      "out-dir",
+			Usage:     "Directory to write each share to (as share-N.txt), instead of printing them",
+			TakesFile: true,
+		},
+	},
+	Action: func(ctx *cli.Context) error {
+		key := make([]byte, keygenKeyLength)
+		if _, err := rand.Read(key); err != nil {
+			return err
+		}
+
+		shares, err := shamir.SplitKey(key, int(ctx.Uint("shares")), int(ctx.Uint("threshold")))
+		if err != nil {
+			return err
+		}
+
+		outDir := ctx.String("out-dir")
+		if outDir == "" {
+			for _, share := range shares {
+				fmt.Println(share.String())
+			}
+			return nil
+		}
+
+		if err := os.MkdirAll(outDir, 0700); err != nil {
+			return err
+		}
+		for i, share := range shares {
+			path := filepath.Join(outDir, fmt.Sprintf("share-%d.txt", i+1))
+			if _, err := os.Stat(path); err == nil {
+				return fmt.Errorf("Refusing to overwrite existing share: %s", path)
+			}
+			if err := ioutil.WriteFile(path, []byte(share.String()+"\n"), 0600); err != nil {
+				return err
+			}
+			fmt.Fprintf(os.Stderr, "Wrote share %d of %d to %s\n", i+1, len(shares), path)
+		}
+		return nil
+	},
+}
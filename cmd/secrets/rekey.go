@@ -0,0 +1,344 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/karimsa/secrets"
+	"github.com/urfave/cli/v2"
+)
+
+var cmdRekey = &cli.Command{
+	Name:  "rekey",
+	Usage: "Re-encrypt values in one or more files using a new passphrase or recipients",
+	Flags: []cli.Flag{
+		&cli.StringSliceFlag{
+			Name:      "in",
+			Aliases:   []string{"i"},
+			Usage:     "Path (or glob) of a file to rekey, may be given multiple times",
+			Required:  true,
+			TakesFile: true,
+		},
+		formatFlag,
+		strategyFlag,
+		passphraseFlag,
+		passphraseFileFlag,
+		passphraseFDFlag,
+		passphraseCommandFlag,
+		minPassphraseLengthFlag,
+		minPassphraseEntropyFlag,
+		shareFlag,
+		publicKeyFlag,
+		privateKeyFlag,
+		keyringFlag,
+		ageRecipientFlag,
+		ageRecipientsFileFlag,
+		ageIdentityFlag,
+		agentKeyFlag,
+		pgpPublicKeyFlag,
+		pgpSecretKeyringFlag,
+		masterKeyFlag,
+		vaultKeyFlag,
+		vaultMountFlag,
+		vaultContextFlag,
+		ageArmorFlag,
+		&cli.BoolFlag{
+			Name:  "reencrypt",
+			Usage: "Re-encrypt every value with a new data key, even when only the members of a keyring change (needed when removing a member, since re-wrapped values keep their data keys)",
+		},
+		&cli.StringFlag{
+			Name:  "new-strategy",
+			Usage: "Encryption type to rekey to (defaults to --strategy)",
+		},
+		&cli.StringFlag{
+			Name:    "new-unsafe-passphrase",
+			Usage:   "Unsafely pass the new passphrase for symmetric encryption",
+			EnvVars: []string{"NEW_PASSPHRASE"},
+		},
+		&cli.PathFlag{
+			Name:      "new-passphrase-file",
+			Usage:     "Read the new passphrase from a file",
+			TakesFile: true,
+		},
+		&cli.UintFlag{
+			Name:  "new-passphrase-fd",
+			Usage: "Read the new passphrase from an open file descriptor",
+		},
+		&cli.StringFlag{
+			Name:  "new-passphrase-command",
+			Usage: "Read the new passphrase from the output of a shell command",
+		},
+		&cli.StringSliceFlag{
+			Name:      "new-share",
+			Usage:     "Path to a share of the new key (pass - to enter shares interactively)",
+			TakesFile: true,
+		},
+		&cli.PathFlag{
+			Name:      "new-public-key",
+			Usage:     "Path to the new RSA public key (defaults to --public-key)",
+			TakesFile: true,
+		},
+		&cli.PathFlag{
+			Name:      "new-private-key",
+			Usage:     "Path to the new RSA private key (defaults to --private-key)",
+			TakesFile: true,
+		},
+		&cli.PathFlag{
+			Name:      "new-keyring",
+			Usage:     "Path to the new keyring (defaults to --keyring)",
+			TakesFile: true,
+		},
+		&cli.StringSliceFlag{
+			Name:  "new-recipient",
+			Usage: "New age or SSH public key to encrypt values to (defaults to --recipient)",
+		},
+		&cli.StringSliceFlag{
+			Name:      "new-recipients-file",
+			Usage:     "Path to a new file of age or SSH public keys (defaults to --recipients-file)",
+			TakesFile: true,
+		},
+		&cli.PathFlag{
+			Name:      "new-agent-key",
+			Usage:     "Path to the public key of the new ssh-agent key (defaults to --agent-key)",
+			TakesFile: true,
+		},
+		&cli.StringSliceFlag{
+			Name:      "new-pgp-public-key",
+			Usage:     "Path to a new OpenPGP public key to encrypt values to (defaults to --pgp-public-key)",
+			TakesFile: true,
+		},
+		&cli.PathFlag{
+			Name:      "new-master-key",
+			Usage:     "Path to the new master key file for local-kms encryption (defaults to --master-key)",
+			TakesFile: true,
+		},
+		&cli.StringFlag{
+			Name:  "new-vault-key",
+			Usage: "Name of the new Vault transit key (defaults to --vault-key)",
+		},
+		algorithmFlag,
+		deterministicFlag,
+		encodingFlag,
+		kdfTimeFlag,
+		kdfMemoryFlag,
+		kdfThreadsFlag,
+		keyFlag,
+		keyFileFlag,
+		bindFileNameFlag,
+		padFlag,
+		padPathFlag,
+		integrityFlag,
+		requireIntegrityFlag,
+		flagLogLevel,
+	},
+	Action: func(ctx *cli.Context) error {
+		inPaths, err := expandGlobs(ctx.StringSlice("in"))
+		if err != nil {
+			return err
+		}
+
+		securePaths, err := getInputPaths(ctx)
+		if err != nil {
+			return err
+		}
+		padding, pathPadding, err := getPadding(ctx)
+		if err != nil {
+			return err
+		}
+
+		logLevel, err := getLogLevel(ctx)
+		if err != nil {
+			return err
+		}
+
+		oldCipher, err := getCipherFromFlags(cipherFlags{ctx: ctx, readOnly: true})
+		if err != nil {
+			return err
+		}
+		defer closeCipher(oldCipher)
+		newFlags := cipherFlags{ctx: ctx, prefix: "new-", newKey: true}
+		newCipher, err := getCipherFromFlags(newFlags)
+		if err != nil {
+			return err
+		}
+		defer closeCipher(newCipher)
+
+		// When only the members of a keyring change, the data keys of each
+		// value are re-wrapped instead of re-encrypting every value. Anyone
+		// who could unwrap a data key before can still read an old copy of
+		// the file, so removed members need --reencrypt.
+		rewrap := ctx.String("strategy") == "keyring" && newFlags.String("strategy") == "keyring" && !ctx.Bool("reencrypt")
+
+		// Every file is rekeyed in memory before anything is written, so that
+		// a failure leaves all files untouched
+		outputs := make([][]byte, len(inPaths))
+		for i, inPath := range inPaths {
+			format := ctx.String("format")
+			if format == "" {
+				format = getFormatFromPath(inPath)
+			}
+			if err := checkArmor(ctx, format); err != nil {
+				return err
+			}
+
+			inFile, err := os.Open(inPath)
+			if err != nil {
+				return err
+			}
+
+			openCipher := oldCipher
+			if rewrap {
+				openCipher = newCipher
+			}
+			envFile, err := secrets.Open(secrets.OpenEnvOptions{
+				Format:           format,
+				Reader:           inFile,
+				Cipher:           openCipher,
+				SecurePaths:      securePaths,
+				LogLevel:         logLevel,
+				FileName:         getBindFileName(ctx, inPath),
+				Padding:          padding,
+				PathPadding:      pathPadding,
+				Integrity:        ctx.Bool("integrity"),
+				RequireIntegrity: ctx.Bool("require-integrity"),
+			})
+			inFile.Close()
+			if err != nil {
+				return fmt.Errorf("Failed to open %s: %s", inPath, err)
+			}
+			warnWithoutIntegrity(inPath, envFile)
+
+			if rewrap {
+				if err := envFile.Rewrap(); err != nil {
+					return fmt.Errorf("Failed to rekey %s: %s", inPath, err)
+				}
+			} else {
+				envFile.Rekey(newCipher)
+			}
+
+			outputs[i], err = envFile.Export(format)
+			if err != nil {
+				return fmt.Errorf("Failed to rekey %s: %s", inPath, err)
+			}
+		}
+
+		// Every file is staged before any of them are replaced, so that a
+		// failure to write one leaves all files untouched
+		staged := make([]*stagedFile, 0, len(inPaths))
+		defer func() {
+			for _, file := range staged {
+				file.discard()
+			}
+		}()
+		for i, inPath := range inPaths {
+			file, err := stageFile(inPath, 0600, func(w io.Writer) error {
+				_, err := w.Write(outputs[i])
+				return err
+			})
+			if err != nil {
+				return fmt.Errorf("Failed to write %s: %s (no files were changed)", inPath, err)
+			}
+			staged = append(staged, file)
+		}
+
+		for i, file := range staged {
+			if err := file.commit(); err != nil {
+				if i == 0 {
+					return fmt.Errorf("Failed to replace %s: %s (no files were changed)", inPaths[i], err)
+				}
+				return fmt.Errorf("Failed to replace %s: %s (already rekeyed: %s)", inPaths[i], err, strings.Join(inPaths[:i], ", "))
+			}
+			fmt.Fprintf(os.Stderr, "Rekeyed %s\n", inPaths[i])
+		}
+		return nil
+	},
+}
+
+// expandGlobs resolves a list of paths and globs into a list of unique files.
+func expandGlobs(patterns []string) ([]string, error) {
+	seen := make(map[string]bool, len(patterns))
+	paths := make([]string, 0, len(patterns))
+
+	for _, pattern := range patterns {
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid glob '%s': %s", pattern, err)
+		}
+		if len(matches) == 0 {
+			return nil, fmt.Errorf("No files found matching: %s", pattern)
+		}
+
+		for _, match := range matches {
+			if !seen[match] {
+				seen[match] = true
+				paths = append(paths, match)
+			}
+		}
+	}
+
+	return paths, nil
+}
+
+// stagedFile is a temporary file in the same directory as the file that it
+// replaces once it is committed.
+type stagedFile struct {
+	path string
+	tmp  string
+}
+
+// stageFile writes the contents of a file to a temporary file, using the given
+// function. The permissions of the file are preserved, and files that do not
+// exist yet are created with the given permissions.
+func stageFile(path string, perm os.FileMode, write func(io.Writer) error) (*stagedFile, error) {
+	if info, err := os.Stat(path); err == nil {
+		perm = info.Mode().Perm()
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return nil, err
+	}
+	file := &stagedFile{path: path, tmp: tmp.Name()}
+
+	err = write(tmp)
+	if err == nil {
+		err = tmp.Chmod(perm)
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		file.discard()
+		return nil, err
+	}
+	return file, nil
+}
+
+// commit renames the temporary file over the original.
+func (file *stagedFile) commit() error {
+	return os.Rename(file.tmp, file.path)
+}
+
+// discard removes the temporary file, unless it was committed.
+func (file *stagedFile) discard() {
+	os.Remove(file.tmp)
+}
+
+// streamFileAtomic replaces the contents of a file by writing them to a
+// temporary file (see stageFile), then renaming it over the original, so that
+// nothing is written if the function fails.
+func streamFileAtomic(path string, perm os.FileMode, write func(io.Writer) error) error {
+	file, err := stageFile(path, perm, write)
+	if err != nil {
+		return err
+	}
+	defer file.discard()
+	return file.commit()
+}
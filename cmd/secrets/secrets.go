@@ -4,15 +4,21 @@ import (
 	"bufio"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
+	"math"
 	"os"
+	"os/exec"
+	"path/filepath"
 	"strings"
 
 	"github.com/howeyc/gopass"
 	"github.com/karimsa/secrets"
 	"github.com/karimsa/secrets/internal/encrypt"
 	"github.com/karimsa/secrets/internal/logger"
+	"github.com/karimsa/secrets/internal/shamir"
 	"github.com/urfave/cli/v2"
+	"golang.org/x/crypto/ssh"
 )
 
 var (
@@ -39,7 +45,7 @@ var (
 	strategyFlag = &cli.StringFlag{
 		Name:    "strategy",
 		Aliases: []string{"s"},
-		Usage:   "Encryption/decryption type (symmetric, asymmetric, or keyring)",
+		Usage:   "Encryption/decryption type (symmetric, asymmetric, keyring, age, ssh, ssh-agent, pgp, local-kms, vault, or the name of a plugin)",
 		Value:   "symmetric",
 	}
 	passphraseFlag = &cli.StringFlag{
@@ -48,6 +54,138 @@ var (
 		Value:   "",
 		EnvVars: []string{"PASSPHRASE"},
 	}
+	passphraseFileFlag = &cli.PathFlag{
+		Name:      "passphrase-file",
+		Usage:     "Read the passphrase for symmetric encryption from a file",
+		TakesFile: true,
+	}
+	passphraseFDFlag = &cli.UintFlag{
+		Name:  "passphrase-fd",
+		Usage: "Read the passphrase for symmetric encryption from an open file descriptor (i.e. 3)",
+	}
+	passphraseCommandFlag = &cli.StringFlag{
+		Name:  "passphrase-command",
+		Usage: "Read the passphrase for symmetric encryption from the output of a shell command (i.e. 'pass show team/secrets')",
+	}
+	minPassphraseLengthFlag = &cli.UintFlag{
+		Name:    "min-passphrase-length",
+		Usage:   "Reject passphrases for new values that are shorter than this many characters (0 to accept any length)",
+		Value:   uint(encrypt.DefaultPassphrasePolicy.MinLength),
+		EnvVars: []string{"SECRETS_MIN_PASSPHRASE_LENGTH"},
+	}
+	minPassphraseEntropyFlag = &cli.Float64Flag{
+		Name:    "min-passphrase-entropy",
+		Usage:   "Reject passphrases for new values with less than this many bits of estimated entropy (0 to accept any passphrase)",
+		Value:   encrypt.DefaultPassphrasePolicy.MinEntropy,
+		EnvVars: []string{"SECRETS_MIN_PASSPHRASE_ENTROPY"},
+	}
+	shareFlag = &cli.StringSliceFlag{
+		Name:      "share",
+		Usage:     "Path to a key share created by keygen, used instead of a passphrase for symmetric encryption (pass - to enter shares interactively)",
+		TakesFile: true,
+	}
+	algorithmFlag = &cli.StringFlag{
+		Name:  "algorithm",
+		Usage: "Algorithm used to encrypt new values with symmetric encryption (aes-256-gcm or xchacha20-poly1305)",
+		Value: encrypt.DefaultAlgorithm,
+	}
+	deterministicFlag = &cli.BoolFlag{
+		Name:  "deterministic",
+		Usage: "Encrypt the same value at the same path to the same ciphertext with symmetric encryption (reveals which values are equal)",
+	}
+	encodingFlag = &cli.StringFlag{
+		Name:    "encoding",
+		Usage:   "Encoding of new values for symmetric, ssh-agent and local-kms encryption (hex, base64)",
+		EnvVars: []string{"SECRETS_ENCODING"},
+	}
+	kdfTimeFlag = &cli.UintFlag{
+		Name:  "kdf-time",
+		Usage: "Number of argon2 passes used to derive keys for new values",
+		Value: uint(encrypt.DefaultKDFParams.Time),
+	}
+	kdfMemoryFlag = &cli.UintFlag{
+		Name:  "kdf-memory",
+		Usage: "Amount of memory (in KiB) used by argon2 to derive keys for new values",
+		Value: uint(encrypt.DefaultKDFParams.Memory),
+	}
+	kdfThreadsFlag = &cli.UintFlag{
+		Name:  "kdf-threads",
+		Usage: "Number of threads used by argon2 to derive keys for new values",
+		Value: uint(encrypt.DefaultKDFParams.Threads),
+	}
+	publicKeyFlag = &cli.PathFlag{
+		Name:      "public-key",
+		Usage:     "Path to a PEM-encoded RSA public key for asymmetric encryption",
+		EnvVars:   []string{"SECRETS_PUBLIC_KEY"},
+		TakesFile: true,
+	}
+	privateKeyFlag = &cli.PathFlag{
+		Name:      "private-key",
+		Usage:     "Path to a PEM-encoded RSA private key for asymmetric decryption",
+		EnvVars:   []string{"SECRETS_PRIVATE_KEY"},
+		TakesFile: true,
+	}
+	keyringFlag = &cli.PathFlag{
+		Name:      "keyring",
+		Usage:     "Path to a keyring of PEM-encoded RSA public keys for keyring encryption",
+		EnvVars:   []string{"SECRETS_KEYRING"},
+		TakesFile: true,
+	}
+	ageRecipientFlag = &cli.StringSliceFlag{
+		Name:  "recipient",
+		Usage: "Public key (age1... or ssh-ed25519/ssh-rsa) to encrypt values to with age or ssh encryption",
+	}
+	ageRecipientsFileFlag = &cli.StringSliceFlag{
+		Name:      "recipients-file",
+		Usage:     "Path to a file of public keys (or an authorized_keys file) to encrypt values to with age or ssh encryption",
+		TakesFile: true,
+	}
+	ageIdentityFlag = &cli.StringSliceFlag{
+		Name:      "identity",
+		Usage:     "Path to an identity file (or SSH private key) to decrypt values with age or ssh encryption",
+		EnvVars:   []string{"SECRETS_AGE_IDENTITY"},
+		TakesFile: true,
+	}
+	ageArmorFlag = &cli.BoolFlag{
+		Name:  "armor",
+		Usage: "Encode values encrypted with age, ssh, or pgp using ASCII armor instead of base64",
+	}
+	agentKeyFlag = &cli.PathFlag{
+		Name:      "agent-key",
+		Usage:     "Path to the public key (.pub) of the ssh-agent key to encrypt new values with (defaults to the first key in the agent)",
+		TakesFile: true,
+	}
+	pgpPublicKeyFlag = &cli.StringSliceFlag{
+		Name:      "pgp-public-key",
+		Usage:     "Path to an armored OpenPGP public key to encrypt values to with pgp encryption",
+		TakesFile: true,
+	}
+	pgpSecretKeyringFlag = &cli.PathFlag{
+		Name:      "pgp-secret-keyring",
+		Usage:     "Path to an OpenPGP secret keyring to decrypt values with pgp encryption",
+		EnvVars:   []string{"SECRETS_PGP_SECRET_KEYRING"},
+		TakesFile: true,
+	}
+	masterKeyFlag = &cli.PathFlag{
+		Name:      "master-key",
+		Usage:     "Path to the master key file that wraps data keys for local-kms encryption",
+		EnvVars:   []string{"SECRETS_MASTER_KEY"},
+		TakesFile: true,
+	}
+	vaultKeyFlag = &cli.StringFlag{
+		Name:    "vault-key",
+		Usage:   "Name of the Vault transit key to encrypt values with (the address and token are read from VAULT_ADDR and VAULT_TOKEN)",
+		EnvVars: []string{"SECRETS_VAULT_KEY"},
+	}
+	vaultMountFlag = &cli.StringFlag{
+		Name:  "vault-mount",
+		Usage: "Path that the Vault transit engine is mounted at",
+		Value: "transit",
+	}
+	vaultContextFlag = &cli.BoolFlag{
+		Name:  "vault-context",
+		Usage: "Bind values to their path using the Vault transit context (requires a key created with derived=true)",
+	}
 	keyFlag = &cli.StringSliceFlag{
 		Name:    "key",
 		Aliases: []string{"k"},
@@ -57,6 +195,27 @@ var (
 		Name:  "key-file",
 		Usage: "Load list of keys from a NL-delimited file",
 	}
+	bindFileNameFlag = &cli.BoolFlag{
+		Name:  "bind-file-name",
+		Usage: "Bind encrypted values to the name of the file they are stored in",
+	}
+	padFlag = &cli.StringFlag{
+		Name:  "pad",
+		Usage: "Pad values before they are encrypted, so that their length is hidden (buckets:<lengths>, max:<length> or none)",
+	}
+	padPathFlag = &cli.StringSliceFlag{
+		Name:  "pad-path",
+		Usage: "Padding of the value at a single path, which overrides --pad (i.e. .DB_PASSWORD=max:64)",
+	}
+	integrityFlag = &cli.BoolFlag{
+		Name:  "integrity",
+		Usage: "Add a MAC over the whole file, so that changes to keys, unencrypted values or their order are detected",
+	}
+	requireIntegrityFlag = &cli.BoolFlag{
+		Name:    "require-integrity",
+		Usage:   "Fail to open files that do not have an integrity MAC",
+		EnvVars: []string{"SECRETS_REQUIRE_INTEGRITY"},
+	}
 	flagLogLevel = &cli.StringFlag{
 		Name:  "log-level",
 		Usage: "Increase logging verbosity (none, info, debug)",
@@ -122,25 +281,515 @@ func getFormatFromPath(path string) string {
 	return format
 }
 
+// getBindFileName returns the file name that values should be bound to, or an
+// empty string if file names should not be bound.
+func getBindFileName(ctx *cli.Context, path string) string {
+	if !ctx.Bool("bind-file-name") {
+		return ""
+	}
+	return filepath.Base(path)
+}
+
+// checkArmor rejects --armor for formats that cannot store the multi-line
+// values that it produces.
+func checkArmor(ctx *cli.Context, format string) error {
+	if ctx.Bool("armor") && format == "dotenv" {
+		return fmt.Errorf("--armor cannot be used with dotenv files, since armored values span multiple lines")
+	}
+	return nil
+}
+
+// warnWithoutIntegrity warns that a file is about to be rewritten without an
+// integrity MAC. A file that had one is indistinguishable from a file that
+// never did once the MAC is deleted, so edit and rekey cannot refuse to drop
+// it unless a MAC is required.
+func warnWithoutIntegrity(path string, envFile *secrets.EnvFile) {
+	if !envFile.HasIntegrity() {
+		fmt.Fprintf(os.Stderr, "WARNING: %s does not have an integrity MAC, and will be written without one (if it had a MAC, it was deleted; pass --integrity to add one, or set SECRETS_REQUIRE_INTEGRITY=true to refuse files without one)\n", path)
+	}
+}
+
+// getPadding returns the padding policy of the file, and the policies of any
+// paths that override it.
+func getPadding(ctx *cli.Context) (secrets.PaddingPolicy, map[string]secrets.PaddingPolicy, error) {
+	var padding secrets.PaddingPolicy
+	if ctx.String("pad") != "" {
+		var err error
+		padding, err = secrets.ParsePaddingPolicy(ctx.String("pad"))
+		if err != nil {
+			return padding, nil, err
+		}
+	}
+
+	// The lengths of buckets are split on commas like separate flags, so they
+	// are joined back onto the path that they belong to
+	var args []string
+	for _, arg := range ctx.StringSlice("pad-path") {
+		if !strings.Contains(arg, "=") && len(args) > 0 {
+			args[len(args)-1] += "," + arg
+		} else {
+			args = append(args, arg)
+		}
+	}
+
+	pathPadding := map[string]secrets.PaddingPolicy{}
+	for _, arg := range args {
+		i := strings.LastIndex(arg, "=")
+		if i == -1 {
+			return padding, nil, fmt.Errorf("Invalid --pad-path: %q (expected <path>=<padding>)", arg)
+		}
+		policy, err := secrets.ParsePaddingPolicy(arg[i+1:])
+		if err != nil {
+			return padding, nil, err
+		}
+		pathPadding[arg[:i]] = policy
+	}
+	return padding, pathPadding, nil
+}
+
+func getKDFParams(ctx *cli.Context) (encrypt.KDFParams, error) {
+	time := ctx.Uint("kdf-time")
+	memory := ctx.Uint("kdf-memory")
+	threads := ctx.Uint("kdf-threads")
+	if time > math.MaxUint32 || memory > math.MaxUint32 || threads > math.MaxUint8 {
+		return encrypt.KDFParams{}, fmt.Errorf("Invalid kdf params: --kdf-time=%d, --kdf-memory=%d, --kdf-threads=%d", time, memory, threads)
+	}
+
+	return encrypt.KDFParams{
+		Time:    uint32(time),
+		Memory:  uint32(memory),
+		Threads: uint8(threads),
+	}, nil
+}
+
+// cipherFlags reads the flags that configure a cipher. Commands that need a
+// second cipher (i.e. rekey) use prefixed flags, which fall back to the
+// unprefixed flags when they are not set.
+type cipherFlags struct {
+	ctx    *cli.Context
+	prefix string
+
+	// newKey is set when the cipher encrypts a file under a passphrase for
+	// the first time, in which case the passphrase must be confirmed and
+	// meet the passphrase policy
+	newKey bool
+
+	// readOnly is set when the cipher is only used to decrypt values, in
+	// which case flags that only affect new values are ignored
+	readOnly bool
+}
+
+func (f cipherFlags) String(name string) string {
+	if f.prefix != "" && f.ctx.IsSet(f.prefix+name) {
+		return f.ctx.String(f.prefix + name)
+	}
+	return f.ctx.String(name)
+}
+
+func (f cipherFlags) StringSlice(name string) []string {
+	if f.prefix != "" && f.ctx.IsSet(f.prefix+name) {
+		return f.ctx.StringSlice(f.prefix + name)
+	}
+	return f.ctx.StringSlice(name)
+}
+
+func (f cipherFlags) flagName(name string) string {
+	return "--" + f.prefix + name
+}
+
+// getPassphrase reads the passphrase for symmetric encryption. Only one of
+// --share, --passphrase-file, --passphrase-fd and --passphrase-command can be
+// given, and they take precedence over --unsafe-passphrase (and PASSPHRASE). If
+// none of them are given, the passphrase is prompted for.
+//
+// Passphrases for new files must meet the passphrase policy, and are asked
+// for twice when they are prompted for.
+func getPassphrase(flags cipherFlags) ([]byte, error) {
+	// Passphrase sources never fall back to the unprefixed flags
+	ctx := flags.ctx
+	sources := []string{}
+	for _, name := range []string{"share", "passphrase-file", "passphrase-fd", "passphrase-command"} {
+		if ctx.IsSet(flags.prefix + name) {
+			sources = append(sources, flags.flagName(name))
+		}
+	}
+	if len(sources) > 1 {
+		return nil, fmt.Errorf("Only one passphrase source can be given (got %s)", strings.Join(sources, ", "))
+	}
+
+	// 1) Recover the key from shares (which are random, so they are never
+	// checked against the policy)
+	if paths := ctx.StringSlice(flags.prefix + "share"); len(paths) != 0 {
+		return getKeyFromShares(paths)
+	}
+
+	pass, prompted, err := readPassphraseSource(flags)
+	if err != nil || !flags.newKey {
+		return pass, err
+	}
+
+	policy := encrypt.PassphrasePolicy{
+		MinLength:  int(ctx.Uint("min-passphrase-length")),
+		MinEntropy: ctx.Float64("min-passphrase-entropy"),
+	}
+	if err := policy.Check(pass); err != nil {
+		return nil, err
+	}
+
+	// New passphrases that were typed in are asked for twice, so that a typo
+	// cannot lock everyone out of the file
+	if prompted {
+		if flags.prefix == "new-" {
+			fmt.Fprintf(os.Stderr, "Confirm new passphrase: ")
+		} else {
+			fmt.Fprintf(os.Stderr, "Confirm passphrase: ")
+		}
+		confirmed, err := gopass.GetPasswdMasked()
+		if err != nil {
+			return nil, err
+		}
+		if string(confirmed) != string(pass) {
+			return nil, fmt.Errorf("Passphrases do not match")
+		}
+	}
+	return pass, nil
+}
+
+// readPassphraseSource reads the passphrase from the first source that is set,
+// and reports whether it was prompted for.
+func readPassphraseSource(flags cipherFlags) ([]byte, bool, error) {
+	ctx := flags.ctx
+
+	// 2) Read from a file, file descriptor, or command
+	if path := ctx.String(flags.prefix + "passphrase-file"); path != "" {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, false, err
+		}
+		pass, err := readPassphrase(data, path)
+		return pass, false, err
+	}
+	if ctx.IsSet(flags.prefix + "passphrase-fd") {
+		fd := ctx.Uint(flags.prefix + "passphrase-fd")
+		file := os.NewFile(uintptr(fd), fmt.Sprintf("fd %d", fd))
+		if file == nil {
+			return nil, false, fmt.Errorf("Invalid file descriptor: %d", fd)
+		}
+		defer file.Close()
+
+		data, err := ioutil.ReadAll(file)
+		if err != nil {
+			return nil, false, fmt.Errorf("Failed to read passphrase from fd %d: %s", fd, err)
+		}
+		pass, err := readPassphrase(data, fmt.Sprintf("fd %d", fd))
+		return pass, false, err
+	}
+	if command := ctx.String(flags.prefix + "passphrase-command"); command != "" {
+		cmd := exec.Command("sh", "-c", command)
+		cmd.Stdin = os.Stdin
+		cmd.Stderr = os.Stderr
+		data, err := cmd.Output()
+		if err != nil {
+			return nil, false, fmt.Errorf("Failed to run passphrase command: %s", err)
+		}
+		pass, err := readPassphrase(data, "passphrase command")
+		return pass, false, err
+	}
+
+	// 3) Read from flags + 4) Will read from 'PASSPHRASE' env variable
+	if pass := ctx.String(flags.prefix + "unsafe-passphrase"); len(pass) != 0 {
+		return []byte(pass), false, nil
+	}
+
+	// 5) Read from stdin
+	if flags.prefix == "new-" {
+		fmt.Fprintf(os.Stderr, "New passphrase: ")
+	} else {
+		fmt.Fprintf(os.Stderr, "Passphrase: ")
+	}
+	pass, err := gopass.GetPasswdMasked()
+	return pass, true, err
+}
+
+// readPassphrase strips the trailing newline that most files and commands end
+// their output with.
+func readPassphrase(data []byte, source string) ([]byte, error) {
+	pass := strings.TrimSuffix(strings.TrimSuffix(string(data), "\n"), "\r")
+	if pass == "" {
+		return nil, fmt.Errorf("Passphrase from %s is empty", source)
+	}
+	return []byte(pass), nil
+}
+
+// getKeyFromShares recovers a key that was split by keygen. Shares are read
+// from each path, and a path of "-" prompts for the remaining shares.
+func getKeyFromShares(paths []string) ([]byte, error) {
+	var shares []shamir.Share
+	interactive := false
+	for _, path := range paths {
+		if path == "-" {
+			interactive = true
+			continue
+		}
+
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		share, err := shamir.ParseShare(string(data))
+		if err != nil {
+			return nil, fmt.Errorf("Invalid share in %s: %s", path, err)
+		}
+		shares = append(shares, share)
+	}
+
+	// The threshold is unknown until the first share is read
+	for interactive && (len(shares) == 0 || len(shares) < shares[0].Threshold) {
+		if len(shares) == 0 {
+			fmt.Fprintf(os.Stderr, "Share: ")
+		} else {
+			fmt.Fprintf(os.Stderr, "Share %d of %d: ", len(shares)+1, shares[0].Threshold)
+		}
+		data, err := gopass.GetPasswdMasked()
+		if err != nil {
+			return nil, err
+		}
+		share, err := shamir.ParseShare(string(data))
+		if err != nil {
+			return nil, err
+		}
+		shares = append(shares, share)
+	}
+
+	return shamir.CombineKey(shares)
+}
+
+// dialAgent connects to the agent, if one is running. It is only an error for
+// the agent to be unreachable if SECRETS_AGENT_SOCK was set explicitly.
+func dialAgent() (*encrypt.AgentClient, error) {
+	agent, err := encrypt.DialAgent(encrypt.AgentSocketPath())
+	if err != nil {
+		if os.Getenv("SECRETS_AGENT_SOCK") != "" {
+			return nil, err
+		}
+		return nil, nil
+	}
+	return agent, nil
+}
+
+func getSSHKeyPassphrase(path string) ([]byte, error) {
+	fmt.Fprintf(os.Stderr, "Passphrase for %s: ", path)
+	return gopass.GetPasswdMasked()
+}
+
+func getPGPKeyPassphrase(keyID string) ([]byte, error) {
+	fmt.Fprintf(os.Stderr, "Passphrase for PGP key %s: ", keyID)
+	return gopass.GetPasswdMasked()
+}
+
+// closeCipher releases whatever a cipher holds open, i.e. a plugin process or
+// a connection to an agent. Every command closes its ciphers before exiting,
+// so that plugins are told to shut down and waited on.
+func closeCipher(cipher secrets.SimpleCipher) {
+	if closer, ok := cipher.(io.Closer); ok {
+		closer.Close()
+	}
+}
+
 func getCipher(ctx *cli.Context) (secrets.SimpleCipher, error) {
-	strategy := ctx.String("strategy")
+	return getCipherFromFlags(cipherFlags{ctx: ctx})
+}
+
+// getNewCipher returns the cipher for a file that is being encrypted for the
+// first time.
+func getNewCipher(ctx *cli.Context) (secrets.SimpleCipher, error) {
+	return getCipherFromFlags(cipherFlags{ctx: ctx, newKey: true})
+}
+
+func getCipherFromFlags(flags cipherFlags) (secrets.SimpleCipher, error) {
+	ctx := flags.ctx
+	strategy := flags.String("strategy")
+	deterministic := ctx.Bool("deterministic") && !flags.readOnly
+	if deterministic && strategy != "symmetric" {
+		return nil, fmt.Errorf("Deterministic encryption is only supported by the symmetric strategy")
+	}
+	encoding := ""
+	if !flags.readOnly {
+		encoding = ctx.String("encoding")
+	}
+	if encoding != "" && encoding != encrypt.EncodingHex && strategy != "symmetric" && strategy != "ssh-agent" && strategy != "local-kms" {
+		return nil, fmt.Errorf("The %s encoding is only supported by the symmetric, ssh-agent and local-kms strategies", encoding)
+	}
 
 	if strategy == "symmetric" {
-		// 1) Read from flags + 2) Will read from 'ENVENC_PASSPHRASE' env variable
-		if pass := ctx.String("unsafe-passphrase"); len(pass) != 0 {
-			return encrypt.NewSymmetricCipher([]byte(pass)), nil
+		kdf, err := getKDFParams(ctx)
+		if err != nil {
+			return nil, err
 		}
 
-		// 3) Read from stdin
-		fmt.Fprintf(os.Stderr, "Passphrase: ")
-		pass, err := gopass.GetPasswdMasked()
+		// When an agent is running, it holds the keys and the passphrase is
+		// only asked for if the agent does not have them yet
+		agent, err := dialAgent()
 		if err != nil {
 			return nil, err
 		}
-		return encrypt.NewSymmetricCipher(pass), nil
+		if agent != nil {
+			cipher, err := encrypt.NewAgentCipher(agent, encrypt.AgentCipherOptions{
+				Algorithm:     ctx.String("algorithm"),
+				KDF:           kdf,
+				Deterministic: deterministic,
+				Encoding:      encoding,
+				Passphrase: func() ([]byte, error) {
+					return getPassphrase(flags)
+				},
+			})
+			if err != nil {
+				agent.Close()
+				return nil, err
+			}
+			return cipher, nil
+		}
+
+		pass, err := getPassphrase(flags)
+		if err != nil {
+			return nil, err
+		}
+		return encrypt.NewSymmetricCipherWithOptions(pass, encrypt.SymmetricCipherOptions{
+			Algorithm:     ctx.String("algorithm"),
+			KDF:           kdf,
+			Deterministic: deterministic,
+			Encoding:      encoding,
+		})
+	}
+
+	if strategy == "asymmetric" {
+		publicKey := flags.String("public-key")
+		privateKey := flags.String("private-key")
+		if publicKey == "" && privateKey == "" {
+			return nil, fmt.Errorf("You must specify either %s or %s for asymmetric encryption", flags.flagName("public-key"), flags.flagName("private-key"))
+		}
+		return encrypt.LoadAsymmetricCipher(publicKey, privateKey)
+	}
+
+	if strategy == "keyring" {
+		keyring := flags.String("keyring")
+		if keyring == "" {
+			return nil, fmt.Errorf("You must specify %s for keyring encryption", flags.flagName("keyring"))
+		}
+		return encrypt.LoadKeyringCipher(keyring, flags.String("private-key"))
+	}
+
+	if strategy == "age" {
+		options := encrypt.AgeCipherOptions{
+			Recipients:     flags.StringSlice("recipient"),
+			RecipientFiles: flags.StringSlice("recipients-file"),
+			IdentityFiles:  flags.StringSlice("identity"),
+			Armor:          ctx.Bool("armor"),
+		}
+
+		// Without any keys, age encrypts using a passphrase
+		if len(options.Recipients) == 0 && len(options.RecipientFiles) == 0 && len(options.IdentityFiles) == 0 {
+			pass, err := getPassphrase(flags)
+			if err != nil {
+				return nil, err
+			}
+			options.Passphrase = pass
+		}
+		return encrypt.LoadAgeCipher(options)
+	}
+
+	if strategy == "ssh" {
+		options := encrypt.SSHCipherOptions{
+			Recipients:     flags.StringSlice("recipient"),
+			RecipientFiles: flags.StringSlice("recipients-file"),
+			IdentityFiles:  flags.StringSlice("identity"),
+			Passphrase:     getSSHKeyPassphrase,
+			Armor:          ctx.Bool("armor"),
+		}
+
+		// Fall back to the user's own keys (i.e. ~/.ssh/id_ed25519)
+		if len(options.IdentityFiles) == 0 {
+			options.IdentityFiles = encrypt.DefaultSSHIdentityFiles()
+		}
+		if len(options.Recipients) == 0 && len(options.RecipientFiles) == 0 && len(options.IdentityFiles) == 0 {
+			return nil, fmt.Errorf("You must specify either %s, %s, or %s for ssh encryption", flags.flagName("recipient"), flags.flagName("recipients-file"), flags.flagName("identity"))
+		}
+		return encrypt.LoadSSHCipher(options)
 	}
 
-	return nil, fmt.Errorf("Unsupported strategy: %s", strategy)
+	if strategy == "ssh-agent" {
+		options := encrypt.SSHAgentCipherOptions{
+			Algorithm: ctx.String("algorithm"),
+			Encoding:  encoding,
+		}
+		if path := flags.String("agent-key"); path != "" {
+			data, err := ioutil.ReadFile(path)
+			if err != nil {
+				return nil, err
+			}
+			options.PublicKey, _, _, _, err = ssh.ParseAuthorizedKey(data)
+			if err != nil {
+				return nil, fmt.Errorf("Failed to parse SSH public key %s: %s", path, err)
+			}
+		}
+		client, err := encrypt.DialSSHAgent()
+		if err != nil {
+			return nil, err
+		}
+		cipher, err := encrypt.NewSSHAgentCipher(client, options)
+		if err != nil {
+			cipher.Close()
+			return nil, err
+		}
+		return cipher, nil
+	}
+
+	if strategy == "pgp" {
+		options := encrypt.PGPCipherOptions{
+			PublicKeyFiles:    flags.StringSlice("pgp-public-key"),
+			SecretKeyringFile: flags.String("pgp-secret-keyring"),
+			Passphrase:        getPGPKeyPassphrase,
+			Armor:             ctx.Bool("armor"),
+		}
+		if len(options.PublicKeyFiles) == 0 && options.SecretKeyringFile == "" {
+			return nil, fmt.Errorf("You must specify either %s or %s for pgp encryption", flags.flagName("pgp-public-key"), flags.flagName("pgp-secret-keyring"))
+		}
+		return encrypt.LoadPGPCipher(options)
+	}
+
+	if strategy == "local-kms" {
+		masterKey := flags.String("master-key")
+		if masterKey == "" {
+			return nil, fmt.Errorf("You must specify %s for local-kms encryption", flags.flagName("master-key"))
+		}
+		manager, err := encrypt.LoadLocalKeyManager(masterKey)
+		if err != nil {
+			return nil, err
+		}
+		return encrypt.NewKeyManagerCipher(manager, encrypt.KeyManagerCipherOptions{
+			Algorithm: ctx.String("algorithm"),
+			Encoding:  encoding,
+		})
+	}
+
+	if strategy == "vault" {
+		key := flags.String("vault-key")
+		if key == "" {
+			return nil, fmt.Errorf("You must specify %s for vault encryption", flags.flagName("vault-key"))
+		}
+		return encrypt.NewVaultCipher(encrypt.VaultCipherOptions{
+			Mount:   ctx.String("vault-mount"),
+			Key:     key,
+			Context: ctx.Bool("vault-context"),
+		})
+	}
+
+	// Any other strategy is delegated to a plugin (i.e. secrets-cipher-foo)
+	plugin, err := encrypt.FindPlugin(strategy)
+	if err != nil {
+		return nil, err
+	}
+	return encrypt.NewPluginCipher(plugin), nil
 }
 
 func getLogLevel(ctx *cli.Context) (logger.LogLevel, error) {
@@ -169,6 +818,9 @@ func main() {
 			cmdEncryptFile,
 			cmdDecryptFile,
 			cmdEdit,
+			cmdRekey,
+			cmdKeygen,
+			cmdAgent,
 		},
 		Authors: []*cli.Author{
 			&cli.Author{
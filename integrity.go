@@ -0,0 +1,312 @@
+package secrets
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/karimsa/secrets/internal/orderedmap"
+	pathReader "github.com/karimsa/secrets/internal/path"
+)
+
+// IntegrityKey is the top-level key that stores the integrity MAC of a file.
+const IntegrityKey = "__secrets_mac"
+
+// The integrity MAC is stored as "v1:<wrapped key>:<manifest>:<mac>". The key
+// is random, and wrapped using the cipher of the file as if it were the value
+// at IntegrityKey. The manifest lists every path in the file in order, along
+// with a tag of its value, and the MAC covers the manifest.
+const (
+	integrityVersion   = "v1"
+	integrityKeyLength = 32
+	integrityTagLength = 16
+)
+
+// IntegrityError is returned by Open when a file does not match its integrity
+// MAC. It lists the paths that changed since the file was last exported,
+// including the ones that are not encrypted.
+type IntegrityError struct {
+	Added     []string
+	Removed   []string
+	Changed   []string
+	Reordered []string
+}
+
+func (err *IntegrityError) Error() string {
+	var changes []string
+	for _, change := range []struct {
+		verb  string
+		paths []string
+	}{
+		{"added", err.Added},
+		{"removed", err.Removed},
+		{"changed", err.Changed},
+		{"reordered", err.Reordered},
+	} {
+		if len(change.paths) > 0 {
+			changes = append(changes, fmt.Sprintf("%s %s", change.verb, strings.Join(change.paths, ", ")))
+		}
+	}
+	return "File does not match its integrity MAC: " + strings.Join(changes, "; ")
+}
+
+// integrityEntry is a single value in the manifest of a file. The tag covers
+// the path and the value, so that changes can be traced back to a path.
+type integrityEntry struct {
+	path string
+	tag  []byte
+}
+
+func (env *EnvFile) integrityKeyPath() pathReader.Path {
+	return pathReader.Path{}.AppendKey(IntegrityKey)
+}
+
+// sealIntegrity adds the integrity MAC of the given values to them. A new MAC
+// key is created the first time a file is sealed.
+func (env *EnvFile) sealIntegrity(encrypted *orderedmap.OrderedMap) error {
+	if _, ok := encrypted.Values[IntegrityKey]; ok {
+		return fmt.Errorf("%s is reserved for the integrity MAC of the file", IntegrityKey)
+	}
+
+	if env.integrityKey == nil {
+		key := make([]byte, integrityKeyLength)
+		if _, err := rand.Read(key); err != nil {
+			return err
+		}
+		wrapped, err := env.batchCipher().EncryptBatch([]BatchValue{{
+			Value:          hex.EncodeToString(key),
+			AssociatedData: env.associatedData(env.integrityKeyPath()),
+		}})
+		if batchErr, ok := err.(*BatchError); ok {
+			err = batchErr.Err
+		}
+		if err != nil {
+			return fmt.Errorf("Failed to encrypt integrity MAC key: %s", err)
+		}
+		env.integrityKey = key
+		env.wrappedIntegrityKey = wrapped[0]
+	}
+
+	manifest := encodeManifest(env.integrityEntries(*encrypted))
+	value := strings.Join([]string{
+		integrityVersion,
+		base64.RawURLEncoding.EncodeToString([]byte(env.wrappedIntegrityKey)),
+		base64.RawURLEncoding.EncodeToString(manifest),
+		base64.RawURLEncoding.EncodeToString(env.integrityMAC(manifest)),
+	}, ":")
+
+	// The key order is shared with the raw values, so it is copied before
+	// the MAC is added to it
+	keyOrder := make(map[string][]string, len(encrypted.KeyOrder))
+	for path, keys := range encrypted.KeyOrder {
+		keyOrder[path] = keys
+	}
+	keyOrder["."] = append(append([]string{}, encrypted.KeyOrder["."]...), IntegrityKey)
+	encrypted.KeyOrder = keyOrder
+	encrypted.Values[IntegrityKey] = value
+	return nil
+}
+
+// openIntegrity removes the integrity MAC from the values of a file, and checks
+// that the rest of the file still matches it.
+func (env *EnvFile) openIntegrity(encrypted *orderedmap.OrderedMap, required bool) error {
+	stored, ok := encrypted.Values[IntegrityKey]
+	if !ok {
+		if required {
+			return fmt.Errorf("File does not have an integrity MAC")
+		}
+		return nil
+	}
+	env.integrity = true
+
+	delete(encrypted.Values, IntegrityKey)
+	keys := make([]string, 0, len(encrypted.KeyOrder["."]))
+	for _, key := range encrypted.KeyOrder["."] {
+		if key != IntegrityKey {
+			keys = append(keys, key)
+		}
+	}
+	encrypted.KeyOrder["."] = keys
+
+	str, _ := stored.(string)
+	parts := strings.Split(str, ":")
+	if len(parts) != 4 || parts[0] != integrityVersion {
+		return fmt.Errorf("Unsupported integrity MAC: %v", stored)
+	}
+	var decoded [3][]byte
+	for i, part := range parts[1:] {
+		var err error
+		if decoded[i], err = base64.RawURLEncoding.DecodeString(part); err != nil {
+			return fmt.Errorf("Integrity MAC is malformed: %s", err)
+		}
+	}
+	wrapped, manifest, mac := string(decoded[0]), decoded[1], decoded[2]
+
+	unwrapped, err := env.batchCipher().DecryptBatch([]BatchValue{{
+		Value:          wrapped,
+		AssociatedData: env.associatedData(env.integrityKeyPath()),
+	}})
+	if batchErr, ok := err.(*BatchError); ok {
+		err = batchErr.Err
+	}
+	if err != nil {
+		return fmt.Errorf("Failed to decrypt integrity MAC key: %s", err)
+	}
+	key, err := hex.DecodeString(unwrapped[0])
+	if err != nil || len(key) != integrityKeyLength {
+		return fmt.Errorf("Failed to decrypt integrity MAC key: invalid key")
+	}
+	env.integrityKey = key
+	env.wrappedIntegrityKey = wrapped
+
+	// Only a manifest that matches the MAC can be trusted to list what
+	// changed since the file was exported
+	if !hmac.Equal(env.integrityMAC(manifest), mac) {
+		return fmt.Errorf("File does not match its integrity MAC: the MAC was modified")
+	}
+	storedEntries, err := decodeManifest(manifest)
+	if err != nil {
+		return err
+	}
+	return diffIntegrityEntries(storedEntries, env.integrityEntries(*encrypted))
+}
+
+// HasIntegrity returns whether the file is exported with an integrity MAC,
+// either because it already had one or because one was asked for. Since a
+// MAC can be deleted along with the key that stores it, callers that rewrite
+// a file without one should say so.
+func (env *EnvFile) HasIntegrity() bool {
+	return env.integrity
+}
+
+func (env *EnvFile) integrityMAC(manifest []byte) []byte {
+	mac := hmac.New(sha256.New, env.integrityKey)
+	mac.Write([]byte("secrets/v1/mac\x00"))
+	mac.Write(manifest)
+	return mac.Sum(nil)
+}
+
+// integrityEntries returns the manifest entries of every value in the given
+// (encrypted) map, in the order they are exported.
+func (env *EnvFile) integrityEntries(values orderedmap.OrderedMap) []integrityEntry {
+	entries := values.Entries()
+	manifest := make([]integrityEntry, len(entries))
+	for i, entry := range entries {
+		path := entry.Path.String()
+		mac := hmac.New(sha256.New, env.integrityKey)
+		mac.Write([]byte("secrets/v1/entry\x00"))
+		writeLengthPrefixed(mac, []byte(path))
+		writeLengthPrefixed(mac, []byte(canonicalValue(entry.Value)))
+		manifest[i] = integrityEntry{path: path, tag: mac.Sum(nil)[:integrityTagLength]}
+	}
+	return manifest
+}
+
+// canonicalValue encodes a value along with its type, so that values of
+// different types never share an encoding. Numbers are encoded the same way
+// whether they were parsed as ints or floats, since formats disagree on that.
+func canonicalValue(val interface{}) string {
+	switch v := val.(type) {
+	case string:
+		return "s:" + v
+	case int:
+		return "n:" + strconv.FormatFloat(float64(v), 'g', -1, 64)
+	case float64:
+		return "n:" + strconv.FormatFloat(v, 'g', -1, 64)
+	case bool:
+		return "b:" + strconv.FormatBool(v)
+	case map[string]interface{}:
+		return "m:"
+	case []interface{}:
+		return "l:"
+	default:
+		return fmt.Sprintf("%T:%v", v, v)
+	}
+}
+
+func writeLengthPrefixed(w io.Writer, data []byte) {
+	var length [binary.MaxVarintLen64]byte
+	w.Write(length[:binary.PutUvarint(length[:], uint64(len(data)))])
+	w.Write(data)
+}
+
+func encodeManifest(entries []integrityEntry) []byte {
+	var manifest bytes.Buffer
+	for _, entry := range entries {
+		writeLengthPrefixed(&manifest, []byte(entry.path))
+		manifest.Write(entry.tag)
+	}
+	return manifest.Bytes()
+}
+
+func decodeManifest(manifest []byte) ([]integrityEntry, error) {
+	var entries []integrityEntry
+	for len(manifest) > 0 {
+		length, n := binary.Uvarint(manifest)
+		if n <= 0 || uint64(len(manifest)-n) < length+integrityTagLength {
+			return nil, fmt.Errorf("Integrity MAC is malformed: truncated manifest")
+		}
+		manifest = manifest[n:]
+		entries = append(entries, integrityEntry{
+			path: string(manifest[:length]),
+			tag:  manifest[length : length+integrityTagLength],
+		})
+		manifest = manifest[length+integrityTagLength:]
+	}
+	return entries, nil
+}
+
+// diffIntegrityEntries compares the manifest stored in a file to the manifest
+// of its current values, and describes every difference.
+func diffIntegrityEntries(stored, current []integrityEntry) error {
+	storedTags := make(map[string][]byte, len(stored))
+	for _, entry := range stored {
+		storedTags[entry.path] = entry.tag
+	}
+	currentTags := make(map[string][]byte, len(current))
+	for _, entry := range current {
+		currentTags[entry.path] = entry.tag
+	}
+
+	// Paths that are in both manifests are compared by their order
+	// relative to each other, so that additions and removals do not also
+	// count as reordering
+	integrityErr := &IntegrityError{}
+	var storedOrder, currentOrder []string
+	for _, entry := range stored {
+		if _, ok := currentTags[entry.path]; ok {
+			storedOrder = append(storedOrder, entry.path)
+		} else {
+			integrityErr.Removed = append(integrityErr.Removed, entry.path)
+		}
+	}
+	for _, entry := range current {
+		tag, ok := storedTags[entry.path]
+		if !ok {
+			integrityErr.Added = append(integrityErr.Added, entry.path)
+			continue
+		}
+		if !hmac.Equal(tag, entry.tag) {
+			integrityErr.Changed = append(integrityErr.Changed, entry.path)
+		}
+		currentOrder = append(currentOrder, entry.path)
+	}
+	for i, path := range currentOrder {
+		if i >= len(storedOrder) || storedOrder[i] != path {
+			integrityErr.Reordered = append(integrityErr.Reordered, path)
+		}
+	}
+
+	if len(integrityErr.Added)+len(integrityErr.Removed)+len(integrityErr.Changed)+len(integrityErr.Reordered) > 0 {
+		return integrityErr
+	}
+	return nil
+}
@@ -0,0 +1,185 @@
+package secrets
+
+import (
+	"fmt"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestIntegrity(t *testing.T) {
+	env, err := New(NewEnvOptions{
+		Format:      "dotenv",
+		Reader:      strings.NewReader("HELLO=world\nHI=there\nBYE=now\n"),
+		Cipher:      boundCipher{},
+		SecurePaths: []string{".HELLO"},
+		Integrity:   true,
+	})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	data, err := env.Export("dotenv")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if !strings.HasPrefix(string(data), "HELLO=encrypt(path=['HELLO']|world)\nHI=there\nBYE=now\n"+IntegrityKey+"=v1:") {
+		t.Error(fmt.Errorf("Unexpected output:\n%s", data))
+		return
+	}
+
+	// Exporting an unchanged file keeps the same MAC
+	env, err = Open(OpenEnvOptions{
+		Format:           "dotenv",
+		Reader:           strings.NewReader(string(data)),
+		Cipher:           boundCipher{},
+		SecurePaths:      []string{".HELLO"},
+		RequireIntegrity: true,
+	})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if reexported, err := env.Export("dotenv"); err != nil || string(reexported) != string(data) {
+		t.Error(fmt.Errorf("Expected the export to be unchanged (%v):\n%s", err, reexported))
+		return
+	}
+	if !env.HasIntegrity() {
+		t.Error(fmt.Errorf("Expected the file to have an integrity MAC"))
+		return
+	}
+	if raw, err := env.UnsafeRawExport("dotenv"); err != nil || string(raw) != "HELLO=world\nHI=there\nBYE=now\n" {
+		t.Error(fmt.Errorf("The MAC should not be part of the raw values (%v):\n%s", err, raw))
+		return
+	}
+
+	mac := regexp.MustCompile(IntegrityKey + "=.*\n").FindString(string(data))
+	for tampered, expected := range map[string]*IntegrityError{
+		strings.Replace(string(data), "HI=there", "HI=where", 1):                       {Changed: []string{"['HI']"}},
+		strings.Replace(string(data), "BYE=now\n", "", 1):                              {Removed: []string{"['BYE']"}},
+		strings.Replace(string(data), "BYE=now\n", "BYE=now\nNEW=value\n", 1):          {Added: []string{"['NEW']"}},
+		strings.Replace(string(data), "HI=there\nBYE=now\n", "BYE=now\nHI=there\n", 1): {Reordered: []string{"['BYE']", "['HI']"}},
+		mac + strings.Replace(string(data), mac, "", 1):                                nil,
+	} {
+		_, err := Open(OpenEnvOptions{
+			Format:      "dotenv",
+			Reader:      strings.NewReader(tampered),
+			Cipher:      boundCipher{},
+			SecurePaths: []string{".HELLO"},
+		})
+		if expected == nil {
+			if err != nil {
+				t.Error(fmt.Errorf("The position of the MAC should not matter: %s", err))
+				return
+			}
+			continue
+		}
+		if integrityErr, ok := err.(*IntegrityError); !ok || !reflect.DeepEqual(integrityErr, expected) {
+			t.Error(fmt.Errorf("Expected %#v, but got: %v\n%s", expected, err, tampered))
+			return
+		}
+	}
+
+	modified := strings.Replace(string(data), mac, mac[:len(mac)-3]+"AA\n", 1)
+	if _, err := Open(OpenEnvOptions{
+		Format:      "dotenv",
+		Reader:      strings.NewReader(modified),
+		Cipher:      boundCipher{},
+		SecurePaths: []string{".HELLO"},
+	}); err == nil || !strings.Contains(err.Error(), "MAC was modified") {
+		t.Error(fmt.Errorf("Expected a modified MAC to be rejected: %v", err))
+		return
+	}
+
+	// Removing the MAC is only noticed when it is required
+	stripped := strings.Replace(string(data), mac, "", 1)
+	env, err = Open(OpenEnvOptions{
+		Format:      "dotenv",
+		Reader:      strings.NewReader(stripped),
+		Cipher:      boundCipher{},
+		SecurePaths: []string{".HELLO"},
+	})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if env.HasIntegrity() {
+		t.Error(fmt.Errorf("Expected the stripped file not to have an integrity MAC"))
+		return
+	}
+	if _, err := Open(OpenEnvOptions{
+		Format:           "dotenv",
+		Reader:           strings.NewReader(stripped),
+		Cipher:           boundCipher{},
+		SecurePaths:      []string{".HELLO"},
+		RequireIntegrity: true,
+	}); err == nil {
+		t.Error(fmt.Errorf("Expected a file without a MAC to be rejected"))
+		return
+	}
+}
+
+func TestIntegrityNested(t *testing.T) {
+	env, err := New(NewEnvOptions{
+		Format:      "yaml",
+		Reader:      strings.NewReader("db:\n  host: localhost\n  port: 5432\n  password: hunter2\nflags: []\n"),
+		Cipher:      badCipher{},
+		SecurePaths: []string{".db.password"},
+		Integrity:   true,
+	})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	data, err := env.Export("yaml")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	for tampered, expected := range map[string]*IntegrityError{
+		strings.Replace(string(data), "port: 5432", "port: \"5432\"", 1): {Changed: []string{"['db']['port']"}},
+		strings.Replace(string(data), "flags: []", "flags: [debug]", 1):  {Added: []string{"['flags'][0]"}, Removed: []string{"['flags']"}},
+	} {
+		_, err := Open(OpenEnvOptions{
+			Format:      "yaml",
+			Reader:      strings.NewReader(tampered),
+			Cipher:      badCipher{},
+			SecurePaths: []string{".db.password"},
+		})
+		if integrityErr, ok := err.(*IntegrityError); !ok || !reflect.DeepEqual(integrityErr, expected) {
+			t.Error(fmt.Errorf("Expected %#v, but got: %v\n%s", expected, err, tampered))
+			return
+		}
+	}
+
+	// Rekeyed files get a new MAC key, wrapped by the new cipher
+	env, err = Open(OpenEnvOptions{
+		Format:      "yaml",
+		Reader:      strings.NewReader(string(data)),
+		Cipher:      badCipher{},
+		SecurePaths: []string{".db.password"},
+	})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	env.Rekey(boundCipher{})
+	rekeyed, err := env.Export("yaml")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if _, err := Open(OpenEnvOptions{
+		Format:           "yaml",
+		Reader:           strings.NewReader(string(rekeyed)),
+		Cipher:           boundCipher{},
+		SecurePaths:      []string{".db.password"},
+		RequireIntegrity: true,
+	}); err != nil {
+		t.Error(err)
+		return
+	}
+}
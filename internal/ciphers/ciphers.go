@@ -0,0 +1,103 @@
+// Package ciphers holds the interfaces and errors that are shared by EnvFile
+// and the ciphers that it uses. They are re-exported by the secrets package,
+// so that ciphers do not need to depend on it.
+package ciphers
+
+import (
+	"fmt"
+)
+
+type SimpleCipher interface {
+	Encrypt(raw string) (string, error)
+	Decrypt(encrypted string) (string, error)
+}
+
+// KeyManager protects data keys using a master key that is held elsewhere.
+type KeyManager interface {
+	Wrap(dataKey []byte) ([]byte, error)
+	Unwrap(wrappedKey []byte) ([]byte, error)
+}
+
+// AuthenticatedCipher is implemented by ciphers that can bind a ciphertext to
+// associated data.
+type AuthenticatedCipher interface {
+	SimpleCipher
+	EncryptWithData(raw string, associatedData []byte) (string, error)
+	DecryptWithData(encrypted string, associatedData []byte) (string, error)
+}
+
+// Rewrapper is implemented by ciphers that can re-encrypt the key protecting a
+// value without touching the value itself.
+type Rewrapper interface {
+	Rewrap(encrypted string) (string, error)
+}
+
+// BatchCipher is implemented by ciphers that encrypt or decrypt many values
+// in a single call.
+type BatchCipher interface {
+	EncryptBatch(values []BatchValue) ([]string, error)
+	DecryptBatch(values []BatchValue) ([]string, error)
+}
+
+// PaddingCipher is implemented by ciphers that can pad values before they are
+// encrypted. PaddedLength returns the length that an encrypted value was
+// padded to, or 0 if it was not padded, without decrypting it.
+type PaddingCipher interface {
+	EncryptPadded(raw string, associatedData []byte, length int) (string, error)
+	PaddedLength(encrypted string) (int, error)
+}
+
+type BatchValue struct {
+	Value string
+
+	// AssociatedData is the data that the value is bound to (see
+	// AuthenticatedCipher)
+	AssociatedData []byte
+
+	// PadTo is the length that the value is padded to before it is encrypted
+	// (see PaddingCipher), or 0 if it is not padded
+	PadTo int
+}
+
+// BatchError is returned by a BatchCipher when a single value in a batch
+// could not be encrypted or decrypted.
+type BatchError struct {
+	Index int
+	Err   error
+}
+
+func (err *BatchError) Error() string {
+	return fmt.Sprintf("Failed to process value #%d: %s", err.Index, err.Err)
+}
+
+// BatchErrors is returned by a BatchCipher when more than one value in a batch
+// could not be encrypted or decrypted.
+type BatchErrors []*BatchError
+
+func (errs BatchErrors) Error() string {
+	return fmt.Sprintf("%s (and %d more)", errs[0], len(errs)-1)
+}
+
+// JoinBatchErrors returns the errors of the values in a batch that failed as a
+// single error, which is nil if no values failed.
+func JoinBatchErrors(errs []*BatchError) error {
+	switch len(errs) {
+	case 0:
+		return nil
+	case 1:
+		return errs[0]
+	default:
+		return BatchErrors(errs)
+	}
+}
+
+// KeyMismatchError is returned by ciphers that can tell that a value was
+// encrypted with a different key than their own.
+type KeyMismatchError struct {
+	// KeyID identifies the key that the value was encrypted with
+	KeyID string
+}
+
+func (err *KeyMismatchError) Error() string {
+	return fmt.Sprintf("Value was encrypted with a different key (key %s)", err.KeyID)
+}
@@ -0,0 +1,30 @@
+package ciphers
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestJoinBatchErrors(t *testing.T) {
+	if err := JoinBatchErrors(nil); err != nil {
+		t.Error(fmt.Errorf("Expected no error: %s", err))
+		return
+	}
+
+	first := &BatchError{Index: 1, Err: &KeyMismatchError{KeyID: "abc"}}
+	if err := JoinBatchErrors([]*BatchError{first}); err != first {
+		t.Error(fmt.Errorf("Expected a single BatchError: %v", err))
+		return
+	}
+
+	second := &BatchError{Index: 3, Err: fmt.Errorf("corrupted")}
+	err := JoinBatchErrors([]*BatchError{first, second})
+	if _, ok := err.(BatchErrors); !ok {
+		t.Error(fmt.Errorf("Expected BatchErrors: %v", err))
+		return
+	}
+	if err.Error() != "Failed to process value #1: Value was encrypted with a different key (key abc) (and 1 more)" {
+		t.Error(fmt.Errorf("Unexpected error: %s", err))
+		return
+	}
+}
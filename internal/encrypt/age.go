@@ -0,0 +1,217 @@
+package encrypt
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"filippo.io/age"
+	"filippo.io/age/armor"
+)
+
+// SimpleAgeCipher encrypts values using age (https://age-encryption.org). Each
+// value is a complete age file, encoded as base64 (or armored), so it can be
+// decrypted by the standalone age tool:
+//
+//	echo "$VALUE" | base64 -d | age -d -i key.txt
+//
+// Age files have no associated data, so values are not bound to their path.
+type SimpleAgeCipher struct {
+	recipients []age.Recipient
+	identities []age.Identity
+	armor      bool
+}
+
+type AgeCipherOptions struct {
+	// Recipients are age public keys (age1...) to encrypt values to
+	Recipients []string
+
+	// RecipientFiles are files containing one recipient per line
+	RecipientFiles []string
+
+	// IdentityFiles are files containing age private keys (AGE-SECRET-KEY-1...),
+	// used to decrypt values. When no recipients are given, values are
+	// encrypted to the identities instead.
+	IdentityFiles []string
+
+	// Passphrase is used to encrypt and decrypt values with an scrypt
+	// recipient, instead of public keys. It cannot be combined with other
+	// recipients.
+	Passphrase []byte
+
+	// Armor encodes values using the age ASCII armor instead of base64
+	Armor bool
+}
+
+func NewAgeCipher(recipients []age.Recipient, identities []age.Identity, armor bool) (SimpleAgeCipher, error) {
+	if len(recipients) == 0 && len(identities) == 0 {
+		return SimpleAgeCipher{}, fmt.Errorf("Either a recipient or an identity is required for age encryption")
+	}
+
+	return SimpleAgeCipher{
+		recipients: recipients,
+		identities: identities,
+		armor:      armor,
+	}, nil
+}
+
+func LoadAgeCipher(options AgeCipherOptions) (SimpleAgeCipher, error) {
+	if len(options.Passphrase) > 0 {
+		if len(options.Recipients) > 0 || len(options.RecipientFiles) > 0 || len(options.IdentityFiles) > 0 {
+			return SimpleAgeCipher{}, fmt.Errorf("A passphrase cannot be combined with other age recipients or identities")
+		}
+
+		recipient, err := age.NewScryptRecipient(string(options.Passphrase))
+		if err != nil {
+			return SimpleAgeCipher{}, err
+		}
+		identity, err := age.NewScryptIdentity(string(options.Passphrase))
+		if err != nil {
+			return SimpleAgeCipher{}, err
+		}
+		return NewAgeCipher([]age.Recipient{recipient}, []age.Identity{identity}, options.Armor)
+	}
+
+	recipients := make([]age.Recipient, 0, len(options.Recipients))
+	for _, str := range options.Recipients {
+		recipient, err := ParseAgeRecipient(str)
+		if err != nil {
+			return SimpleAgeCipher{}, err
+		}
+		recipients = append(recipients, recipient)
+	}
+
+	for _, path := range options.RecipientFiles {
+		fileRecipients, err := ReadAgeRecipientsFile(path)
+		if err != nil {
+			return SimpleAgeCipher{}, err
+		}
+		recipients = append(recipients, fileRecipients...)
+	}
+
+	identities := make([]age.Identity, 0, len(options.IdentityFiles))
+	for _, path := range options.IdentityFiles {
+		fileIdentities, err := ReadAgeIdentitiesFile(path)
+		if err != nil {
+			return SimpleAgeCipher{}, err
+		}
+		identities = append(identities, fileIdentities...)
+	}
+
+	// Allow values to be re-encrypted (i.e. by edit) with only an identity
+	if len(recipients) == 0 {
+		for _, identity := range identities {
+			if x25519, ok := identity.(*age.X25519Identity); ok {
+				recipients = append(recipients, x25519.Recipient())
+			}
+		}
+	}
+
+	return NewAgeCipher(recipients, identities, options.Armor)
+}
+
+// ParseAgeRecipient parses a single age recipient (age1...).
+func ParseAgeRecipient(str string) (age.Recipient, error) {
+	return age.ParseX25519Recipient(strings.TrimSpace(str))
+}
+
+// ReadAgeRecipientsFile reads a list of age recipients, one per line.
+func ReadAgeRecipientsFile(path string) ([]age.Recipient, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	recipients, err := age.ParseRecipients(file)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read recipients from %s: %s", path, err)
+	}
+	return recipients, nil
+}
+
+// ReadAgeIdentitiesFile reads a list of age identities, as written by age-keygen.
+func ReadAgeIdentitiesFile(path string) ([]age.Identity, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	identities, err := age.ParseIdentities(file)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read identities from %s: %s", path, err)
+	}
+	return identities, nil
+}
+
+func (s SimpleAgeCipher) Encrypt(str string) (string, error) {
+	if len(s.recipients) == 0 {
+		return "", fmt.Errorf("A recipient is required to encrypt values")
+	}
+
+	var buffer bytes.Buffer
+	var out io.WriteCloser = nopWriteCloser{&buffer}
+	if s.armor {
+		out = armor.NewWriter(&buffer)
+	}
+
+	writer, err := age.Encrypt(out, s.recipients...)
+	if err != nil {
+		return "", err
+	}
+	if _, err := writer.Write([]byte(str)); err != nil {
+		return "", err
+	}
+	if err := writer.Close(); err != nil {
+		return "", err
+	}
+	if err := out.Close(); err != nil {
+		return "", err
+	}
+
+	if s.armor {
+		return buffer.String(), nil
+	}
+	return base64.StdEncoding.EncodeToString(buffer.Bytes()), nil
+}
+
+func (s SimpleAgeCipher) Decrypt(encrypted string) (string, error) {
+	if len(s.identities) == 0 {
+		return "", fmt.Errorf("An identity is required to decrypt values")
+	}
+
+	var in io.Reader
+	trimmed := strings.TrimSpace(encrypted)
+	if strings.HasPrefix(trimmed, armor.Header) {
+		in = armor.NewReader(strings.NewReader(trimmed))
+	} else {
+		buffer, err := base64.StdEncoding.DecodeString(trimmed)
+		if err != nil {
+			return "", fmt.Errorf("Value is not a base64-encoded age file: %s", err)
+		}
+		in = bytes.NewReader(buffer)
+	}
+
+	reader, err := age.Decrypt(in, s.identities...)
+	if err != nil {
+		return "", err
+	}
+	plainText, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return "", err
+	}
+	return string(plainText), nil
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
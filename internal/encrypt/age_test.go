@@ -0,0 +1,159 @@
+package encrypt
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"filippo.io/age"
+)
+
+func writeTestIdentity(t *testing.T) (*age.X25519Identity, string) {
+	identity, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(t.TempDir(), "key.txt")
+	if err := ioutil.WriteFile(path, []byte("# test identity\n"+identity.String()+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return identity, path
+}
+
+func TestAgeEncrypt(t *testing.T) {
+	identity, identityPath := writeTestIdentity(t)
+	data := "foobar - some hello world text blah blah"
+
+	encrypter, err := LoadAgeCipher(AgeCipherOptions{
+		Recipients: []string{identity.Recipient().String()},
+	})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	encrypted, err := encrypter.Encrypt(data)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if _, err := encrypter.Decrypt(encrypted); err == nil {
+		t.Error(fmt.Errorf("Decryption should have failed without an identity"))
+		return
+	}
+
+	// Values should be plain age files once base64-decoded
+	buffer, err := base64.StdEncoding.DecodeString(encrypted)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if !bytes.HasPrefix(buffer, []byte("age-encryption.org/v1\n")) {
+		t.Error(fmt.Errorf("Value is not an age file: %q", buffer))
+		return
+	}
+
+	decrypter, err := LoadAgeCipher(AgeCipherOptions{
+		IdentityFiles: []string{identityPath},
+	})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	decrypted, err := decrypter.Decrypt(encrypted)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if decrypted != data {
+		t.Error(fmt.Sprintf("Decryption failed: '%s' (%d)", decrypted, len(decrypted)))
+		return
+	}
+
+	_, otherIdentityPath := writeTestIdentity(t)
+	other, err := LoadAgeCipher(AgeCipherOptions{
+		IdentityFiles: []string{otherIdentityPath},
+	})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if decrypted, err := other.Decrypt(encrypted); err == nil {
+		t.Error(fmt.Errorf("Decryption should have failed: %s", decrypted))
+		return
+	}
+}
+
+func TestAgeArmor(t *testing.T) {
+	_, identityPath := writeTestIdentity(t)
+	cipher, err := LoadAgeCipher(AgeCipherOptions{
+		IdentityFiles: []string{identityPath},
+		Armor:         true,
+	})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	encrypted, err := cipher.Encrypt("some test text")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if !strings.HasPrefix(encrypted, "-----BEGIN AGE ENCRYPTED FILE-----") {
+		t.Error(fmt.Errorf("Value was not armored: %s", encrypted))
+		return
+	}
+
+	decrypted, err := cipher.Decrypt(encrypted)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if decrypted != "some test text" {
+		t.Error(fmt.Sprintf("Decryption failed: '%s'", decrypted))
+		return
+	}
+}
+
+func TestAgePassphrase(t *testing.T) {
+	cipher, err := LoadAgeCipher(AgeCipherOptions{
+		Passphrase: []byte("testing"),
+	})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	encrypted, err := cipher.Encrypt("some test text")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	decrypted, err := cipher.Decrypt(encrypted)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if decrypted != "some test text" {
+		t.Error(fmt.Sprintf("Decryption failed: '%s'", decrypted))
+		return
+	}
+
+	bad, err := LoadAgeCipher(AgeCipherOptions{
+		Passphrase: []byte("bad pass"),
+	})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if decrypted, err := bad.Decrypt(encrypted); err == nil {
+		t.Error(fmt.Errorf("Decryption should have failed: %s", decrypted))
+		return
+	}
+}
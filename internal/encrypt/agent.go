@@ -0,0 +1,529 @@
+package encrypt
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/karimsa/secrets/internal/ciphers"
+)
+
+const (
+	// DefaultAgentTTL is how long a KeyAgent holds keys for, unless another
+	// TTL is given
+	DefaultAgentTTL = 15 * time.Minute
+
+	agentProtocolVersion = 1
+)
+
+// KeyAgent holds the keys derived from passphrases in memory, so that
+// symmetric encryption only has to prompt for a passphrase and run argon2
+// once across many commands. Clients never receive keys: they send values to
+// the agent, which encrypts or decrypts them (see SimpleAgentCipher).
+//
+// Keys are only added to the agent after they have successfully decrypted a
+// value (or when they are used to encrypt a new file), so a mistyped
+// passphrase is never cached. Each key is wiped from memory once its TTL has
+// passed, or when the agent is locked.
+//
+// Like plugins, clients send one JSON request per line, and the agent writes
+// one JSON response per line.
+type KeyAgent struct {
+	ttl  time.Duration
+	keys *keyCache
+
+	lock  sync.Mutex
+	added map[string]time.Time
+}
+
+type agentRequest struct {
+	Version       int          `json:"version"`
+	Method        string       `json:"method"`
+	Values        []agentValue `json:"values,omitempty"`
+	Passphrase    []byte       `json:"passphrase,omitempty"`
+	Algorithm     string       `json:"algorithm,omitempty"`
+	KDF           KDFParams    `json:"kdf"`
+	Deterministic bool         `json:"deterministic,omitempty"`
+	Encoding      string       `json:"encoding,omitempty"`
+	Salt          []byte       `json:"salt,omitempty"`
+}
+
+type agentValue struct {
+	Value          string `json:"value"`
+	AssociatedData []byte `json:"associated_data,omitempty"`
+	PadTo          int    `json:"pad_to,omitempty"`
+}
+
+type agentResponse struct {
+	Error string `json:"error,omitempty"`
+
+	// Locked is set when the agent does not hold the keys for a request, and
+	// the request must be sent again with the passphrase
+	Locked bool `json:"locked,omitempty"`
+
+	// Salt is the salt that new values in the same file should use
+	Salt    []byte        `json:"salt,omitempty"`
+	Results []agentResult `json:"results,omitempty"`
+}
+
+type agentResult struct {
+	Value string `json:"value,omitempty"`
+	Error string `json:"error,omitempty"`
+
+	// KeyID is set when a value was encrypted with a different key
+	KeyID string `json:"key_id,omitempty"`
+}
+
+// AgentSocketPath returns the path of the agent's socket, which is read from
+// SECRETS_AGENT_SOCK. It defaults to a socket in a private directory of the
+// user's runtime (or temp) dir.
+func AgentSocketPath() string {
+	if path := os.Getenv("SECRETS_AGENT_SOCK"); path != "" {
+		return path
+	}
+
+	dir := os.Getenv("XDG_RUNTIME_DIR")
+	if dir == "" {
+		dir = os.TempDir()
+	}
+	return filepath.Join(dir, fmt.Sprintf("secrets-agent-%d", os.Getuid()), "agent.sock")
+}
+
+// checkAgentSocketDir verifies that the directory of the agent's socket is
+// owned by the current user, and that only they can access it, so that another
+// user cannot impersonate the agent to collect passphrases. Symlinks are not
+// followed, since the directory they point to could be replaced.
+func checkAgentSocketDir(path string) error {
+	dir := filepath.Dir(path)
+	info, err := os.Lstat(dir)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("Refusing to use agent socket in %s (it is not a directory)", dir)
+	}
+	if owner, ok := fileOwner(info); ok && owner != os.Getuid() {
+		return fmt.Errorf("Refusing to use agent socket in %s (it is owned by another user)", dir)
+	}
+	if info.Mode().Perm()&0077 != 0 {
+		return fmt.Errorf("Refusing to use agent socket in %s (it must only be accessible by you, i.e. chmod 700)", dir)
+	}
+	return nil
+}
+
+func NewKeyAgent(ttl time.Duration) *KeyAgent {
+	if ttl <= 0 {
+		ttl = DefaultAgentTTL
+	}
+	return &KeyAgent{
+		ttl:   ttl,
+		keys:  newKeyCache(),
+		added: make(map[string]time.Time),
+	}
+}
+
+// Listen creates the agent's socket at the given path. The socket's directory
+// is created if it does not exist, and must only be accessible by the current
+// user.
+func (a *KeyAgent) Listen(path string) (net.Listener, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, err
+	}
+	if err := checkAgentSocketDir(path); err != nil {
+		return nil, err
+	}
+
+	// Remove the socket of an agent that is no longer running
+	if conn, err := net.Dial("unix", path); err == nil {
+		conn.Close()
+		return nil, fmt.Errorf("An agent is already listening on %s", path)
+	}
+	os.Remove(path)
+
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, 0600); err != nil {
+		listener.Close()
+		return nil, err
+	}
+	return listener, nil
+}
+
+// Serve handles connections until the listener is closed.
+func (a *KeyAgent) Serve(listener net.Listener) error {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+		go a.handle(conn)
+	}
+}
+
+func (a *KeyAgent) handle(conn net.Conn) {
+	defer conn.Close()
+
+	decoder := json.NewDecoder(conn)
+	encoder := json.NewEncoder(conn)
+	for {
+		var request agentRequest
+		if err := decoder.Decode(&request); err != nil {
+			return
+		}
+		if err := encoder.Encode(a.process(request)); err != nil {
+			return
+		}
+	}
+}
+
+// Lock wipes every key held by the agent.
+func (a *KeyAgent) Lock() {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	a.keys.wipe()
+	a.added = make(map[string]time.Time)
+}
+
+// expire wipes the keys that were added more than one TTL before the given
+// time.
+func (a *KeyAgent) expire(now time.Time) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	var expired []string
+	for id, added := range a.added {
+		if !now.Before(added.Add(a.ttl)) {
+			expired = append(expired, id)
+			delete(a.added, id)
+		}
+	}
+	a.keys.forget(expired)
+}
+
+func (a *KeyAgent) addKeys(keys *keyCache) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	now := time.Now()
+	for _, id := range a.keys.addKeys(keys) {
+		a.added[id] = now
+	}
+	time.AfterFunc(a.ttl, func() {
+		a.expire(time.Now())
+	})
+}
+
+func (a *KeyAgent) process(request agentRequest) agentResponse {
+	if request.Version != agentProtocolVersion {
+		return agentResponse{Error: fmt.Sprintf("Unsupported agent protocol version: %d", request.Version)}
+	}
+
+	switch request.Method {
+	case "lock":
+		a.Lock()
+		return agentResponse{}
+	case "encrypt", "decrypt":
+	default:
+		return agentResponse{Error: fmt.Sprintf("Unsupported agent method: %s", request.Method)}
+	}
+
+	cipher, err := NewSymmetricCipherWithOptions(request.Passphrase, SymmetricCipherOptions{
+		Algorithm:     request.Algorithm,
+		KDF:           request.KDF,
+		Deterministic: request.Deterministic,
+		Encoding:      request.Encoding,
+	})
+	if err != nil {
+		return agentResponse{Error: err.Error()}
+	}
+
+	// Each request works on a copy of the agent's keys, which can only derive
+	// new keys if the passphrase was given
+	keys := newKeyCache()
+	keys.addKeys(a.keys)
+	keys.salt = request.Salt
+	keys.locked = request.Passphrase == nil
+	cipher.keys = keys
+	defer keys.wipe()
+
+	response := agentResponse{
+		Results: make([]agentResult, len(request.Values)),
+	}
+	failed := false
+	for i, value := range request.Values {
+		var result string
+		if request.Method == "encrypt" {
+			result, err = cipher.EncryptPadded(value.Value, value.AssociatedData, value.PadTo)
+		} else {
+			result, err = cipher.DecryptWithData(value.Value, value.AssociatedData)
+		}
+
+		if err == errKeyNotCached {
+			return agentResponse{Locked: true}
+		} else if err != nil {
+			response.Results[i].Error = err.Error()
+			if mismatch, ok := err.(*ciphers.KeyMismatchError); ok {
+				response.Results[i].KeyID = mismatch.KeyID
+			}
+			failed = true
+		} else {
+			response.Results[i].Value = result
+		}
+	}
+
+	// Keys derived from a passphrase are only kept if they worked
+	if request.Passphrase != nil && !failed {
+		a.addKeys(keys)
+	}
+	response.Salt = keys.salt
+	return response
+}
+
+// AgentClient is a connection to a KeyAgent.
+type AgentClient struct {
+	lock    sync.Mutex
+	conn    net.Conn
+	encoder *json.Encoder
+	decoder *json.Decoder
+}
+
+// DialAgent connects to the agent listening on the given socket.
+func DialAgent(path string) (*AgentClient, error) {
+	if err := checkAgentSocketDir(path); err != nil {
+		return nil, err
+	}
+
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to connect to agent: %s", err)
+	}
+	return &AgentClient{
+		conn:    conn,
+		encoder: json.NewEncoder(conn),
+		decoder: json.NewDecoder(conn),
+	}, nil
+}
+
+func (c *AgentClient) call(request agentRequest) (agentResponse, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	request.Version = agentProtocolVersion
+
+	var response agentResponse
+	if err := c.encoder.Encode(request); err != nil {
+		return response, fmt.Errorf("Agent stopped responding: %s", err)
+	}
+	if err := c.decoder.Decode(&response); err != nil {
+		return response, fmt.Errorf("Agent stopped responding: %s", err)
+	}
+	if response.Error != "" {
+		return response, fmt.Errorf("Agent failed to %s values: %s", request.Method, response.Error)
+	}
+	return response, nil
+}
+
+// Lock asks the agent to wipe every key it holds.
+func (c *AgentClient) Lock() error {
+	_, err := c.call(agentRequest{Method: "lock"})
+	return err
+}
+
+func (c *AgentClient) Close() error {
+	return c.conn.Close()
+}
+
+// SimpleAgentCipher encrypts values using symmetric encryption, by sending
+// them to a KeyAgent. The passphrase is only asked for if the agent does not
+// already hold the keys for the values, and it is then sent to the agent to
+// derive the keys.
+//
+// Like SimpleSymmetricCipher, new values adopt the salt of the existing values
+// in a file.
+type SimpleAgentCipher struct {
+	client        *AgentClient
+	algorithm     string
+	kdf           KDFParams
+	deterministic bool
+	encoding      string
+	passphrase    func() ([]byte, error)
+	state         *agentCipherState
+}
+
+type agentCipherState struct {
+	lock sync.Mutex
+	pass []byte
+	salt []byte
+}
+
+type AgentCipherOptions struct {
+	// Algorithm is the AEAD used to encrypt new values (defaults to
+	// DefaultAlgorithm)
+	Algorithm string
+
+	// KDF are the argon2 params used to encrypt new values (defaults to
+	// DefaultKDFParams)
+	KDF KDFParams
+
+	// Deterministic encrypts the same plaintext at the same path to the same
+	// value (see SymmetricCipherOptions)
+	Deterministic bool
+
+	// Encoding is the encoding of new values (defaults to EncodingHex)
+	Encoding string
+
+	// Passphrase is called when the agent does not hold the keys for a value.
+	// It is called at most once.
+	Passphrase func() ([]byte, error)
+}
+
+func NewAgentCipher(client *AgentClient, options AgentCipherOptions) (SimpleAgentCipher, error) {
+	s := SimpleAgentCipher{
+		client:        client,
+		algorithm:     DefaultAlgorithm,
+		kdf:           DefaultKDFParams,
+		deterministic: options.Deterministic,
+		passphrase:    options.Passphrase,
+		state:         &agentCipherState{},
+	}
+
+	if options.Algorithm != "" {
+		if _, err := newAEAD(options.Algorithm, make([]byte, dataKeyLength)); err != nil {
+			return s, err
+		}
+		s.algorithm = options.Algorithm
+	}
+	if options.KDF != (KDFParams{}) {
+		if err := options.KDF.validate(); err != nil {
+			return s, err
+		}
+		s.kdf = options.KDF
+	}
+	if options.Encoding != "" {
+		if err := checkEncoding(options.Encoding); err != nil {
+			return s, err
+		}
+		s.encoding = options.Encoding
+	}
+	return s, nil
+}
+
+// Close closes the connection to the agent. The agent keeps the keys that it
+// holds until they expire.
+func (s SimpleAgentCipher) Close() error {
+	return s.client.Close()
+}
+
+func (s SimpleAgentCipher) call(method string, values []ciphers.BatchValue) ([]string, error) {
+	s.state.lock.Lock()
+	defer s.state.lock.Unlock()
+
+	request := agentRequest{
+		Method:        method,
+		Values:        make([]agentValue, len(values)),
+		Passphrase:    s.state.pass,
+		Algorithm:     s.algorithm,
+		KDF:           s.kdf,
+		Deterministic: s.deterministic,
+		Encoding:      s.encoding,
+		Salt:          s.state.salt,
+	}
+	for i, value := range values {
+		request.Values[i] = agentValue{
+			Value:          value.Value,
+			AssociatedData: value.AssociatedData,
+			PadTo:          value.PadTo,
+		}
+	}
+
+	response, err := s.client.call(request)
+	if err != nil {
+		return nil, err
+	}
+	if response.Locked {
+		if s.passphrase == nil {
+			return nil, fmt.Errorf("The agent does not hold the key for these values")
+		}
+		pass, err := s.passphrase()
+		if err != nil {
+			return nil, err
+		}
+		s.state.pass = pass
+
+		request.Passphrase = pass
+		response, err = s.client.call(request)
+		if err != nil {
+			return nil, err
+		}
+		if response.Locked {
+			return nil, fmt.Errorf("The agent could not derive the key for these values")
+		}
+	}
+
+	if len(response.Results) != len(values) {
+		return nil, fmt.Errorf("Agent returned %d results for %d values", len(response.Results), len(values))
+	}
+	results := make([]string, len(values))
+	var errs []*ciphers.BatchError
+	for i, result := range response.Results {
+		if result.KeyID != "" {
+			errs = append(errs, &ciphers.BatchError{Index: i, Err: &ciphers.KeyMismatchError{KeyID: result.KeyID}})
+		} else if result.Error != "" {
+			errs = append(errs, &ciphers.BatchError{Index: i, Err: fmt.Errorf("%s", result.Error)})
+		}
+		results[i] = result.Value
+	}
+	if err := ciphers.JoinBatchErrors(errs); err != nil {
+		return nil, err
+	}
+
+	if s.state.salt == nil {
+		s.state.salt = response.Salt
+	}
+	return results, nil
+}
+
+func (s SimpleAgentCipher) Encrypt(str string) (string, error) {
+	return s.EncryptWithData(str, nil)
+}
+
+func (s SimpleAgentCipher) EncryptWithData(str string, associatedData []byte) (string, error) {
+	return s.EncryptPadded(str, associatedData, 0)
+}
+
+func (s SimpleAgentCipher) EncryptPadded(str string, associatedData []byte, length int) (string, error) {
+	return unbatch(s.EncryptBatch([]ciphers.BatchValue{
+		{Value: str, AssociatedData: associatedData, PadTo: length},
+	}))
+}
+
+// PaddedLength returns the length that an encrypted value was padded to, or 0
+// if it was not padded.
+func (s SimpleAgentCipher) PaddedLength(encrypted string) (int, error) {
+	return envelopePaddedLength(encrypted)
+}
+
+func (s SimpleAgentCipher) EncryptBatch(values []ciphers.BatchValue) ([]string, error) {
+	return s.call("encrypt", values)
+}
+
+func (s SimpleAgentCipher) Decrypt(encrypted string) (string, error) {
+	return s.DecryptWithData(encrypted, nil)
+}
+
+func (s SimpleAgentCipher) DecryptWithData(encrypted string, associatedData []byte) (string, error) {
+	return unbatch(s.DecryptBatch([]ciphers.BatchValue{
+		{Value: encrypted, AssociatedData: associatedData},
+	}))
+}
+
+func (s SimpleAgentCipher) DecryptBatch(values []ciphers.BatchValue) ([]string, error) {
+	return s.call("decrypt", values)
+}
@@ -0,0 +1,308 @@
+package encrypt
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/karimsa/secrets"
+)
+
+var testAgentKDF = KDFParams{Time: 1, Memory: 64, Threads: 1}
+
+// newTestKeyAgent starts a KeyAgent on a socket in a temporary directory.
+func newTestKeyAgent(t *testing.T) (*KeyAgent, string) {
+	agent := NewKeyAgent(time.Minute)
+	path := filepath.Join(t.TempDir(), "agent", "agent.sock")
+	listener, err := agent.Listen(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go agent.Serve(listener)
+	return agent, path
+}
+
+// newTestAgentCipher connects a new cipher to the agent, which counts the
+// number of times that the passphrase is asked for.
+func newTestAgentCipher(t *testing.T, path string, pass string, prompts *int) SimpleAgentCipher {
+	client, err := DialAgent(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+
+	cipher, err := NewAgentCipher(client, AgentCipherOptions{
+		KDF: testAgentKDF,
+		Passphrase: func() ([]byte, error) {
+			*prompts++
+			return []byte(pass), nil
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cipher
+}
+
+func TestAgentEncrypt(t *testing.T) {
+	_, path := newTestKeyAgent(t)
+	prompts := 0
+
+	env, err := secrets.New(secrets.NewEnvOptions{
+		Format:      "dotenv",
+		Reader:      strings.NewReader("A=first\nB=second\n"),
+		Cipher:      newTestAgentCipher(t, path, "test-pass", &prompts),
+		SecurePaths: []string{".A", ".B"},
+	})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	data, err := env.Export("dotenv")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if prompts != 1 {
+		t.Error(fmt.Errorf("Expected a single passphrase prompt, but got %d", prompts))
+		return
+	}
+
+	// Values should be readable by the symmetric cipher
+	local, err := NewSymmetricCipherWithOptions([]byte("test-pass"), SymmetricCipherOptions{KDF: testAgentKDF})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	localEnv, err := secrets.Open(secrets.OpenEnvOptions{
+		Format:      "dotenv",
+		Reader:      strings.NewReader(string(data)),
+		Cipher:      local,
+		SecurePaths: []string{".A", ".B"},
+	})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if raw, _ := localEnv.UnsafeRawExport("dotenv"); string(raw) != "A=first\nB=second\n" {
+		t.Error(fmt.Errorf("Unexpected output:\n%s", raw))
+		return
+	}
+
+	// Later commands should not need the passphrase, and changed values should
+	// keep using the file's salt
+	env, err = secrets.Open(secrets.OpenEnvOptions{
+		Format:      "dotenv",
+		Reader:      strings.NewReader(string(data)),
+		Cipher:      newTestAgentCipher(t, path, "test-pass", &prompts),
+		SecurePaths: []string{".A", ".B"},
+	})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if err := env.UpdateFrom("dotenv", strings.NewReader("A=first\nB=changed\n")); err != nil {
+		t.Error(err)
+		return
+	}
+	updated, err := env.Export("dotenv")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if prompts != 1 {
+		t.Error(fmt.Errorf("Expected the agent to hold the key, but the passphrase was asked for %d times", prompts))
+		return
+	}
+	lines := strings.Split(string(updated), "\n")
+	salt := lines[0][strings.Index(lines[0], ",salt="):strings.Index(lines[0], ",nonce=")]
+	if lines[1] == strings.Split(string(data), "\n")[1] || !strings.Contains(lines[1], salt) {
+		t.Error(fmt.Errorf("Expected new values to adopt the file's salt:\n%s", updated))
+		return
+	}
+}
+
+func TestAgentLock(t *testing.T) {
+	agent, path := newTestKeyAgent(t)
+	prompts := 0
+
+	encrypted, err := newTestAgentCipher(t, path, "test-pass", &prompts).Encrypt("some test text")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	// Wrong passphrases should not be cached
+	client, err := DialAgent(path)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer client.Close()
+	if err := client.Lock(); err != nil {
+		t.Error(err)
+		return
+	}
+	if _, err := newTestAgentCipher(t, path, "wrong-pass", &prompts).Decrypt(encrypted); err == nil {
+		t.Error(fmt.Errorf("Decryption should fail with the wrong passphrase"))
+		return
+	}
+	decrypted, err := newTestAgentCipher(t, path, "test-pass", &prompts).Decrypt(encrypted)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if decrypted != "some test text" || prompts != 3 {
+		t.Error(fmt.Errorf("Unexpected result after %d prompts: %s", prompts, decrypted))
+		return
+	}
+
+	// Keys should be wiped once their TTL has passed
+	agent.expire(time.Now().Add(time.Minute))
+	cipher, err := NewAgentCipher(client, AgentCipherOptions{KDF: testAgentKDF})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if _, err := cipher.Decrypt(encrypted); err == nil || !strings.Contains(err.Error(), "does not hold the key") {
+		t.Error(fmt.Errorf("Expected expired keys to be wiped: %v", err))
+		return
+	}
+}
+
+func TestAgentCipherClose(t *testing.T) {
+	_, path := newTestKeyAgent(t)
+	prompts := 0
+
+	cipher := newTestAgentCipher(t, path, "test-pass", &prompts)
+	if _, err := cipher.Encrypt("some test text"); err != nil {
+		t.Error(err)
+		return
+	}
+	if err := cipher.Close(); err != nil {
+		t.Error(err)
+		return
+	}
+	if _, err := cipher.Encrypt("some test text"); err == nil {
+		t.Error(fmt.Errorf("Expected a closed cipher to stop talking to the agent"))
+		return
+	}
+}
+
+func TestAgentDeterministic(t *testing.T) {
+	_, path := newTestKeyAgent(t)
+	prompts := 0
+
+	newCipher := func(passphrase string) SimpleAgentCipher {
+		client, err := DialAgent(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { client.Close() })
+
+		cipher, err := NewAgentCipher(client, AgentCipherOptions{
+			KDF:           testAgentKDF,
+			Deterministic: true,
+			Passphrase: func() ([]byte, error) {
+				prompts++
+				return []byte(passphrase), nil
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return cipher
+	}
+	ad := []byte("path=['A']")
+
+	// Re-encrypting a value in the same file reuses its salt, and the key
+	// that the agent holds for it
+	first, err := newCipher("test-pass").EncryptWithData("some test text", ad)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	cipher := newCipher("test-pass")
+	if _, err := cipher.DecryptWithData(first, ad); err != nil {
+		t.Error(err)
+		return
+	}
+	second, err := cipher.EncryptWithData("some test text", ad)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if first != second || prompts != 1 {
+		t.Error(fmt.Errorf("Expected deterministic output after %d prompts:\n%s\n%s", prompts, first, second))
+		return
+	}
+
+	// A new file gets its own salt, so the key held for the first file is
+	// never used for a different passphrase
+	other, err := newCipher("other-pass").EncryptWithData("some test text", ad)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	for _, test := range []struct {
+		encrypted, passphrase, wrong string
+	}{
+		{first, "test-pass", "other-pass"},
+		{other, "other-pass", "test-pass"},
+	} {
+		if raw, err := NewSymmetricCipher([]byte(test.passphrase)).DecryptWithData(test.encrypted, ad); err != nil || raw != "some test text" {
+			t.Error(fmt.Errorf("Expected value to decrypt with %s: %v", test.passphrase, err))
+			return
+		}
+		if _, err := NewSymmetricCipher([]byte(test.wrong)).DecryptWithData(test.encrypted, ad); err == nil {
+			t.Error(fmt.Errorf("Expected value not to decrypt with %s", test.wrong))
+			return
+		}
+	}
+}
+
+func TestAgentSocketDir(t *testing.T) {
+	dir := t.TempDir()
+	private := filepath.Join(dir, "private")
+	if err := os.Mkdir(private, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkAgentSocketDir(filepath.Join(private, "agent.sock")); err != nil {
+		t.Error(err)
+		return
+	}
+
+	shared := filepath.Join(dir, "shared")
+	if err := os.Mkdir(shared, 0750); err != nil {
+		t.Fatal(err)
+	}
+	link := filepath.Join(dir, "link")
+	if err := os.Symlink(private, link); err != nil {
+		t.Fatal(err)
+	}
+	for _, socketDir := range []string{shared, link} {
+		if err := checkAgentSocketDir(filepath.Join(socketDir, "agent.sock")); err == nil {
+			t.Error(fmt.Errorf("Expected the agent to refuse a socket in %s", socketDir))
+			return
+		}
+	}
+
+	// Only root can create a directory that is owned by another user
+	if os.Getuid() == 0 {
+		other := filepath.Join(dir, "other")
+		if err := os.Mkdir(other, 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chown(other, 1, 1); err != nil {
+			t.Fatal(err)
+		}
+		if err := checkAgentSocketDir(filepath.Join(other, "agent.sock")); err == nil {
+			t.Error(fmt.Errorf("Expected the agent to refuse a socket in a directory owned by another user"))
+			return
+		}
+	}
+}
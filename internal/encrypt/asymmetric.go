@@ -0,0 +1,292 @@
+package encrypt
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"strings"
+)
+
+const (
+	dataKeyLength = 32
+
+	// boundValuePrefix comes before the associated data tag of values that
+	// are bound to associated data
+	boundValuePrefix = "ad="
+)
+
+// SimpleAsymmetricCipher encrypts values to an RSA public key, and decrypts
+// them with the matching private key. Each value is encrypted using a random
+// AES-256-GCM data key, which is then wrapped using RSA-OAEP.
+//
+// The private key is optional, which allows values to be encrypted by parties
+// that should not be able to read them (i.e. CI).
+type SimpleAsymmetricCipher struct {
+	publicKey  *rsa.PublicKey
+	privateKey *rsa.PrivateKey
+}
+
+func NewAsymmetricCipher(publicKey *rsa.PublicKey, privateKey *rsa.PrivateKey) (SimpleAsymmetricCipher, error) {
+	if publicKey == nil {
+		if privateKey == nil {
+			return SimpleAsymmetricCipher{}, fmt.Errorf("Either a public or a private key is required for asymmetric encryption")
+		}
+		publicKey = &privateKey.PublicKey
+	}
+
+	return SimpleAsymmetricCipher{
+		publicKey:  publicKey,
+		privateKey: privateKey,
+	}, nil
+}
+
+// LoadAsymmetricCipher creates an asymmetric cipher from PEM-encoded key files.
+// Either path may be left empty, but at least one must be given.
+func LoadAsymmetricCipher(publicKeyPath, privateKeyPath string) (SimpleAsymmetricCipher, error) {
+	var publicKey *rsa.PublicKey
+	var privateKey *rsa.PrivateKey
+	var err error
+
+	if publicKeyPath != "" {
+		publicKey, err = ReadPublicKeyFile(publicKeyPath)
+		if err != nil {
+			return SimpleAsymmetricCipher{}, err
+		}
+	}
+	if privateKeyPath != "" {
+		privateKey, err = ReadPrivateKeyFile(privateKeyPath)
+		if err != nil {
+			return SimpleAsymmetricCipher{}, err
+		}
+	}
+
+	return NewAsymmetricCipher(publicKey, privateKey)
+}
+
+func readPEMBlock(path string) (*pem.Block, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("No PEM data found in %s", path)
+	}
+	return block, nil
+}
+
+// ReadPublicKeyFile reads an RSA public key from a PEM file, in either PKIX
+// ("PUBLIC KEY") or PKCS #1 ("RSA PUBLIC KEY") form.
+func ReadPublicKeyFile(path string) (*rsa.PublicKey, error) {
+	block, err := readPEMBlock(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParsePublicKey(block)
+}
+
+func ParsePublicKey(block *pem.Block) (*rsa.PublicKey, error) {
+	switch block.Type {
+	case "RSA PUBLIC KEY":
+		return x509.ParsePKCS1PublicKey(block.Bytes)
+
+	case "PUBLIC KEY":
+		key, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		rsaKey, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return nil, fmt.Errorf("Unsupported public key type: %T", key)
+		}
+		return rsaKey, nil
+
+	default:
+		return nil, fmt.Errorf("Unsupported PEM block for public key: %s", block.Type)
+	}
+}
+
+// ReadPrivateKeyFile reads an RSA private key from a PEM file, in either
+// PKCS #1 ("RSA PRIVATE KEY") or PKCS #8 ("PRIVATE KEY") form.
+func ReadPrivateKeyFile(path string) (*rsa.PrivateKey, error) {
+	block, err := readPEMBlock(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParsePrivateKey(block)
+}
+
+func ParsePrivateKey(block *pem.Block) (*rsa.PrivateKey, error) {
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		return x509.ParsePKCS1PrivateKey(block.Bytes)
+
+	case "PRIVATE KEY":
+		key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		rsaKey, ok := key.(*rsa.PrivateKey)
+		if !ok {
+			return nil, fmt.Errorf("Unsupported private key type: %T", key)
+		}
+		return rsaKey, nil
+
+	default:
+		return nil, fmt.Errorf("Unsupported PEM block for private key: %s", block.Type)
+	}
+}
+
+func wrapDataKey(publicKey *rsa.PublicKey, dataKey []byte) ([]byte, error) {
+	return rsa.EncryptOAEP(sha256.New(), rand.Reader, publicKey, dataKey, nil)
+}
+
+func unwrapDataKey(privateKey *rsa.PrivateKey, wrapped []byte) ([]byte, error) {
+	return rsa.DecryptOAEP(sha256.New(), rand.Reader, privateKey, wrapped, nil)
+}
+
+func sealWithDataKey(dataKey, plainText, associatedData []byte) ([]byte, error) {
+	block, err := aes.NewCipher(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return gcm.Seal(nonce, nonce, plainText, associatedData), nil
+}
+
+// openWithDataKey decrypts a value sealed by sealWithDataKey, using the same
+// associated data.
+func openWithDataKey(dataKey, sealed, associatedData []byte) ([]byte, error) {
+	block, err := aes.NewCipher(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(sealed) < gcm.NonceSize() {
+		return nil, fmt.Errorf("Failed to decrypt value")
+	}
+	plainText, err := gcm.Open(nil, sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():], associatedData)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to decrypt value")
+	}
+	return plainText, nil
+}
+
+// tagBoundValue records the associated data tag in front of a value that is
+// bound to associated data (i.e. "ad=<tag>:<hex>"), like the ad param of
+// envelopes. Values that are not bound are left as-is.
+func tagBoundValue(encoded string, associatedData []byte) string {
+	if len(associatedData) == 0 {
+		return encoded
+	}
+	return boundValuePrefix + associatedDataTag(associatedData) + ":" + encoded
+}
+
+// cutBoundValue splits a value into its associated data tag (including the
+// prefix, or empty if the value is not bound) and the value itself.
+func cutBoundValue(encrypted string) (string, string, error) {
+	if !strings.HasPrefix(encrypted, boundValuePrefix) {
+		return "", encrypted, nil
+	}
+	end := strings.IndexByte(encrypted, ':')
+	if end == -1 {
+		return "", "", fmt.Errorf("Unexpected end of value while reading associated data tag")
+	}
+	return encrypted[:end+1], encrypted[end+1:], nil
+}
+
+// openBoundValue checks that a value tagged by tagBoundValue is bound to the
+// given associated data, and returns the value along with the associated data
+// that it should be decrypted with. Only values without a tag were never bound,
+// and are decrypted without associated data.
+func openBoundValue(encrypted string, associatedData []byte) (string, []byte, error) {
+	tag, encoded, err := cutBoundValue(encrypted)
+	if err != nil {
+		return "", nil, err
+	}
+	if tag == "" {
+		return encoded, nil, nil
+	}
+	if tag != tagBoundValue("", associatedData) {
+		return "", nil, errValueMoved
+	}
+	return encoded, associatedData, nil
+}
+
+func (s SimpleAsymmetricCipher) Encrypt(str string) (string, error) {
+	return s.EncryptWithData(str, nil)
+}
+
+func (s SimpleAsymmetricCipher) EncryptWithData(str string, associatedData []byte) (string, error) {
+	dataKey := make([]byte, dataKeyLength)
+	if _, err := rand.Read(dataKey); err != nil {
+		return "", err
+	}
+
+	wrappedKey, err := wrapDataKey(s.publicKey, dataKey)
+	if err != nil {
+		return "", err
+	}
+
+	sealed, err := sealWithDataKey(dataKey, []byte(str), associatedData)
+	if err != nil {
+		return "", err
+	}
+
+	return tagBoundValue(hex.EncodeToString(append(wrappedKey, sealed...)), associatedData), nil
+}
+
+func (s SimpleAsymmetricCipher) Decrypt(encrypted string) (string, error) {
+	return s.DecryptWithData(encrypted, nil)
+}
+
+func (s SimpleAsymmetricCipher) DecryptWithData(encrypted string, associatedData []byte) (string, error) {
+	if s.privateKey == nil {
+		return "", fmt.Errorf("A private key is required to decrypt values")
+	}
+
+	encrypted, associatedData, err := openBoundValue(encrypted, associatedData)
+	if err != nil {
+		return "", err
+	}
+	buffer, err := hex.DecodeString(encrypted)
+	if err != nil {
+		return "", err
+	}
+
+	keySize := s.privateKey.Size()
+	if len(buffer) < keySize {
+		return "", fmt.Errorf("Failed to decrypt value")
+	}
+
+	dataKey, err := unwrapDataKey(s.privateKey, buffer[:keySize])
+	if err != nil {
+		return "", fmt.Errorf("Failed to decrypt value")
+	}
+
+	plainText, err := openWithDataKey(dataKey, buffer[keySize:], associatedData)
+	if err != nil {
+		return "", err
+	}
+	return string(plainText), nil
+}
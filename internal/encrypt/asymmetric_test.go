@@ -0,0 +1,138 @@
+package encrypt
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func writeTestKeys(t *testing.T) (string, string) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pubBytes, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	pubPath := filepath.Join(dir, "key.pub")
+	privPath := filepath.Join(dir, "key.pem")
+	if err := ioutil.WriteFile(pubPath, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pubBytes}), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(privPath, pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return pubPath, privPath
+}
+
+func TestAsymmetricEncrypt(t *testing.T) {
+	pubPath, privPath := writeTestKeys(t)
+	data := "foobar - some hello world text blah blah"
+
+	encrypter, err := LoadAsymmetricCipher(pubPath, "")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	encrypted, err := encrypter.Encrypt(data)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if _, err := encrypter.Decrypt(encrypted); err == nil {
+		t.Error(fmt.Errorf("Decryption should have failed without a private key"))
+		return
+	}
+
+	decrypter, err := LoadAsymmetricCipher("", privPath)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	decrypted, err := decrypter.Decrypt(encrypted)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if decrypted != data {
+		t.Error(fmt.Sprintf("Decryption failed: '%s' (%d)", decrypted, len(decrypted)))
+		return
+	}
+}
+
+func TestAsymmetricWrongKey(t *testing.T) {
+	pubPath, _ := writeTestKeys(t)
+	_, otherPrivPath := writeTestKeys(t)
+
+	encrypter, err := LoadAsymmetricCipher(pubPath, "")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	encrypted, err := encrypter.Encrypt("some test text")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	decrypter, err := LoadAsymmetricCipher("", otherPrivPath)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if decrypted, err := decrypter.Decrypt(encrypted); err == nil {
+		t.Error(fmt.Errorf("Decryption should have failed: %s", decrypted))
+		return
+	}
+}
+
+func TestAsymmetricBinding(t *testing.T) {
+	pubPath, privPath := writeTestKeys(t)
+	cipher, err := LoadAsymmetricCipher(pubPath, privPath)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	encrypted, err := cipher.EncryptWithData("bound", []byte("path=.A"))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if decrypted, err := cipher.DecryptWithData(encrypted, []byte("path=.A")); err != nil || decrypted != "bound" {
+		t.Error(fmt.Errorf("Failed to decrypt bound value: %q (%v)", decrypted, err))
+		return
+	}
+
+	// Moved values are reported as such, and removing the tag does not
+	// unbind them
+	if _, err := cipher.DecryptWithData(encrypted, []byte("path=.B")); err != errValueMoved {
+		t.Error(fmt.Errorf("Expected the value to be reported as moved, but got: %v", err))
+		return
+	}
+	_, untagged, _ := cutBoundValue(encrypted)
+	if _, err := cipher.DecryptWithData(untagged, []byte("path=.B")); err == nil {
+		t.Error(fmt.Errorf("Expected an untagged bound value to fail to decrypt"))
+		return
+	}
+
+	// Values that were never bound decrypt at any path
+	unbound, err := cipher.Encrypt("unbound")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if decrypted, err := cipher.DecryptWithData(unbound, []byte("path=.B")); err != nil || decrypted != "unbound" {
+		t.Error(fmt.Errorf("Failed to decrypt unbound value: %q (%v)", decrypted, err))
+		return
+	}
+}
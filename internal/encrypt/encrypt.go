@@ -1,6 +1,7 @@
 package encrypt
 
 import (
+	"bytes"
 	"crypto/aes"
 	"crypto/cipher"
 	"crypto/hmac"
@@ -9,7 +10,9 @@ import (
 	"encoding/hex"
 	"fmt"
 
+	"github.com/karimsa/secrets/internal/ciphers"
 	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/chacha20poly1305"
 )
 
 type EncryptionStrategy int
@@ -31,6 +34,114 @@ const (
 	hmacLength = 256 / 8
 )
 
+const (
+	// AlgorithmAESGCM encrypts values using AES-256 in GCM mode
+	AlgorithmAESGCM = "aes-256-gcm"
+
+	// AlgorithmXChaCha20Poly1305 encrypts values using XChaCha20-Poly1305
+	AlgorithmXChaCha20Poly1305 = "xchacha20-poly1305"
+
+	// DefaultAlgorithm is the algorithm used for newly encrypted values
+	DefaultAlgorithm = AlgorithmAESGCM
+
+	// algAESCBCHMAC is AES-256-CBC with encrypt-then-MAC, which is only
+	// supported for decrypting existing values
+	algAESCBCHMAC = "aes-256-cbc-hmac-sha256"
+
+	kdfArgon2id = "argon2id"
+	subkeyHKDF  = "hkdf-sha256"
+	sivHMAC     = "hmac-sha256"
+	padISO7816  = "iso7816"
+)
+
+// KDFParams are the parameters given to argon2id when deriving keys from a
+// passphrase. They are recorded in every encrypted value, so decryption never
+// needs to be told which params were used.
+type KDFParams struct {
+	// Time is the number of passes over the memory
+	Time uint32
+
+	// Memory is the amount of memory used, in KiB
+	Memory uint32
+
+	// Threads is the number of threads used
+	Threads uint8
+}
+
+// DefaultKDFParams are used to encrypt new values, unless others are given
+var DefaultKDFParams = KDFParams{
+	Time:    3,
+	Memory:  32 * 1024,
+	Threads: 4,
+}
+
+const (
+	// maxKDFTime and maxKDFMemory bound the params that will be accepted
+	// from encrypted values, so that a malicious value cannot exhaust
+	// resources while being decrypted
+	maxKDFTime   = 64
+	maxKDFMemory = 4 * 1024 * 1024
+)
+
+func (p KDFParams) validate() error {
+	if p.Time < 1 || p.Time > maxKDFTime {
+		return fmt.Errorf("Invalid argon2 time: %d (must be between 1 and %d)", p.Time, maxKDFTime)
+	}
+	if p.Threads < 1 {
+		return fmt.Errorf("Invalid argon2 threads: %d (must be between 1 and 255)", p.Threads)
+	}
+	if p.Memory < 8*uint32(p.Threads) || p.Memory > maxKDFMemory {
+		return fmt.Errorf("Invalid argon2 memory: %d KiB (must be between %d and %d)", p.Memory, 8*uint32(p.Threads), maxKDFMemory)
+	}
+	return nil
+}
+
+func (p KDFParams) deriveKey(passphrase, salt []byte, keyLength uint32) []byte {
+	return argon2.IDKey(passphrase, salt, p.Time, p.Memory, p.Threads, keyLength)
+}
+
+func (p KDFParams) writeTo(e *envelope) {
+	e.set("kdf", kdfArgon2id)
+	e.setInt("t", int(p.Time))
+	e.setInt("m", int(p.Memory))
+	e.setInt("p", int(p.Threads))
+}
+
+func readKDFParams(e *envelope) (KDFParams, error) {
+	kdf, err := e.require("kdf")
+	if err != nil {
+		return KDFParams{}, err
+	}
+	if kdf != kdfArgon2id {
+		return KDFParams{}, fmt.Errorf("Unsupported key derivation function: %s", kdf)
+	}
+
+	time, err := e.getInt("t")
+	if err != nil {
+		return KDFParams{}, err
+	}
+	memory, err := e.getInt("m")
+	if err != nil {
+		return KDFParams{}, err
+	}
+	threads, err := e.getInt("p")
+	if err != nil {
+		return KDFParams{}, err
+	}
+	if time < 1 || memory < 1 || threads < 1 || threads > 255 || memory > maxKDFMemory {
+		return KDFParams{}, fmt.Errorf("Invalid key derivation params: t=%d, m=%d, p=%d", time, memory, threads)
+	}
+
+	params := KDFParams{
+		Time:    uint32(time),
+		Memory:  uint32(memory),
+		Threads: uint8(threads),
+	}
+	return params, params.validate()
+}
+
+// initCipher derives the key used by legacy (v1) values, which were
+// encrypted and signed using the same key.
 func initCipher(passphrase, salt []byte) (cipher.Block, []byte, error) {
 	key := argon2.Key(
 		passphrase,
@@ -44,13 +155,97 @@ func initCipher(passphrase, salt []byte) (cipher.Block, []byte, error) {
 	return block, key, err
 }
 
+// SimpleSymmetricCipher encrypts values using a key derived from a passphrase.
+//
+// The passphrase is only run through argon2 once per file: all values that
+// are encrypted by the same cipher share a single salt (which is stored in
+// each value), and each value is encrypted with its own subkey derived from
+// the resulting master key using HKDF. When a file is opened, the salt of its
+// existing values is adopted for any new values.
 type SimpleSymmetricCipher struct {
-	pass []byte
+	pass          []byte
+	algorithm     string
+	kdf           KDFParams
+	deterministic bool
+	encoding      string
+	keys          *keyCache
+}
+
+type SymmetricCipherOptions struct {
+	// Algorithm is the AEAD used to encrypt new values (defaults to
+	// DefaultAlgorithm). Decryption always uses the algorithm recorded in
+	// the value.
+	Algorithm string
+
+	// KDF are the argon2 params used to encrypt new values (defaults to
+	// DefaultKDFParams). Decryption always uses the params recorded in the
+	// value.
+	KDF KDFParams
+
+	// Deterministic encrypts the same plaintext at the same path to the same
+	// value, so that re-encrypting a file does not change it. The nonce of
+	// each value is derived from its plaintext (like AES-SIV), and new values
+	// reuse the salt of the file. This reveals which values are equal, so it
+	// is off by default.
+	Deterministic bool
+
+	// Encoding is the encoding of new values (defaults to EncodingHex).
+	// Decryption detects the encoding of each value.
+	Encoding string
 }
 
 func NewSymmetricCipher(pass []byte) SimpleSymmetricCipher {
 	return SimpleSymmetricCipher{
-		pass: pass,
+		pass:      pass,
+		algorithm: DefaultAlgorithm,
+		kdf:       DefaultKDFParams,
+		encoding:  EncodingHex,
+		keys:      newKeyCache(),
+	}
+}
+
+func NewSymmetricCipherWithOptions(pass []byte, options SymmetricCipherOptions) (SimpleSymmetricCipher, error) {
+	s := NewSymmetricCipher(pass)
+
+	if options.Algorithm != "" {
+		if _, err := newAEAD(options.Algorithm, make([]byte, dataKeyLength)); err != nil {
+			return s, err
+		}
+		s.algorithm = options.Algorithm
+	}
+
+	if options.KDF != (KDFParams{}) {
+		if err := options.KDF.validate(); err != nil {
+			return s, err
+		}
+		s.kdf = options.KDF
+	}
+
+	if options.Encoding != "" {
+		if err := checkEncoding(options.Encoding); err != nil {
+			return s, err
+		}
+		s.encoding = options.Encoding
+	}
+
+	s.deterministic = options.Deterministic
+	return s, nil
+}
+
+func newAEAD(algorithm string, key []byte) (cipher.AEAD, error) {
+	switch algorithm {
+	case AlgorithmAESGCM:
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+		return cipher.NewGCM(block)
+
+	case AlgorithmXChaCha20Poly1305:
+		return chacha20poly1305.NewX(key)
+
+	default:
+		return nil, fmt.Errorf("Unsupported encryption algorithm: %s", algorithm)
 	}
 }
 
@@ -64,6 +259,9 @@ func verify(key, data, expected []byte) bool {
 	return hmac.Equal(sign(key, data), expected)
 }
 
+// symmetricEnvelope is the legacy (v1) format of encrypted values, which is
+// a bare hex blob of the IV, salt, HMAC and ciphertext. It is only supported
+// for decryption.
 type symmetricEnvelope struct {
 	buffer     []byte
 	iv         []byte
@@ -72,11 +270,6 @@ type symmetricEnvelope struct {
 	cipherText []byte
 }
 
-func newSymmetricEnvelope(dataSize int) symmetricEnvelope {
-	buffer := make([]byte, aes.BlockSize+dataSize+saltLength+hmacLength)
-	return openSymmetricEnvelope(buffer)
-}
-
 func openSymmetricEnvelope(buffer []byte) symmetricEnvelope {
 	return symmetricEnvelope{
 		buffer: buffer,
@@ -89,38 +282,359 @@ func openSymmetricEnvelope(buffer []byte) symmetricEnvelope {
 	}
 }
 
-func (s symmetricEnvelope) export() string {
-	return hex.EncodeToString(s.buffer)
+// masterKeyID identifies the key that a value was encrypted with, so that
+// values encrypted with a different passphrase can be told apart from values
+// that are corrupted. Since it is derived from the master key, checking a
+// passphrase against it is as slow as trying to decrypt the value.
+func masterKeyID(masterKey []byte) string {
+	return hex.EncodeToString(sign(masterKey, []byte("secrets/v2/kid"))[:keyIDLength])
+}
+
+// associatedDataTag identifies the associated data a value was bound to, so
+// that values which have been moved can be reported clearly.
+func associatedDataTag(associatedData []byte) string {
+	sum := sha256.Sum256(associatedData)
+	return hex.EncodeToString(sum[:8])
 }
 
 func (s SimpleSymmetricCipher) Encrypt(str string) (string, error) {
-	raw := pkcs7Pad([]byte(str), aes.BlockSize)
-	e := newSymmetricEnvelope(len(raw))
+	return s.EncryptWithData(str, nil)
+}
+
+// EncryptWithData encrypts a value and binds it to the given associated data,
+// which must be given again to decrypt it.
+func (s SimpleSymmetricCipher) EncryptWithData(str string, associatedData []byte) (string, error) {
+	return s.EncryptPadded(str, associatedData, 0)
+}
 
-	_, err := rand.Read(e.salt)
+// EncryptPadded encrypts a value like EncryptWithData, after padding it to the
+// given length.
+func (s SimpleSymmetricCipher) EncryptPadded(str string, associatedData []byte, length int) (string, error) {
+	e := newEnvelope()
+	e.set("alg", s.algorithm)
+	e.setEncoding(s.encoding)
+	s.kdf.writeTo(e)
+	e.set("subkey", subkeyHKDF)
+	if len(associatedData) > 0 {
+		e.set("ad", associatedDataTag(associatedData))
+	}
+
+	salt, err := s.keys.fileSalt(func() ([]byte, error) {
+		salt := make([]byte, saltLength)
+		_, err := rand.Read(salt)
+		return salt, err
+	})
 	if err != nil {
 		return "", err
 	}
+	e.setBytes("salt", salt)
 
-	block, key, err := initCipher(s.pass, e.salt)
+	masterKey, err := s.keys.deriveKey(s.pass, s.kdf, salt, dataKeyLength)
+	if err != nil {
+		return "", err
+	}
+	e.set("kid", masterKeyID(masterKey))
+	if s.deterministic {
+		e.set("siv", sivHMAC)
+	}
+	return sealEnvelope(e, s.algorithm, masterKey, []byte(str), associatedData, length)
+}
+
+// PaddedLength returns the length that an encrypted value was padded to, or 0
+// if it was not padded.
+func (s SimpleSymmetricCipher) PaddedLength(encrypted string) (int, error) {
+	return envelopePaddedLength(encrypted)
+}
+
+// sealEnvelope encrypts a value with a subkey of the master key, and stores
+// the nonce and ciphertext in the envelope. Every other param must already be
+// set, since they are authenticated along with the value. Envelopes with a
+// siv param get a synthetic nonce instead of a random one. If padTo is given,
+// the value is padded to that length first.
+func sealEnvelope(e *envelope, algorithm string, masterKey, plainText, associatedData []byte, padTo int) (string, error) {
+	if padTo > 0 {
+		padded, err := padPlainText(plainText, padTo)
+		if err != nil {
+			return "", err
+		}
+		e.set("pad", padISO7816)
+		plainText = padded
+	}
+
+	subkey, err := deriveSubkey(masterKey, algorithm, associatedData)
+	if err != nil {
+		return "", err
+	}
+	aead, err := newAEAD(algorithm, subkey)
+	if err != nil {
+		return "", err
+	}
+
+	var nonce []byte
+	if _, synthetic := e.get("siv"); synthetic {
+		nonce, err = syntheticNonce(e, subkey, aead.NonceSize(), plainText, associatedData)
+		if err != nil {
+			return "", err
+		}
+	} else {
+		nonce = make([]byte, aead.NonceSize())
+		if _, err := rand.Read(nonce); err != nil {
+			return "", err
+		}
+	}
+	e.setBytes("nonce", nonce)
+	e.setBytes("data", aead.Seal(nil, nonce, plainText, append(e.header(), associatedData...)))
+
+	return e.String(), nil
+}
+
+func (s SimpleSymmetricCipher) Decrypt(encrypted string) (string, error) {
+	return s.DecryptWithData(encrypted, nil)
+}
+
+// DecryptWithData decrypts a value that was bound to the given associated
+// data. Values that were not bound to any associated data are decrypted as-is.
+func (s SimpleSymmetricCipher) DecryptWithData(encrypted string, associatedData []byte) (string, error) {
+	if isEnvelope(encrypted) {
+		e, err := parseEnvelope(encrypted)
+		if err != nil {
+			return "", err
+		}
+		return s.decryptEnvelope(e, associatedData)
+	}
+	return s.decryptLegacy(encrypted)
+}
+
+func (s SimpleSymmetricCipher) decryptEnvelope(e *envelope, associatedData []byte) (string, error) {
+	if e.version != envelopeVersion {
+		return "", fmt.Errorf("Unsupported envelope version: v%d", e.version)
+	}
+
+	associatedData, err := checkAssociatedData(e, associatedData)
 	if err != nil {
 		return "", err
 	}
 
-	if _, err := rand.Read(e.iv); err != nil {
+	alg, err := e.require("alg")
+	if err != nil {
+		return "", err
+	}
+	params, err := readKDFParams(e)
+	if err != nil {
+		return "", err
+	}
+	salt, err := e.getBytes("salt")
+	if err != nil {
 		return "", err
 	}
 
-	cbc := cipher.NewCBCEncrypter(block, e.iv)
-	cbc.CryptBlocks(e.cipherText, raw)
+	if alg == algAESCBCHMAC {
+		cipherText, err := e.getBytes("data")
+		if err != nil {
+			return "", err
+		}
+		return s.decryptCBC(e, params, salt, cipherText)
+	}
 
-	signature := sign(key, e.cipherText)
-	copy(e.signature, signature)
+	masterKey, err := s.keys.deriveKey(s.pass, params, salt, dataKeyLength)
+	if err != nil {
+		return "", err
+	}
+	if kid, ok := e.get("kid"); ok && kid != masterKeyID(masterKey) {
+		return "", &ciphers.KeyMismatchError{KeyID: kid}
+	}
+	plainText, err := openEnvelope(e, alg, masterKey, associatedData)
+	if err != nil {
+		return "", err
+	}
 
-	return e.export(), nil
+	if params == s.kdf {
+		s.keys.adoptSalt(salt)
+	}
+	return string(plainText), nil
 }
 
-func (s SimpleSymmetricCipher) Decrypt(encrypted string) (decrypted string, err error) {
+// errValueMoved is returned when a value is bound to different associated data
+// than it is being decrypted with.
+var errValueMoved = fmt.Errorf("Value is bound to a different location (it may have been moved or copied)")
+
+// checkAssociatedData verifies that a value is bound to the given associated
+// data, and returns the associated data that it should be decrypted with.
+// Values that were not bound to any associated data are decrypted without it.
+func checkAssociatedData(e *envelope, associatedData []byte) ([]byte, error) {
+	tag, bound := e.get("ad")
+	if !bound {
+		return nil, nil
+	}
+	if tag != associatedDataTag(associatedData) {
+		return nil, errValueMoved
+	}
+	return associatedData, nil
+}
+
+// openEnvelope decrypts a value that was sealed by sealEnvelope.
+func openEnvelope(e *envelope, algorithm string, masterKey, associatedData []byte) ([]byte, error) {
+	nonce, err := e.getBytes("nonce")
+	if err != nil {
+		return nil, err
+	}
+	cipherText, err := e.getBytes("data")
+	if err != nil {
+		return nil, err
+	}
+
+	// Values without a subkey were encrypted directly with the master key
+	key := masterKey
+	if subkey, hasSubkey := e.get("subkey"); hasSubkey {
+		if subkey != subkeyHKDF {
+			return nil, fmt.Errorf("Unsupported subkey derivation: %s", subkey)
+		}
+		key, err = deriveSubkey(masterKey, algorithm, associatedData)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	aead, err := newAEAD(algorithm, key)
+	if err != nil {
+		return nil, err
+	}
+	if len(nonce) != aead.NonceSize() {
+		return nil, fmt.Errorf("Failed to decrypt value")
+	}
+
+	plainText, err := aead.Open(nil, nonce, cipherText, append(e.header(), associatedData...))
+	if err != nil {
+		return nil, fmt.Errorf("Failed to decrypt value")
+	}
+
+	// Synthetic nonces must match the plaintext they were derived from
+	if _, synthetic := e.get("siv"); synthetic {
+		expected, err := syntheticNonce(e, key, len(nonce), plainText, associatedData)
+		if err != nil {
+			return nil, err
+		}
+		if !hmac.Equal(nonce, expected) {
+			return nil, fmt.Errorf("Failed to decrypt value")
+		}
+	}
+
+	if pad, padded := e.get("pad"); padded {
+		if pad != padISO7816 {
+			return nil, fmt.Errorf("Unsupported padding: %s", pad)
+		}
+		return unpadPlainText(plainText)
+	}
+	return plainText, nil
+}
+
+// aeadOverhead is the length of the tag that both algorithms add to a value.
+const aeadOverhead = 16
+
+// envelopePaddedLength returns the length that the value of an envelope was
+// padded to by sealEnvelope, or 0 if it was not padded. Legacy values are
+// never padded.
+func envelopePaddedLength(encrypted string) (int, error) {
+	if !isEnvelope(encrypted) {
+		return 0, nil
+	}
+	e, err := parseEnvelope(encrypted)
+	if err != nil {
+		return 0, err
+	}
+	if _, padded := e.get("pad"); !padded {
+		return 0, nil
+	}
+	data, err := e.getBytes("data")
+	if err != nil {
+		return 0, err
+	}
+
+	// The padding takes at least one byte (see padPlainText)
+	length := len(data) - aeadOverhead - 1
+	if length < 0 {
+		return 0, fmt.Errorf("Invalid padding")
+	}
+	return length, nil
+}
+
+// padPlainText pads a value to the given length using ISO/IEC 7816-4 padding
+// (a single 0x80 byte followed by zeros). The padding takes at least one
+// byte, so the result is one byte longer than the given length.
+func padPlainText(plainText []byte, length int) ([]byte, error) {
+	if len(plainText) > length {
+		return nil, fmt.Errorf("Value is too long to be padded: %d bytes (must be at most %d)", len(plainText), length)
+	}
+	padded := make([]byte, length+1)
+	copy(padded, plainText)
+	padded[len(plainText)] = 0x80
+	return padded, nil
+}
+
+func unpadPlainText(padded []byte) ([]byte, error) {
+	trimmed := bytes.TrimRight(padded, "\x00")
+	if len(trimmed) == 0 || trimmed[len(trimmed)-1] != 0x80 {
+		return nil, fmt.Errorf("Invalid padding")
+	}
+	return trimmed[:len(trimmed)-1], nil
+}
+
+// syntheticNonce derives the nonce of a value from its plaintext, its
+// associated data, and the params of its envelope, so that encrypting the same
+// value twice gives the same result. This is the synthetic IV construction of
+// AES-SIV (RFC 5297), using HMAC-SHA256 as the PRF: since the nonce only
+// repeats when the plaintext does, nonces are never reused for different
+// plaintexts.
+func syntheticNonce(e *envelope, subkey []byte, size int, plainText, associatedData []byte) ([]byte, error) {
+	if mode, _ := e.get("siv"); mode != sivHMAC {
+		return nil, fmt.Errorf("Unsupported synthetic nonce: %s", mode)
+	}
+
+	mac := hmac.New(sha256.New, sign(subkey, []byte("secrets/v2/siv")))
+	for _, param := range e.params {
+		if param.key != "nonce" && param.key != "data" && param.key != "mac" {
+			fmt.Fprintf(mac, "%s=%s,", param.key, param.value)
+		}
+	}
+	fmt.Fprintf(mac, "%d:", len(associatedData))
+	mac.Write(associatedData)
+	mac.Write(plainText)
+	return mac.Sum(nil)[:size], nil
+}
+
+func (s SimpleSymmetricCipher) decryptCBC(e *envelope, params KDFParams, salt, cipherText []byte) (string, error) {
+	iv, err := e.getBytes("iv")
+	if err != nil {
+		return "", err
+	}
+	signature, err := e.getBytes("mac")
+	if err != nil {
+		return "", err
+	}
+	if len(iv) != aes.BlockSize || len(cipherText) == 0 || len(cipherText)%aes.BlockSize != 0 {
+		return "", fmt.Errorf("Failed to decrypt value")
+	}
+
+	key, err := s.keys.deriveKey(s.pass, params, salt, 2*dataKeyLength)
+	if err != nil {
+		return "", err
+	}
+	if !verify(key[dataKeyLength:], append(e.header(), cipherText...), signature) {
+		return "", fmt.Errorf("Failed to decrypt value")
+	}
+
+	block, err := aes.NewCipher(key[:dataKeyLength])
+	if err != nil {
+		return "", err
+	}
+
+	text := make([]byte, len(cipherText))
+	cbc := cipher.NewCBCDecrypter(block, iv)
+	cbc.CryptBlocks(text, cipherText)
+	return string(pkcs7Unpad(text)), nil
+}
+
+func (s SimpleSymmetricCipher) decryptLegacy(encrypted string) (decrypted string, err error) {
 	defer func() {
 		if r := recover(); err == nil && r != nil {
 			if e, isErr := r.(error); isErr {
@@ -137,6 +651,12 @@ func (s SimpleSymmetricCipher) Decrypt(encrypted string) (decrypted string, err
 	}
 	e := openSymmetricEnvelope(buffer)
 
+	// Legacy keys are never cached
+	if s.keys.locked {
+		err = errKeyNotCached
+		return
+	}
+
 	block, key, err := initCipher(s.pass, e.salt)
 	if err != nil {
 		return
@@ -155,14 +675,6 @@ func (s SimpleSymmetricCipher) Decrypt(encrypted string) (decrypted string, err
 	return
 }
 
-func pkcs7Pad(data []byte, blkSize int) []byte {
-	padSize := blkSize - ((len(data) + 1) % blkSize)
-	result := make([]byte, len(data)+padSize+1)
-	copy(result[:len(data)+1], data)
-	result[len(result)-1] = byte(padSize)
-	return result
-}
-
 func pkcs7Unpad(padded []byte) []byte {
 	padSize := 1 + int(padded[len(padded)-1])
 	return padded[:len(padded)-padSize]
@@ -7,8 +7,20 @@ import (
 	"strconv"
 	"strings"
 	"testing"
+
+	"github.com/karimsa/secrets"
 )
 
+// pkcs7Pad pads data the way that legacy CBC values were padded before they
+// were encrypted. New values are never CBC encrypted, so only tests need it.
+func pkcs7Pad(data []byte, blkSize int) []byte {
+	padSize := blkSize - ((len(data) + 1) % blkSize)
+	result := make([]byte, len(data)+padSize+1)
+	copy(result[:len(data)+1], data)
+	result[len(result)-1] = byte(padSize)
+	return result
+}
+
 func TestPadding(t *testing.T) {
 	data := []byte{1, 1, 1}
 	paddedBuff := pkcs7Pad(data, 16)
@@ -88,3 +100,552 @@ func TestSignVerify(t *testing.T) {
 		return
 	}
 }
+
+func TestSymmetricEnvelope(t *testing.T) {
+	encrypted, err := NewSymmetricCipher([]byte("testing")).Encrypt("some test text")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if !strings.HasPrefix(encrypted, "ENC[v2,alg=") {
+		t.Error(fmt.Errorf("Value was not encrypted into a versioned envelope: %s", encrypted))
+		return
+	}
+
+	e, err := parseEnvelope(encrypted)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if e.String() != encrypted {
+		t.Error(fmt.Errorf("Envelope did not survive a round-trip:\n%s\n%s", e.String(), encrypted))
+		return
+	}
+
+	// Tampering with the header should be detected
+	tampered := strings.Replace(encrypted, ",t=3,", ",t=4,", 1)
+	if decrypted, err := NewSymmetricCipher([]byte("testing")).Decrypt(tampered); err == nil {
+		t.Error(fmt.Errorf("Decryption of tampered envelope should have failed: %s", decrypted))
+		return
+	}
+}
+
+func TestLegacyDecrypt(t *testing.T) {
+	legacy := "d4c024a2df7bad9a7fba233dee4a50d5520165da1a26e54711a0e060f2c3693db01cf2ebb71a4d1b9b7e6f9278af1188382fdea6e76c3f18d859ff7e3be43baaa5fa5ad4281359921120d06a7b76f8210019a13180d1f1207529952a5377971d"
+
+	decrypted, err := NewSymmetricCipher([]byte("testing")).Decrypt(legacy)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if decrypted != "legacy secret value" {
+		t.Error(fmt.Sprintf("Decryption failed: '%s' (%d)", decrypted, len(decrypted)))
+		return
+	}
+
+	if decrypted, err := NewSymmetricCipher([]byte("bad pass")).Decrypt(legacy); err == nil {
+		t.Error(fmt.Errorf("Decryption should have failed: %s", decrypted))
+		return
+	}
+}
+
+func TestAEADAlgorithms(t *testing.T) {
+	for _, algorithm := range []string{AlgorithmAESGCM, AlgorithmXChaCha20Poly1305} {
+		cipher, err := NewSymmetricCipherWithOptions([]byte("testing"), SymmetricCipherOptions{
+			Algorithm: algorithm,
+		})
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		encrypted, err := cipher.Encrypt("some test text")
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		if !strings.HasPrefix(encrypted, "ENC[v2,alg="+algorithm+",") {
+			t.Error(fmt.Errorf("Value was not encrypted using %s: %s", algorithm, encrypted))
+			return
+		}
+
+		// Decryption should not depend on the configured algorithm
+		decrypted, err := NewSymmetricCipher([]byte("testing")).Decrypt(encrypted)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		if decrypted != "some test text" {
+			t.Error(fmt.Sprintf("Decryption failed: '%s' (%d)", decrypted, len(decrypted)))
+			return
+		}
+	}
+
+	if _, err := NewSymmetricCipherWithOptions([]byte("testing"), SymmetricCipherOptions{
+		Algorithm: "aes-256-cbc-hmac-sha256",
+	}); err == nil {
+		t.Error(fmt.Errorf("CBC should not be allowed for encryption"))
+		return
+	}
+}
+
+func TestCBCDecrypt(t *testing.T) {
+	encrypted := "ENC[v2,alg=aes-256-cbc-hmac-sha256,kdf=argon2id,t=3,m=32768,p=4,salt=ac335aa7bcf65bb6cc418373fcc4dc46,iv=a024aee37819bc7e70a2104222c3bbaa,data=aca2b0cc1dddb84d6eeca0f01977eb57f100b825c846f5f035b874f7eff10209,mac=76b3aa43fdee674fb541c35c54a1341cd3d7d7a8ff7798b961445a895fe170d4]"
+
+	decrypted, err := NewSymmetricCipher([]byte("testing")).Decrypt(encrypted)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if decrypted != "cbc secret value" {
+		t.Error(fmt.Sprintf("Decryption failed: '%s' (%d)", decrypted, len(decrypted)))
+		return
+	}
+
+	if decrypted, err := NewSymmetricCipher([]byte("bad pass")).Decrypt(encrypted); err == nil {
+		t.Error(fmt.Errorf("Decryption should have failed: %s", decrypted))
+		return
+	}
+}
+
+func TestDecryptWithoutSubkey(t *testing.T) {
+	encrypted := "ENC[v2,alg=aes-256-gcm,kdf=argon2id,t=3,m=32768,p=4,salt=5652b9e7172287f2efd383ce557c6452,nonce=efc61488f368cad21f1e8ab7,data=a0c058f1292814c212c88268b50b1177f246a514153c0fba46c483bea6f0d112]"
+
+	decrypted, err := NewSymmetricCipher([]byte("testing")).Decrypt(encrypted)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if decrypted != "direct key value" {
+		t.Error(fmt.Sprintf("Decryption failed: '%s' (%d)", decrypted, len(decrypted)))
+		return
+	}
+}
+
+func TestAssociatedData(t *testing.T) {
+	cipher := NewSymmetricCipher([]byte("testing"))
+	encrypted, err := cipher.EncryptWithData("some test text", []byte("path=['db']['password']"))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	decrypted, err := cipher.DecryptWithData(encrypted, []byte("path=['db']['password']"))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if decrypted != "some test text" {
+		t.Error(fmt.Sprintf("Decryption failed: '%s' (%d)", decrypted, len(decrypted)))
+		return
+	}
+
+	if _, err := cipher.DecryptWithData(encrypted, []byte("path=['api']['token']")); err == nil || !strings.Contains(err.Error(), "moved") {
+		t.Error(fmt.Errorf("Decryption at another path should fail clearly: %v", err))
+		return
+	}
+	if _, err := cipher.Decrypt(encrypted); err == nil {
+		t.Error(fmt.Errorf("Decryption without associated data should fail"))
+		return
+	}
+
+	// Values that were never bound can still be decrypted
+	unbound, err := cipher.Encrypt("some test text")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if _, err := cipher.DecryptWithData(unbound, []byte("path=['api']['token']")); err != nil {
+		t.Error(err)
+		return
+	}
+}
+
+func TestFileLevelKDF(t *testing.T) {
+	encrypter := NewSymmetricCipher([]byte("testing"))
+	values := make([]string, 20)
+	for i := range values {
+		encrypted, err := encrypter.EncryptWithData(fmt.Sprintf("value #%d", i), []byte(fmt.Sprintf("path=['key%d']", i)))
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		values[i] = encrypted
+	}
+	if len(encrypter.keys.keys) != 1 {
+		t.Error(fmt.Errorf("Expected a single key to be derived for all values, got %d", len(encrypter.keys.keys)))
+		return
+	}
+
+	decrypter := NewSymmetricCipher([]byte("testing"))
+	for i, encrypted := range values {
+		decrypted, err := decrypter.DecryptWithData(encrypted, []byte(fmt.Sprintf("path=['key%d']", i)))
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		if decrypted != fmt.Sprintf("value #%d", i) {
+			t.Error(fmt.Sprintf("Decryption failed: '%s'", decrypted))
+			return
+		}
+	}
+	if len(decrypter.keys.keys) != 1 {
+		t.Error(fmt.Errorf("Expected a single key to be derived for all values, got %d", len(decrypter.keys.keys)))
+		return
+	}
+
+	// New values should re-use the salt of the values that were decrypted
+	encrypted, err := decrypter.Encrypt("new value")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	oldEnvelope, _ := parseEnvelope(values[0])
+	newEnvelope, _ := parseEnvelope(encrypted)
+	oldSalt, _ := oldEnvelope.get("salt")
+	newSalt, _ := newEnvelope.get("salt")
+	if oldSalt != newSalt {
+		t.Error(fmt.Errorf("New value did not adopt the existing salt: %s != %s", newSalt, oldSalt))
+		return
+	}
+}
+
+func TestKDFParams(t *testing.T) {
+	cipher, err := NewSymmetricCipherWithOptions([]byte("testing"), SymmetricCipherOptions{
+		KDF: KDFParams{
+			Time:    1,
+			Memory:  64,
+			Threads: 1,
+		},
+	})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	encrypted, err := cipher.Encrypt("some test text")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if !strings.Contains(encrypted, ",kdf=argon2id,t=1,m=64,p=1,") {
+		t.Error(fmt.Errorf("KDF params were not recorded in value: %s", encrypted))
+		return
+	}
+
+	// Decryption should not depend on the configured params
+	decrypted, err := NewSymmetricCipher([]byte("testing")).Decrypt(encrypted)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if decrypted != "some test text" {
+		t.Error(fmt.Sprintf("Decryption failed: '%s' (%d)", decrypted, len(decrypted)))
+		return
+	}
+
+	for _, params := range []KDFParams{
+		{Time: 0, Memory: 64, Threads: 1},
+		{Time: 1, Memory: 4, Threads: 1},
+		{Time: 1, Memory: 64, Threads: 0},
+		{Time: 1, Memory: maxKDFMemory + 1, Threads: 1},
+	} {
+		if _, err := NewSymmetricCipherWithOptions([]byte("testing"), SymmetricCipherOptions{KDF: params}); err == nil {
+			t.Error(fmt.Errorf("Expected invalid params to be rejected: %#v", params))
+			return
+		}
+	}
+
+	tampered := strings.Replace(encrypted, ",m=64,", fmt.Sprintf(",m=%d,", maxKDFMemory+1), 1)
+	if _, err := cipher.Decrypt(tampered); err == nil || !strings.Contains(err.Error(), "Invalid") {
+		t.Error(fmt.Errorf("Expected excessive params to be rejected: %v", err))
+		return
+	}
+}
+
+func TestKeyID(t *testing.T) {
+	kdf := KDFParams{Time: 1, Memory: 64, Threads: 1}
+	cipher, err := NewSymmetricCipherWithOptions([]byte("testing"), SymmetricCipherOptions{KDF: kdf})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	other, err := NewSymmetricCipherWithOptions([]byte("bad pass"), SymmetricCipherOptions{KDF: kdf})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	encrypted, err := cipher.Encrypt("some test text")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	e, err := parseEnvelope(encrypted)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	kid, ok := e.get("kid")
+	if !ok || len(kid) != 2*keyIDLength {
+		t.Error(fmt.Errorf("Expected value to record its key id: %s", encrypted))
+		return
+	}
+
+	// A different passphrase is reported as such
+	_, err = other.Decrypt(encrypted)
+	if mismatch, ok := err.(*secrets.KeyMismatchError); !ok || mismatch.KeyID != kid {
+		t.Error(fmt.Errorf("Expected a key mismatch: %v", err))
+		return
+	}
+
+	// A corrupted value is not
+	corrupted := strings.Replace(encrypted, "data=", "data=00", 1)
+	if _, err := cipher.Decrypt(corrupted); err == nil || err.Error() != "Failed to decrypt value" {
+		t.Error(fmt.Errorf("Expected corrupted value to fail to decrypt: %v", err))
+		return
+	}
+
+	// Files with values from both passphrases report which values differ
+	otherValue, err := other.EncryptWithData("other text", []byte("path=['B']"))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	firstValue, err := cipher.EncryptWithData("first text", []byte("path=['A']"))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	_, err = secrets.Open(secrets.OpenEnvOptions{
+		Format:      "dotenv",
+		Reader:      strings.NewReader("A=" + firstValue + "\nB=" + otherValue + "\n"),
+		Cipher:      cipher,
+		SecurePaths: []string{".A", ".B"},
+	})
+	if err == nil || !strings.HasPrefix(err.Error(), "1 of 2 values were encrypted with a different key:\n\tkey ") {
+		t.Error(fmt.Errorf("Unexpected error: %v", err))
+		return
+	}
+}
+
+func TestDeterministic(t *testing.T) {
+	options := SymmetricCipherOptions{
+		KDF:           KDFParams{Time: 1, Memory: 64, Threads: 1},
+		Deterministic: true,
+	}
+	newCipher := func() SimpleSymmetricCipher {
+		cipher, err := NewSymmetricCipherWithOptions([]byte("testing"), options)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return cipher
+	}
+	export := func(env *secrets.EnvFile, err error) string {
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := env.Export("dotenv")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(data)
+	}
+	create := func() string {
+		return export(secrets.New(secrets.NewEnvOptions{
+			Format:      "dotenv",
+			Reader:      strings.NewReader("A=same\nB=same\nC=other\n"),
+			Cipher:      newCipher(),
+			SecurePaths: []string{".A", ".B", ".C"},
+		}))
+	}
+	reencrypt := func(encrypted string) string {
+		return export(secrets.Open(secrets.OpenEnvOptions{
+			Format:      "dotenv",
+			Reader:      strings.NewReader(encrypted),
+			Cipher:      newCipher(),
+			SecurePaths: []string{".A", ".B", ".C"},
+		}))
+	}
+
+	// Re-encrypting a file keeps its salt, so its values do not change
+	first := create()
+	if second := reencrypt(first); first != second {
+		t.Error(fmt.Errorf("Expected deterministic output:\n%s\n%s", first, second))
+		return
+	}
+
+	// New files get a random salt, so they never match each other
+	if second := create(); first == second {
+		t.Error(fmt.Errorf("Expected new files to use different salts:\n%s\n%s", first, second))
+		return
+	}
+	if !strings.Contains(first, ",siv=hmac-sha256,") {
+		t.Error(fmt.Errorf("Expected values to record their nonce mode:\n%s", first))
+		return
+	}
+
+	// Equal values at different paths are still encrypted differently
+	lines := strings.Split(first, "\n")
+	if lines[0][2:] == lines[1][2:] {
+		t.Error(fmt.Errorf("Expected values to be keyed per path:\n%s", first))
+		return
+	}
+
+	// Values can be decrypted without deterministic mode
+	env, err := secrets.Open(secrets.OpenEnvOptions{
+		Format:      "dotenv",
+		Reader:      strings.NewReader(first),
+		Cipher:      NewSymmetricCipher([]byte("testing")),
+		SecurePaths: []string{".A", ".B", ".C"},
+	})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if raw, _ := env.UnsafeRawExport("dotenv"); string(raw) != "A=same\nB=same\nC=other\n" {
+		t.Error(fmt.Errorf("Unexpected output:\n%s", raw))
+		return
+	}
+
+	// Random nonces are used by default
+	options.Deterministic = false
+	random, err := NewSymmetricCipherWithOptions([]byte("testing"), options)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	a, _ := random.Encrypt("same")
+	b, _ := random.Encrypt("same")
+	if a == b || strings.Contains(a, "siv=") {
+		t.Error(fmt.Errorf("Expected random nonces: %s, %s", a, b))
+		return
+	}
+}
+
+func TestLengthHiding(t *testing.T) {
+	for _, deterministic := range []bool{false, true} {
+		cipher, err := NewSymmetricCipherWithOptions([]byte("testing"), SymmetricCipherOptions{
+			KDF:           KDFParams{Time: 1, Memory: 64, Threads: 1},
+			Deterministic: deterministic,
+		})
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		// Values padded to the same length are indistinguishable
+		var lengths []int
+		for _, value := range []string{"", "1234", strings.Repeat("k", 64)} {
+			encrypted, err := cipher.EncryptPadded(value, []byte("path=['A']"), 64)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if !strings.Contains(encrypted, ",pad=iso7816,") {
+				t.Error(fmt.Errorf("Expected the padding to be recorded: %s", encrypted))
+				return
+			}
+			lengths = append(lengths, len(encrypted))
+
+			if length, err := cipher.PaddedLength(encrypted); err != nil || length != 64 {
+				t.Error(fmt.Errorf("Expected the value to be padded to 64 bytes, got: %d (%v)", length, err))
+				return
+			}
+
+			decrypted, err := cipher.DecryptWithData(encrypted, []byte("path=['A']"))
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if decrypted != value {
+				t.Error(fmt.Errorf("Expected padding to be stripped: %q", decrypted))
+				return
+			}
+		}
+		if lengths[0] != lengths[1] || lengths[1] != lengths[2] {
+			t.Error(fmt.Errorf("Expected padded values to have the same length: %v", lengths))
+			return
+		}
+
+		unpadded, err := cipher.Encrypt("1234")
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		if length, err := cipher.PaddedLength(unpadded); err != nil || length != 0 {
+			t.Error(fmt.Errorf("Expected the value not to be padded, got: %d (%v)", length, err))
+			return
+		}
+
+		if _, err := cipher.EncryptPadded(strings.Repeat("k", 65), nil, 64); err == nil {
+			t.Error(fmt.Errorf("Values longer than the padding should not be encrypted"))
+			return
+		}
+	}
+
+	// Values with invalid padding are rejected, even though they are authentic
+	for _, padded := range [][]byte{{}, {'a', 0, 0}, {'a', 0x80, 'b'}} {
+		if _, err := unpadPlainText(padded); err == nil {
+			t.Error(fmt.Errorf("Expected invalid padding to be rejected: %v", padded))
+			return
+		}
+	}
+}
+
+func TestBase64Encoding(t *testing.T) {
+	kdf := KDFParams{Time: 1, Memory: 64, Threads: 1}
+	hexCipher, err := NewSymmetricCipherWithOptions([]byte("testing"), SymmetricCipherOptions{KDF: kdf})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	b64Cipher, err := NewSymmetricCipherWithOptions([]byte("testing"), SymmetricCipherOptions{KDF: kdf, Encoding: EncodingBase64})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	value := strings.Repeat("secret", 10)
+	hexValue, err := hexCipher.Encrypt(value)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	b64Value, err := b64Cipher.Encrypt(value)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if !strings.Contains(b64Value, ",enc=b64,") || len(b64Value) >= len(hexValue) {
+		t.Error(fmt.Errorf("Expected a shorter base64 value:\n%s\n%s", hexValue, b64Value))
+		return
+	}
+
+	// Either cipher can decrypt both encodings
+	for _, encrypted := range []string{hexValue, b64Value} {
+		for _, cipher := range []SimpleSymmetricCipher{hexCipher, b64Cipher} {
+			decrypted, err := cipher.Decrypt(encrypted)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if decrypted != value {
+				t.Error(fmt.Errorf("Unexpected value: %s", decrypted))
+				return
+			}
+		}
+	}
+
+	// The encoding is authenticated along with the value
+	if _, err := hexCipher.Decrypt(strings.Replace(b64Value, ",enc=b64,", ",enc=b64,enc2=b64,", 1)); err == nil {
+		t.Error(fmt.Errorf("Expected tampered params to fail to decrypt"))
+		return
+	}
+
+	if _, err := NewSymmetricCipherWithOptions([]byte("testing"), SymmetricCipherOptions{Encoding: "base32"}); err == nil {
+		t.Error(fmt.Errorf("Expected unknown encodings to be rejected"))
+		return
+	}
+}
@@ -0,0 +1,204 @@
+package encrypt
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const (
+	envelopePrefix  = "ENC["
+	envelopeSuffix  = "]"
+	envelopeVersion = 2
+)
+
+const (
+	// EncodingHex stores the binary params of envelopes (i.e. the ciphertext)
+	// as hex
+	EncodingHex = "hex"
+
+	// EncodingBase64 stores the binary params of envelopes as unpadded
+	// base64url, which is a third shorter than hex
+	EncodingBase64 = "base64"
+
+	encodingB64 = "b64"
+)
+
+func checkEncoding(encoding string) error {
+	if encoding != EncodingHex && encoding != EncodingBase64 {
+		return fmt.Errorf("Unsupported encoding: %s (must be %s or %s)", encoding, EncodingHex, EncodingBase64)
+	}
+	return nil
+}
+
+type envelopeParam struct {
+	key   string
+	value string
+}
+
+// envelope is the self-describing format used to store encrypted values:
+//
+//	ENC[v2,alg=<algorithm>,kdf=<kdf>,<param>=<value>,...,data=<ciphertext>]
+//
+// Params are stored in the order they were set, and binary params are hex
+// encoded, unless the envelope has an enc=b64 param (which must be set before
+// any binary params), in which case they are base64url encoded. Everything
+// except the data and mac params makes up the header of the envelope, which is
+// authenticated along with the ciphertext so that params cannot be tampered
+// with.
+type envelope struct {
+	version int
+	params  []envelopeParam
+}
+
+func newEnvelope() *envelope {
+	return &envelope{
+		version: envelopeVersion,
+		params:  make([]envelopeParam, 0, 10),
+	}
+}
+
+func isEnvelope(str string) bool {
+	return strings.HasPrefix(str, envelopePrefix) && strings.HasSuffix(str, envelopeSuffix)
+}
+
+func parseEnvelope(str string) (*envelope, error) {
+	if !isEnvelope(str) {
+		return nil, fmt.Errorf("Value is not an encrypted envelope")
+	}
+
+	parts := strings.Split(str[len(envelopePrefix):len(str)-len(envelopeSuffix)], ",")
+	if len(parts[0]) < 2 || parts[0][0] != 'v' {
+		return nil, fmt.Errorf("Missing version in encrypted envelope")
+	}
+	version, err := strconv.Atoi(parts[0][1:])
+	if err != nil {
+		return nil, fmt.Errorf("Invalid version in encrypted envelope: %s", parts[0])
+	}
+
+	e := &envelope{
+		version: version,
+		params:  make([]envelopeParam, 0, len(parts)-1),
+	}
+	for _, part := range parts[1:] {
+		equals := strings.IndexByte(part, '=')
+		if equals < 1 {
+			return nil, fmt.Errorf("Invalid param in encrypted envelope: '%s'", part)
+		}
+		if _, exists := e.get(part[:equals]); exists {
+			return nil, fmt.Errorf("Duplicate param in encrypted envelope: '%s'", part[:equals])
+		}
+		e.params = append(e.params, envelopeParam{
+			key:   part[:equals],
+			value: part[equals+1:],
+		})
+	}
+	return e, nil
+}
+
+func (e *envelope) set(key, value string) {
+	if strings.ContainsAny(key, ",=]") || strings.ContainsAny(value, ",=]") {
+		panic(fmt.Errorf("invalid envelope param: %s=%s", key, value))
+	}
+
+	for i, param := range e.params {
+		if param.key == key {
+			e.params[i].value = value
+			return
+		}
+	}
+	e.params = append(e.params, envelopeParam{
+		key:   key,
+		value: value,
+	})
+}
+
+// setEncoding sets the encoding of the envelope's binary params.
+func (e *envelope) setEncoding(encoding string) {
+	if encoding == EncodingBase64 {
+		e.set("enc", encodingB64)
+	}
+}
+
+func (e *envelope) setBytes(key string, value []byte) {
+	if enc, _ := e.get("enc"); enc == encodingB64 {
+		e.set(key, base64.RawURLEncoding.EncodeToString(value))
+		return
+	}
+	e.set(key, hex.EncodeToString(value))
+}
+
+func (e *envelope) setInt(key string, value int) {
+	e.set(key, strconv.Itoa(value))
+}
+
+func (e *envelope) get(key string) (string, bool) {
+	for _, param := range e.params {
+		if param.key == key {
+			return param.value, true
+		}
+	}
+	return "", false
+}
+
+func (e *envelope) require(key string) (string, error) {
+	value, ok := e.get(key)
+	if !ok {
+		return "", fmt.Errorf("Missing '%s' in encrypted envelope", key)
+	}
+	return value, nil
+}
+
+func (e *envelope) getBytes(key string) ([]byte, error) {
+	value, err := e.require(key)
+	if err != nil {
+		return nil, err
+	}
+	var buffer []byte
+	switch enc, _ := e.get("enc"); enc {
+	case "":
+		buffer, err = hex.DecodeString(value)
+	case encodingB64:
+		buffer, err = base64.RawURLEncoding.DecodeString(value)
+	default:
+		return nil, fmt.Errorf("Unsupported encoding in encrypted envelope: %s", enc)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Invalid '%s' in encrypted envelope: %s", key, err)
+	}
+	return buffer, nil
+}
+
+func (e *envelope) getInt(key string) (int, error) {
+	value, err := e.require(key)
+	if err != nil {
+		return 0, err
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, fmt.Errorf("Invalid '%s' in encrypted envelope: %s", key, value)
+	}
+	return n, nil
+}
+
+// header returns the authenticated portion of the envelope, which is
+// everything except the ciphertext and its signature.
+func (e *envelope) header() []byte {
+	parts := []string{fmt.Sprintf("v%d", e.version)}
+	for _, param := range e.params {
+		if param.key != "data" && param.key != "mac" {
+			parts = append(parts, param.key+"="+param.value)
+		}
+	}
+	return []byte(strings.Join(parts, ","))
+}
+
+func (e *envelope) String() string {
+	parts := []string{fmt.Sprintf("v%d", e.version)}
+	for _, param := range e.params {
+		parts = append(parts, param.key+"="+param.value)
+	}
+	return envelopePrefix + strings.Join(parts, ",") + envelopeSuffix
+}
@@ -0,0 +1,77 @@
+package encrypt
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+)
+
+func TestParseEnvelope(t *testing.T) {
+	e, err := parseEnvelope("ENC[v2,alg=test,salt=0102,data=ff]")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if e.version != 2 {
+		t.Error(fmt.Errorf("Wrong version parsed: %d", e.version))
+		return
+	}
+	if alg, _ := e.get("alg"); alg != "test" {
+		t.Error(fmt.Errorf("Wrong alg parsed: %s", alg))
+		return
+	}
+	if salt, err := e.getBytes("salt"); err != nil || !bytes.Equal(salt, []byte{1, 2}) {
+		t.Error(fmt.Errorf("Wrong salt parsed: %#v (%v)", salt, err))
+		return
+	}
+	if header := string(e.header()); header != "v2,alg=test,salt=0102" {
+		t.Error(fmt.Errorf("Wrong header: %s", header))
+		return
+	}
+
+	invalid := []string{
+		"ENC[]",
+		"ENC[2,alg=test]",
+		"ENC[v2,alg]",
+		"ENC[v2,alg=a,alg=b]",
+		"ENC[v2,alg=test",
+	}
+	for _, str := range invalid {
+		if _, err := parseEnvelope(str); err == nil {
+			t.Error(fmt.Errorf("Expected parsing to fail for: %s", str))
+			return
+		}
+	}
+}
+
+func TestEnvelopeEncoding(t *testing.T) {
+	e := newEnvelope()
+	e.set("alg", "test")
+	e.setEncoding(EncodingBase64)
+	e.setBytes("data", []byte{0xfb, 0xff, 0x01})
+	if str := e.String(); str != "ENC[v2,alg=test,enc=b64,data=-_8B]" {
+		t.Error(fmt.Errorf("Wrong envelope: %s", str))
+		return
+	}
+
+	parsed, err := parseEnvelope(e.String())
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if data, err := parsed.getBytes("data"); err != nil || !bytes.Equal(data, []byte{0xfb, 0xff, 0x01}) {
+		t.Error(fmt.Errorf("Wrong data parsed: %#v (%v)", data, err))
+		return
+	}
+
+	parsed, err = parseEnvelope("ENC[v2,alg=test,enc=b32,data=ff]")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if _, err := parsed.getBytes("data"); err == nil {
+		t.Error(fmt.Errorf("Expected unknown encodings to be rejected"))
+		return
+	}
+}
@@ -0,0 +1,176 @@
+package encrypt
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"sync"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+// errKeyNotCached is returned by caches that cannot derive keys, when a key
+// has not been cached yet.
+var errKeyNotCached = fmt.Errorf("Key is not cached")
+
+// keyCache holds the keys derived from a passphrase, so that argon2 only has
+// to run once per salt instead of once per value. It also tracks the salt that
+// new values should be encrypted with, which is shared by every value in a
+// file.
+type keyCache struct {
+	lock sync.Mutex
+	keys map[string][]byte
+	salt []byte
+
+	// wrappedKey is the wrapped data key that new values are encrypted with,
+	// for ciphers that use envelope encryption instead of a salt (see
+	// SimpleKeyManagerCipher)
+	wrappedKey []byte
+
+	// locked caches only return keys that were added to them, and never
+	// derive new keys (see KeyAgent)
+	locked bool
+}
+
+func newKeyCache() *keyCache {
+	return &keyCache{
+		keys: make(map[string][]byte),
+	}
+}
+
+func (c *keyCache) deriveKey(passphrase []byte, params KDFParams, salt []byte, keyLength uint32) ([]byte, error) {
+	id := fmt.Sprintf("%d:%d:%d:%x:%d", params.Time, params.Memory, params.Threads, salt, keyLength)
+	return c.cachedKey(id, func() ([]byte, error) {
+		if c.locked {
+			return nil, errKeyNotCached
+		}
+		return params.deriveKey(passphrase, salt, keyLength), nil
+	})
+}
+
+// cachedKey returns the key with the given id, deriving it if it has not been
+// derived yet. Keys that fail to be derived are not cached.
+func (c *keyCache) cachedKey(id string, derive func() ([]byte, error)) ([]byte, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if key, ok := c.keys[id]; ok {
+		return key, nil
+	}
+
+	key, err := derive()
+	if err != nil {
+		return nil, err
+	}
+	c.keys[id] = key
+	return key, nil
+}
+
+// fileSalt returns the salt used for new values, generating one if no value
+// has been encrypted or adopted yet.
+func (c *keyCache) fileSalt(generate func() ([]byte, error)) ([]byte, error) {
+	return c.fileValue(&c.salt, generate)
+}
+
+// fileWrappedKey returns the wrapped data key used for new values, generating
+// one if no value has been encrypted or adopted yet.
+func (c *keyCache) fileWrappedKey(generate func() ([]byte, error)) ([]byte, error) {
+	return c.fileValue(&c.wrappedKey, generate)
+}
+
+func (c *keyCache) fileValue(value *[]byte, generate func() ([]byte, error)) ([]byte, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if *value == nil {
+		generated, err := generate()
+		if err != nil {
+			return nil, err
+		}
+		*value = generated
+	}
+	return *value, nil
+}
+
+// adoptSalt reuses the salt of an existing value for new values, if no salt
+// has been chosen yet. This keeps a file on a single salt when it is edited.
+func (c *keyCache) adoptSalt(salt []byte) {
+	c.adoptValue(&c.salt, salt)
+}
+
+// adoptWrappedKey reuses the wrapped data key of an existing value for new
+// values, like adoptSalt.
+func (c *keyCache) adoptWrappedKey(wrappedKey []byte) {
+	c.adoptValue(&c.wrappedKey, wrappedKey)
+}
+
+func (c *keyCache) adoptValue(value *[]byte, adopted []byte) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if *value == nil {
+		*value = adopted
+	}
+}
+
+// addKeys copies every key of another cache into this one, and returns the ids
+// of the keys that were not already cached.
+func (c *keyCache) addKeys(other *keyCache) []string {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	other.lock.Lock()
+	defer other.lock.Unlock()
+
+	var added []string
+	for id, key := range other.keys {
+		if _, ok := c.keys[id]; !ok {
+			c.keys[id] = append([]byte{}, key...)
+			added = append(added, id)
+		}
+	}
+	return added
+}
+
+// forget wipes the keys with the given ids from memory.
+func (c *keyCache) forget(ids []string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	for _, id := range ids {
+		if key, ok := c.keys[id]; ok {
+			wipeBytes(key)
+			delete(c.keys, id)
+		}
+	}
+}
+
+// wipe removes every key from the cache, and overwrites them in memory.
+func (c *keyCache) wipe() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	for id, key := range c.keys {
+		wipeBytes(key)
+		delete(c.keys, id)
+	}
+	c.salt = nil
+	c.wrappedKey = nil
+}
+
+func wipeBytes(buffer []byte) {
+	for i := range buffer {
+		buffer[i] = 0
+	}
+}
+
+// deriveSubkey derives the key for a single value from the file's master key,
+// using HKDF-SHA256. Subkeys are bound to the algorithm and the associated
+// data of the value (i.e. its path).
+func deriveSubkey(masterKey []byte, algorithm string, associatedData []byte) ([]byte, error) {
+	info := append([]byte("secrets/v2/"+algorithm+"\x00"), associatedData...)
+	subkey := make([]byte, dataKeyLength)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, masterKey, nil, info), subkey); err != nil {
+		return nil, err
+	}
+	return subkey, nil
+}
@@ -0,0 +1,289 @@
+package encrypt
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+)
+
+const (
+	keyIDLength   = 8
+	maxRecipients = 255
+)
+
+// SimpleKeyringCipher encrypts each value to many RSA public keys. Every value
+// gets its own random data key, which is wrapped once per recipient, so any
+// one of the matching private keys can decrypt it.
+//
+// Encrypted values are laid out as:
+//
+//	count (1 byte)
+//	count * [ key id (8 bytes) | wrapped key length (2 bytes) | wrapped key ]
+//	nonce | AES-256-GCM ciphertext
+//
+// Since the plaintext is only ever encrypted under the data key, adding or
+// removing recipients only requires the data key to be re-wrapped (see Rewrap).
+type SimpleKeyringCipher struct {
+	recipients []*rsa.PublicKey
+	privateKey *rsa.PrivateKey
+}
+
+func NewKeyringCipher(recipients []*rsa.PublicKey, privateKey *rsa.PrivateKey) (SimpleKeyringCipher, error) {
+	if len(recipients) == 0 {
+		return SimpleKeyringCipher{}, fmt.Errorf("Keyring must contain at least one public key")
+	}
+	if len(recipients) > maxRecipients {
+		return SimpleKeyringCipher{}, fmt.Errorf("Keyring cannot contain more than %d public keys", maxRecipients)
+	}
+
+	return SimpleKeyringCipher{
+		recipients: recipients,
+		privateKey: privateKey,
+	}, nil
+}
+
+// LoadKeyringCipher creates a keyring cipher from a keyring file (see
+// ReadKeyringFile) and an optional PEM-encoded private key.
+func LoadKeyringCipher(keyringPath, privateKeyPath string) (SimpleKeyringCipher, error) {
+	recipients, err := ReadKeyringFile(keyringPath)
+	if err != nil {
+		return SimpleKeyringCipher{}, err
+	}
+
+	var privateKey *rsa.PrivateKey
+	if privateKeyPath != "" {
+		privateKey, err = ReadPrivateKeyFile(privateKeyPath)
+		if err != nil {
+			return SimpleKeyringCipher{}, err
+		}
+	}
+
+	return NewKeyringCipher(recipients, privateKey)
+}
+
+// ReadKeyringFile reads a keyring, which is a list of PEM-encoded RSA public
+// keys concatenated into a single file (i.e. `cat alice.pub bob.pub > keyring.pem`).
+// Any text outside of the PEM blocks is ignored, so it can be used to leave
+// comments about who owns each key.
+func ReadKeyringFile(path string) ([]*rsa.PublicKey, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := make([]*rsa.PublicKey, 0, 10)
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+
+		key, err := ParsePublicKey(block)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to read key #%d from keyring %s: %s", len(keys)+1, path, err)
+		}
+		keys = append(keys, key)
+	}
+
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("No public keys found in keyring: %s", path)
+	}
+	return keys, nil
+}
+
+// KeyID returns a short identifier for a public key, derived from the hash of
+// its PKIX encoding.
+func KeyID(publicKey *rsa.PublicKey) ([]byte, error) {
+	der, err := x509.MarshalPKIXPublicKey(publicKey)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(der)
+	return sum[:keyIDLength], nil
+}
+
+type keyringStanza struct {
+	keyID      []byte
+	wrappedKey []byte
+}
+
+type keyringEnvelope struct {
+	stanzas []keyringStanza
+	sealed  []byte
+}
+
+func (e keyringEnvelope) export() string {
+	buffer := []byte{byte(len(e.stanzas))}
+	for _, stanza := range e.stanzas {
+		buffer = append(buffer, stanza.keyID...)
+
+		size := make([]byte, 2)
+		binary.BigEndian.PutUint16(size, uint16(len(stanza.wrappedKey)))
+		buffer = append(buffer, size...)
+		buffer = append(buffer, stanza.wrappedKey...)
+	}
+	return hex.EncodeToString(append(buffer, e.sealed...))
+}
+
+func openKeyringEnvelope(encrypted string) (keyringEnvelope, error) {
+	e := keyringEnvelope{}
+	buffer, err := hex.DecodeString(encrypted)
+	if err != nil {
+		return e, err
+	}
+	if len(buffer) < 1 {
+		return e, fmt.Errorf("Unexpected empty value")
+	}
+
+	count := int(buffer[0])
+	buffer = buffer[1:]
+	e.stanzas = make([]keyringStanza, count)
+
+	for i := 0; i < count; i++ {
+		if len(buffer) < keyIDLength+2 {
+			return e, fmt.Errorf("Unexpected end of value while reading recipient #%d", i+1)
+		}
+		size := int(binary.BigEndian.Uint16(buffer[keyIDLength : keyIDLength+2]))
+		if len(buffer) < keyIDLength+2+size {
+			return e, fmt.Errorf("Unexpected end of value while reading recipient #%d", i+1)
+		}
+
+		e.stanzas[i] = keyringStanza{
+			keyID:      buffer[:keyIDLength],
+			wrappedKey: buffer[keyIDLength+2 : keyIDLength+2+size],
+		}
+		buffer = buffer[keyIDLength+2+size:]
+	}
+
+	e.sealed = buffer
+	return e, nil
+}
+
+func (s SimpleKeyringCipher) wrapForRecipients(dataKey []byte) ([]keyringStanza, error) {
+	stanzas := make([]keyringStanza, len(s.recipients))
+	for i, recipient := range s.recipients {
+		keyID, err := KeyID(recipient)
+		if err != nil {
+			return nil, err
+		}
+		wrappedKey, err := wrapDataKey(recipient, dataKey)
+		if err != nil {
+			return nil, err
+		}
+		stanzas[i] = keyringStanza{
+			keyID:      keyID,
+			wrappedKey: wrappedKey,
+		}
+	}
+	return stanzas, nil
+}
+
+func (s SimpleKeyringCipher) unwrap(e keyringEnvelope) ([]byte, error) {
+	if s.privateKey == nil {
+		return nil, fmt.Errorf("A private key is required to decrypt values")
+	}
+
+	keyID, err := KeyID(&s.privateKey.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, stanza := range e.stanzas {
+		if bytes.Equal(stanza.keyID, keyID) {
+			dataKey, err := unwrapDataKey(s.privateKey, stanza.wrappedKey)
+			if err != nil {
+				return nil, fmt.Errorf("Failed to decrypt value")
+			}
+			return dataKey, nil
+		}
+	}
+	return nil, fmt.Errorf("Value was not encrypted for key %s", hex.EncodeToString(keyID))
+}
+
+func (s SimpleKeyringCipher) Encrypt(str string) (string, error) {
+	return s.EncryptWithData(str, nil)
+}
+
+func (s SimpleKeyringCipher) EncryptWithData(str string, associatedData []byte) (string, error) {
+	dataKey := make([]byte, dataKeyLength)
+	if _, err := rand.Read(dataKey); err != nil {
+		return "", err
+	}
+
+	stanzas, err := s.wrapForRecipients(dataKey)
+	if err != nil {
+		return "", err
+	}
+
+	sealed, err := sealWithDataKey(dataKey, []byte(str), associatedData)
+	if err != nil {
+		return "", err
+	}
+
+	return tagBoundValue(keyringEnvelope{
+		stanzas: stanzas,
+		sealed:  sealed,
+	}.export(), associatedData), nil
+}
+
+func (s SimpleKeyringCipher) Decrypt(encrypted string) (string, error) {
+	return s.DecryptWithData(encrypted, nil)
+}
+
+func (s SimpleKeyringCipher) DecryptWithData(encrypted string, associatedData []byte) (string, error) {
+	encrypted, associatedData, err := openBoundValue(encrypted, associatedData)
+	if err != nil {
+		return "", err
+	}
+	e, err := openKeyringEnvelope(encrypted)
+	if err != nil {
+		return "", err
+	}
+
+	dataKey, err := s.unwrap(e)
+	if err != nil {
+		return "", err
+	}
+
+	plainText, err := openWithDataKey(dataKey, e.sealed, associatedData)
+	if err != nil {
+		return "", err
+	}
+	return string(plainText), nil
+}
+
+// Rewrap re-encrypts the data key of an existing value for the current set of
+// recipients. The encrypted payload is left untouched.
+func (s SimpleKeyringCipher) Rewrap(encrypted string) (string, error) {
+	tag, encrypted, err := cutBoundValue(encrypted)
+	if err != nil {
+		return "", err
+	}
+	e, err := openKeyringEnvelope(encrypted)
+	if err != nil {
+		return "", err
+	}
+
+	dataKey, err := s.unwrap(e)
+	if err != nil {
+		return "", err
+	}
+
+	stanzas, err := s.wrapForRecipients(dataKey)
+	if err != nil {
+		return "", err
+	}
+
+	return tag + keyringEnvelope{
+		stanzas: stanzas,
+		sealed:  e.sealed,
+	}.export(), nil
+}
@@ -0,0 +1,161 @@
+package encrypt
+
+import (
+	"crypto/rsa"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func writeTestKeyring(t *testing.T, pubPaths ...string) string {
+	keyring := []byte("# test keyring\n")
+	for _, pubPath := range pubPaths {
+		data, err := ioutil.ReadFile(pubPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		keyring = append(keyring, data...)
+	}
+
+	keyringPath := filepath.Join(t.TempDir(), "keyring.pem")
+	if err := ioutil.WriteFile(keyringPath, keyring, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return keyringPath
+}
+
+func TestKeyringEncrypt(t *testing.T) {
+	alicePub, alicePriv := writeTestKeys(t)
+	bobPub, bobPriv := writeTestKeys(t)
+	_, evePriv := writeTestKeys(t)
+	keyringPath := writeTestKeyring(t, alicePub, bobPub)
+
+	data := "foobar - some hello world text blah blah"
+	encrypter, err := LoadKeyringCipher(keyringPath, "")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	encrypted, err := encrypter.Encrypt(data)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	for _, privPath := range []string{alicePriv, bobPriv} {
+		decrypter, err := LoadKeyringCipher(keyringPath, privPath)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		decrypted, err := decrypter.Decrypt(encrypted)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		if decrypted != data {
+			t.Error(fmt.Sprintf("Decryption failed: '%s' (%d)", decrypted, len(decrypted)))
+			return
+		}
+	}
+
+	decrypter, err := LoadKeyringCipher(keyringPath, evePriv)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if decrypted, err := decrypter.Decrypt(encrypted); err == nil {
+		t.Error(fmt.Errorf("Decryption should have failed: %s", decrypted))
+		return
+	}
+}
+
+func TestKeyringRewrap(t *testing.T) {
+	alicePub, alicePriv := writeTestKeys(t)
+	bobPub, bobPriv := writeTestKeys(t)
+
+	alice, err := ReadPrivateKeyFile(alicePriv)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	alicePublic, err := ReadPublicKeyFile(alicePub)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	bobPublic, err := ReadPublicKeyFile(bobPub)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	before, err := NewKeyringCipher([]*rsa.PublicKey{alicePublic}, alice)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	encrypted, err := before.Encrypt("some test text")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	after, err := NewKeyringCipher([]*rsa.PublicKey{alicePublic, bobPublic}, alice)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	rewrapped, err := after.Rewrap(encrypted)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	oldEnvelope, _ := openKeyringEnvelope(encrypted)
+	newEnvelope, err := openKeyringEnvelope(rewrapped)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if string(oldEnvelope.sealed) != string(newEnvelope.sealed) {
+		t.Error(fmt.Errorf("Rewrapping should not re-encrypt the payload"))
+		return
+	}
+
+	bob, err := LoadKeyringCipher(writeTestKeyring(t, alicePub, bobPub), bobPriv)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	decrypted, err := bob.Decrypt(rewrapped)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if decrypted != "some test text" {
+		t.Error(fmt.Sprintf("Decryption failed: '%s'", decrypted))
+		return
+	}
+
+	// Rewrapping keeps values bound to their associated data
+	bound, err := before.EncryptWithData("some bound text", []byte("path=.A"))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	rewrapped, err = after.Rewrap(bound)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if decrypted, err := bob.DecryptWithData(rewrapped, []byte("path=.A")); err != nil || decrypted != "some bound text" {
+		t.Error(fmt.Errorf("Failed to decrypt rewrapped value: %q (%v)", decrypted, err))
+		return
+	}
+	if _, err := bob.DecryptWithData(rewrapped, []byte("path=.B")); err != errValueMoved {
+		t.Error(fmt.Errorf("Expected the value to be reported as moved, but got: %v", err))
+		return
+	}
+}
@@ -0,0 +1,228 @@
+package encrypt
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"github.com/karimsa/secrets/internal/ciphers"
+)
+
+const (
+	kdfKeyManager = "key-manager"
+
+	localKeyManagerData = "secrets/v2/local-key-manager"
+)
+
+// SimpleKeyManagerCipher encrypts values using envelope encryption: every file
+// gets a random data key, which is wrapped by a KeyManager. Only the wrapped
+// data key is stored in each value, and each value is encrypted locally with
+// its own subkey of the data key.
+//
+// Like the salt of symmetric encryption, the data key is only wrapped once per
+// file, and the data key of existing values is adopted for new values, so each
+// distinct wrapped key is only unwrapped once.
+type SimpleKeyManagerCipher struct {
+	manager   ciphers.KeyManager
+	algorithm string
+	encoding  string
+	keys      *keyCache
+}
+
+type KeyManagerCipherOptions struct {
+	// Algorithm is the AEAD used to encrypt new values (defaults to
+	// DefaultAlgorithm)
+	Algorithm string
+
+	// Encoding is the encoding of new values (defaults to EncodingHex).
+	// Decryption detects the encoding of each value.
+	Encoding string
+}
+
+func NewKeyManagerCipher(manager ciphers.KeyManager, options KeyManagerCipherOptions) (SimpleKeyManagerCipher, error) {
+	s := SimpleKeyManagerCipher{
+		manager:   manager,
+		algorithm: DefaultAlgorithm,
+		encoding:  EncodingHex,
+		keys:      newKeyCache(),
+	}
+
+	if options.Algorithm != "" {
+		if _, err := newAEAD(options.Algorithm, make([]byte, dataKeyLength)); err != nil {
+			return s, err
+		}
+		s.algorithm = options.Algorithm
+	}
+
+	if options.Encoding != "" {
+		if err := checkEncoding(options.Encoding); err != nil {
+			return s, err
+		}
+		s.encoding = options.Encoding
+	}
+	return s, nil
+}
+
+// dataKey returns the data key for the given wrapped key, unwrapping it if it
+// has not been unwrapped yet.
+func (s SimpleKeyManagerCipher) dataKey(wrappedKey []byte) ([]byte, error) {
+	return s.keys.cachedKey(hex.EncodeToString(wrappedKey), func() ([]byte, error) {
+		dataKey, err := s.manager.Unwrap(wrappedKey)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to unwrap data key: %s", err)
+		}
+		if len(dataKey) != dataKeyLength {
+			return nil, fmt.Errorf("Unwrapped data key has an invalid length: %d", len(dataKey))
+		}
+		return dataKey, nil
+	})
+}
+
+func (s SimpleKeyManagerCipher) Encrypt(str string) (string, error) {
+	return s.EncryptWithData(str, nil)
+}
+
+func (s SimpleKeyManagerCipher) EncryptWithData(str string, associatedData []byte) (string, error) {
+	return s.EncryptPadded(str, associatedData, 0)
+}
+
+// EncryptPadded encrypts a value like EncryptWithData, after padding it to the
+// given length.
+func (s SimpleKeyManagerCipher) EncryptPadded(str string, associatedData []byte, length int) (string, error) {
+	var generatedKey []byte
+	wrappedKey, err := s.keys.fileWrappedKey(func() ([]byte, error) {
+		generatedKey = make([]byte, dataKeyLength)
+		if _, err := rand.Read(generatedKey); err != nil {
+			return nil, err
+		}
+
+		wrappedKey, err := s.manager.Wrap(generatedKey)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to wrap data key: %s", err)
+		}
+		return wrappedKey, nil
+	})
+	if err != nil {
+		return "", err
+	}
+
+	// Newly generated keys are cached, so that they never need to be unwrapped
+	var dataKey []byte
+	if generatedKey != nil {
+		dataKey, err = s.keys.cachedKey(hex.EncodeToString(wrappedKey), func() ([]byte, error) {
+			return generatedKey, nil
+		})
+	} else {
+		dataKey, err = s.dataKey(wrappedKey)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	e := newEnvelope()
+	e.set("alg", s.algorithm)
+	e.setEncoding(s.encoding)
+	e.set("kdf", kdfKeyManager)
+	e.setBytes("wrapped", wrappedKey)
+	e.set("subkey", subkeyHKDF)
+	if len(associatedData) > 0 {
+		e.set("ad", associatedDataTag(associatedData))
+	}
+	return sealEnvelope(e, s.algorithm, dataKey, []byte(str), associatedData, length)
+}
+
+// PaddedLength returns the length that an encrypted value was padded to, or 0
+// if it was not padded.
+func (s SimpleKeyManagerCipher) PaddedLength(encrypted string) (int, error) {
+	return envelopePaddedLength(encrypted)
+}
+
+func (s SimpleKeyManagerCipher) Decrypt(encrypted string) (string, error) {
+	return s.DecryptWithData(encrypted, nil)
+}
+
+func (s SimpleKeyManagerCipher) DecryptWithData(encrypted string, associatedData []byte) (string, error) {
+	e, err := parseEnvelope(encrypted)
+	if err != nil {
+		return "", err
+	}
+	if e.version != envelopeVersion {
+		return "", fmt.Errorf("Unsupported envelope version: v%d", e.version)
+	}
+
+	associatedData, err = checkAssociatedData(e, associatedData)
+	if err != nil {
+		return "", err
+	}
+
+	alg, err := e.require("alg")
+	if err != nil {
+		return "", err
+	}
+	if kdf, err := e.require("kdf"); err != nil {
+		return "", err
+	} else if kdf != kdfKeyManager {
+		return "", fmt.Errorf("Value was not encrypted with a key manager (kdf=%s)", kdf)
+	}
+	wrappedKey, err := e.getBytes("wrapped")
+	if err != nil {
+		return "", err
+	}
+
+	dataKey, err := s.dataKey(wrappedKey)
+	if err != nil {
+		return "", err
+	}
+	plainText, err := openEnvelope(e, alg, dataKey, associatedData)
+	if err != nil {
+		return "", err
+	}
+
+	s.keys.adoptWrappedKey(wrappedKey)
+	return string(plainText), nil
+}
+
+// LocalKeyManager wraps data keys using a master key that is stored in a
+// local file. It is meant for testing, and for setups that do not have a key
+// management service.
+type LocalKeyManager struct {
+	masterKey []byte
+}
+
+func NewLocalKeyManager(masterKey []byte) (LocalKeyManager, error) {
+	if len(masterKey) != dataKeyLength {
+		return LocalKeyManager{}, fmt.Errorf("Master key must be %d bytes long (got %d)", dataKeyLength, len(masterKey))
+	}
+	return LocalKeyManager{masterKey: masterKey}, nil
+}
+
+// LoadLocalKeyManager reads a master key file, which either contains 32 raw
+// bytes or 64 hex characters (i.e. `openssl rand -hex 32 > master.key`).
+func LoadLocalKeyManager(path string) (LocalKeyManager, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return LocalKeyManager{}, err
+	}
+
+	if trimmed := strings.TrimSpace(string(data)); len(trimmed) == 2*dataKeyLength {
+		if masterKey, err := hex.DecodeString(trimmed); err == nil {
+			return NewLocalKeyManager(masterKey)
+		}
+	}
+
+	manager, err := NewLocalKeyManager(data)
+	if err != nil {
+		return manager, fmt.Errorf("Invalid master key in %s: %s", path, err)
+	}
+	return manager, nil
+}
+
+func (m LocalKeyManager) Wrap(dataKey []byte) ([]byte, error) {
+	return sealWithDataKey(m.masterKey, dataKey, []byte(localKeyManagerData))
+}
+
+func (m LocalKeyManager) Unwrap(wrappedKey []byte) ([]byte, error) {
+	return openWithDataKey(m.masterKey, wrappedKey, []byte(localKeyManagerData))
+}
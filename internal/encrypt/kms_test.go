@@ -0,0 +1,174 @@
+package encrypt
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// countingKeyManager counts the number of keys that are wrapped and unwrapped.
+type countingKeyManager struct {
+	LocalKeyManager
+	wraps   int
+	unwraps int
+}
+
+func (m *countingKeyManager) Wrap(dataKey []byte) ([]byte, error) {
+	m.wraps++
+	return m.LocalKeyManager.Wrap(dataKey)
+}
+
+func (m *countingKeyManager) Unwrap(wrappedKey []byte) ([]byte, error) {
+	m.unwraps++
+	return m.LocalKeyManager.Unwrap(wrappedKey)
+}
+
+func newTestKeyManager(t *testing.T) *countingKeyManager {
+	masterKey := make([]byte, dataKeyLength)
+	if _, err := rand.Read(masterKey); err != nil {
+		t.Fatal(err)
+	}
+	manager, err := NewLocalKeyManager(masterKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &countingKeyManager{LocalKeyManager: manager}
+}
+
+func TestKeyManagerEncrypt(t *testing.T) {
+	manager := newTestKeyManager(t)
+	cipher, err := NewKeyManagerCipher(manager, KeyManagerCipherOptions{})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	values := []string{"first value", "second value", "third value"}
+	encrypted := make([]string, len(values))
+	for i, value := range values {
+		encrypted[i], err = cipher.EncryptWithData(value, []byte(fmt.Sprintf("path=%d", i)))
+		if err != nil {
+			t.Error(err)
+			return
+		}
+	}
+	if manager.wraps != 1 || manager.unwraps != 0 {
+		t.Error(fmt.Errorf("Expected a single data key to be wrapped (wraps: %d, unwraps: %d)", manager.wraps, manager.unwraps))
+		return
+	}
+
+	// Values should only store the wrapped data key
+	e, err := parseEnvelope(encrypted[0])
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if kdf, _ := e.get("kdf"); kdf != kdfKeyManager {
+		t.Error(fmt.Errorf("Unexpected envelope: %s", encrypted[0]))
+		return
+	}
+	wrapped, _ := e.get("wrapped")
+	for _, value := range encrypted {
+		if !strings.Contains(value, ",wrapped="+wrapped+",") {
+			t.Error(fmt.Errorf("Expected every value to share a data key: %v", encrypted))
+			return
+		}
+	}
+
+	decrypter, err := NewKeyManagerCipher(manager, KeyManagerCipherOptions{})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	for i, value := range values {
+		decrypted, err := decrypter.DecryptWithData(encrypted[i], []byte(fmt.Sprintf("path=%d", i)))
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		if decrypted != value {
+			t.Error(fmt.Sprintf("Decryption failed: '%s'", decrypted))
+			return
+		}
+	}
+
+	// New values should adopt the data key of existing values
+	added, err := decrypter.Encrypt("added value")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if !strings.Contains(added, ",wrapped="+wrapped+",") {
+		t.Error(fmt.Errorf("Expected new values to adopt the existing data key: %s", added))
+		return
+	}
+	if manager.wraps != 1 || manager.unwraps != 1 {
+		t.Error(fmt.Errorf("Expected the data key to be unwrapped once (wraps: %d, unwraps: %d)", manager.wraps, manager.unwraps))
+		return
+	}
+
+	other, err := NewKeyManagerCipher(newTestKeyManager(t), KeyManagerCipherOptions{})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if decrypted, err := other.Decrypt(added); err == nil {
+		t.Error(fmt.Errorf("Decryption should have failed: %s", decrypted))
+		return
+	}
+}
+
+func TestLocalKeyManager(t *testing.T) {
+	masterKey := make([]byte, dataKeyLength)
+	if _, err := rand.Read(masterKey); err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	rawPath := filepath.Join(dir, "raw.key")
+	hexPath := filepath.Join(dir, "hex.key")
+	badPath := filepath.Join(dir, "bad.key")
+	if err := ioutil.WriteFile(rawPath, masterKey, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(hexPath, []byte(hex.EncodeToString(masterKey)+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(badPath, []byte("too short"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	rawManager, err := LoadLocalKeyManager(rawPath)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	hexManager, err := LoadLocalKeyManager(hexPath)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if _, err := LoadLocalKeyManager(badPath); err == nil {
+		t.Error(fmt.Errorf("Invalid master keys should be rejected"))
+		return
+	}
+
+	wrapped, err := rawManager.Wrap([]byte("0123456789abcdef0123456789abcdef"))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	unwrapped, err := hexManager.Unwrap(wrapped)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if string(unwrapped) != "0123456789abcdef0123456789abcdef" {
+		t.Error(fmt.Errorf("Unexpected data key: %x", unwrapped))
+		return
+	}
+}
@@ -0,0 +1,8 @@
+package encrypt
+
+import "os"
+
+// fileOwner is not supported on Windows, where files do not have a uid.
+func fileOwner(info os.FileInfo) (int, bool) {
+	return 0, false
+}
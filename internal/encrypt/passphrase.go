@@ -0,0 +1,96 @@
+package encrypt
+
+import (
+	"fmt"
+	"math"
+	"unicode"
+	"unicode/utf8"
+)
+
+// PassphrasePolicy is the minimum strength required of passphrases that are
+// used to encrypt new values. A zero policy accepts any passphrase.
+type PassphrasePolicy struct {
+	// MinLength is the minimum number of characters
+	MinLength int
+
+	// MinEntropy is the minimum number of bits of entropy, as estimated by
+	// EstimateEntropy
+	MinEntropy float64
+}
+
+// DefaultPassphrasePolicy is applied to new passphrases, unless a weaker
+// policy is chosen explicitly. It rejects passphrases that are shorter than 12
+// characters, or that are obviously weak (i.e. a single word, or digits).
+var DefaultPassphrasePolicy = PassphrasePolicy{
+	MinLength:  12,
+	MinEntropy: 50,
+}
+
+// Check returns an error describing why a passphrase does not meet the policy.
+func (p PassphrasePolicy) Check(passphrase []byte) error {
+	if length := utf8.RuneCount(passphrase); length < p.MinLength {
+		return fmt.Errorf("Passphrase is too short: %d characters (must be at least %d)", length, p.MinLength)
+	}
+	if entropy := EstimateEntropy(passphrase); entropy < p.MinEntropy {
+		return fmt.Errorf("Passphrase is too weak: about %.0f bits of entropy (must be at least %.0f)", entropy, p.MinEntropy)
+	}
+	return nil
+}
+
+// EstimateEntropy gives a rough estimate of the entropy of a passphrase, in
+// bits. Each character is worth log2 of the size of the character classes
+// used (lowercase, uppercase, digits, symbols, and anything else), except for
+// characters that repeat or continue a sequence (i.e. "aaa" or "123"), which
+// are only worth a single bit.
+//
+// This is an upper bound for passphrases that are made of dictionary words,
+// so it is only meant to catch passphrases that are obviously weak.
+func EstimateEntropy(passphrase []byte) float64 {
+	var lower, upper, digit, symbol, other bool
+	for _, r := range string(passphrase) {
+		switch {
+		case r >= 'a' && r <= 'z':
+			lower = true
+		case r >= 'A' && r <= 'Z':
+			upper = true
+		case r >= '0' && r <= '9':
+			digit = true
+		case r < utf8.RuneSelf && unicode.IsPrint(r):
+			symbol = true
+		default:
+			other = true
+		}
+	}
+
+	pool := 0
+	for _, class := range []struct {
+		used bool
+		size int
+	}{
+		{lower, 26},
+		{upper, 26},
+		{digit, 10},
+		{symbol, 33},
+		{other, 100},
+	} {
+		if class.used {
+			pool += class.size
+		}
+	}
+	if pool == 0 {
+		return 0
+	}
+
+	bitsPerChar := math.Log2(float64(pool))
+	bits := 0.0
+	prev := rune(-1)
+	for _, r := range string(passphrase) {
+		if prev != -1 && (r == prev || r == prev+1 || r == prev-1) {
+			bits++
+		} else {
+			bits += bitsPerChar
+		}
+		prev = r
+	}
+	return bits
+}
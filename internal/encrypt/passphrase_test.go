@@ -0,0 +1,61 @@
+package encrypt
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestEstimateEntropy(t *testing.T) {
+	for _, test := range []struct {
+		passphrase string
+		min, max   float64
+	}{
+		{"", 0, 0},
+		{"aaaaaaaaaaaa", 5, 16},
+		{"abcdefgh", 5, 16},
+		{"12345678", 3, 11},
+		{"correct horse battery staple", 100, 200},
+		{"x7#Lq9!vR2", 60, 70},
+	} {
+		entropy := EstimateEntropy([]byte(test.passphrase))
+		if entropy < test.min || entropy > test.max {
+			t.Error(fmt.Errorf("Expected entropy of %q to be between %.0f and %.0f, but got %.1f", test.passphrase, test.min, test.max, entropy))
+			return
+		}
+	}
+}
+
+func TestPassphrasePolicy(t *testing.T) {
+	if err := (PassphrasePolicy{}).Check([]byte("a")); err != nil {
+		t.Error(fmt.Errorf("Zero policy should accept any passphrase: %s", err))
+		return
+	}
+
+	policy := PassphrasePolicy{MinLength: 10, MinEntropy: 50}
+	if err := policy.Check([]byte("x7#Lq9!")); err == nil || !strings.Contains(err.Error(), "too short") {
+		t.Error(fmt.Errorf("Expected short passphrase to be rejected: %v", err))
+		return
+	}
+	if err := policy.Check([]byte("aaaaaaaaaaaaaaaa")); err == nil || !strings.Contains(err.Error(), "too weak") {
+		t.Error(fmt.Errorf("Expected weak passphrase to be rejected: %v", err))
+		return
+	}
+	if err := policy.Check([]byte("x7#Lq9!vR2")); err != nil {
+		t.Error(err)
+		return
+	}
+
+	// The default policy rejects short passphrases and plain numbers, but
+	// accepts a few words
+	for _, weak := range []string{"hunter2", "passphrase", "123456789012"} {
+		if err := DefaultPassphrasePolicy.Check([]byte(weak)); err == nil {
+			t.Error(fmt.Errorf("Expected the default policy to reject %q", weak))
+			return
+		}
+	}
+	if err := DefaultPassphrasePolicy.Check([]byte("correct horse battery staple")); err != nil {
+		t.Error(err)
+		return
+	}
+}
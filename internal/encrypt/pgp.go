@@ -0,0 +1,215 @@
+package encrypt
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/armor"
+)
+
+const (
+	pgpMessageType = "PGP MESSAGE"
+	armorPrefix    = "-----BEGIN "
+)
+
+// SimplePGPCipher encrypts values to OpenPGP public keys. Each value is a
+// complete OpenPGP message, encoded as base64 (or armored), so it can be
+// decrypted by gpg:
+//
+//	echo "$VALUE" | base64 -d | gpg --decrypt
+//
+// Both RSA and ECC (i.e. cv25519) encryption keys are supported.
+type SimplePGPCipher struct {
+	recipients openpgp.EntityList
+	keyring    openpgp.EntityList
+	passphrase func(keyID string) ([]byte, error)
+	armor      bool
+}
+
+type PGPCipherOptions struct {
+	// PublicKeyFiles are armored public key files to encrypt values to
+	PublicKeyFiles []string
+
+	// SecretKeyringFile is a secret keyring (armored or binary, i.e. from
+	// `gpg --export-secret-keys`) used to decrypt values. When no public keys
+	// are given, values are encrypted to the keys in the keyring instead.
+	SecretKeyringFile string
+
+	// Passphrase is called to decrypt passphrase-protected secret keys. It is
+	// only called once a value that was encrypted to the key is decrypted.
+	Passphrase func(keyID string) ([]byte, error)
+
+	// Armor encodes values as armored PGP messages instead of base64
+	Armor bool
+}
+
+func NewPGPCipher(recipients, keyring openpgp.EntityList, passphrase func(keyID string) ([]byte, error), armor bool) (SimplePGPCipher, error) {
+	if len(recipients) == 0 && len(keyring) == 0 {
+		return SimplePGPCipher{}, fmt.Errorf("Either a public key or a secret keyring is required for pgp encryption")
+	}
+
+	return SimplePGPCipher{
+		recipients: recipients,
+		keyring:    keyring,
+		passphrase: passphrase,
+		armor:      armor,
+	}, nil
+}
+
+func LoadPGPCipher(options PGPCipherOptions) (SimplePGPCipher, error) {
+	recipients := make(openpgp.EntityList, 0, len(options.PublicKeyFiles))
+	for _, path := range options.PublicKeyFiles {
+		keys, err := ReadPGPKeyringFile(path)
+		if err != nil {
+			return SimplePGPCipher{}, err
+		}
+		recipients = append(recipients, keys...)
+	}
+
+	var keyring openpgp.EntityList
+	if options.SecretKeyringFile != "" {
+		keys, err := ReadPGPKeyringFile(options.SecretKeyringFile)
+		if err != nil {
+			return SimplePGPCipher{}, err
+		}
+		for _, key := range keys {
+			if key.PrivateKey != nil {
+				keyring = append(keyring, key)
+			}
+		}
+		if len(keyring) == 0 {
+			return SimplePGPCipher{}, fmt.Errorf("No secret keys found in %s", options.SecretKeyringFile)
+		}
+	}
+
+	// Allow values to be re-encrypted (i.e. by edit) with only a keyring
+	if len(recipients) == 0 {
+		recipients = keyring
+	}
+
+	return NewPGPCipher(recipients, keyring, options.Passphrase, options.Armor)
+}
+
+// ReadPGPKeyringFile reads a list of OpenPGP keys, which may either be armored
+// or binary.
+func ReadPGPKeyringFile(path string) (openpgp.EntityList, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+	var keys openpgp.EntityList
+	if prefix, _ := reader.Peek(len(armorPrefix)); string(prefix) == armorPrefix {
+		keys, err = openpgp.ReadArmoredKeyRing(reader)
+	} else {
+		keys, err = openpgp.ReadKeyRing(reader)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read pgp keys from %s: %s", path, err)
+	}
+	return keys, nil
+}
+
+func (s SimplePGPCipher) Encrypt(str string) (string, error) {
+	if len(s.recipients) == 0 {
+		return "", fmt.Errorf("A public key is required to encrypt values")
+	}
+
+	var buffer bytes.Buffer
+	var out io.WriteCloser = nopWriteCloser{&buffer}
+	if s.armor {
+		var err error
+		out, err = armor.Encode(&buffer, pgpMessageType, nil)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	writer, err := openpgp.Encrypt(out, s.recipients, nil, nil, nil)
+	if err != nil {
+		return "", err
+	}
+	if _, err := writer.Write([]byte(str)); err != nil {
+		return "", err
+	}
+	if err := writer.Close(); err != nil {
+		return "", err
+	}
+	if err := out.Close(); err != nil {
+		return "", err
+	}
+
+	if s.armor {
+		return buffer.String(), nil
+	}
+	return base64.StdEncoding.EncodeToString(buffer.Bytes()), nil
+}
+
+func (s SimplePGPCipher) Decrypt(encrypted string) (string, error) {
+	if len(s.keyring) == 0 {
+		return "", fmt.Errorf("A secret keyring is required to decrypt values")
+	}
+
+	var in io.Reader
+	trimmed := strings.TrimSpace(encrypted)
+	if strings.HasPrefix(trimmed, armorPrefix) {
+		block, err := armor.Decode(strings.NewReader(trimmed))
+		if err != nil {
+			return "", err
+		}
+		if block.Type != pgpMessageType {
+			return "", fmt.Errorf("Unexpected armor type: %s", block.Type)
+		}
+		in = block.Body
+	} else {
+		buffer, err := base64.StdEncoding.DecodeString(trimmed)
+		if err != nil {
+			return "", fmt.Errorf("Value is not a base64-encoded pgp message: %s", err)
+		}
+		in = bytes.NewReader(buffer)
+	}
+
+	message, err := openpgp.ReadMessage(in, s.keyring, s.prompt, nil)
+	if err != nil {
+		return "", err
+	}
+	plainText, err := ioutil.ReadAll(message.UnverifiedBody)
+	if err != nil {
+		return "", err
+	}
+	return string(plainText), nil
+}
+
+// prompt decrypts the secret keys that a message was encrypted to. Decrypted
+// keys stay decrypted in the keyring, so each passphrase is only requested
+// once.
+func (s SimplePGPCipher) prompt(keys []openpgp.Key, symmetric bool) ([]byte, error) {
+	if s.passphrase == nil {
+		return nil, fmt.Errorf("Secret key is protected by a passphrase")
+	}
+
+	for _, key := range keys {
+		if key.PrivateKey == nil || !key.PrivateKey.Encrypted {
+			continue
+		}
+
+		pass, err := s.passphrase(key.PrivateKey.KeyIdString())
+		if err != nil {
+			return nil, err
+		}
+		if err := key.PrivateKey.Decrypt(pass); err != nil {
+			return nil, fmt.Errorf("Failed to decrypt secret key %s: %s", key.PrivateKey.KeyIdString(), err)
+		}
+		return nil, nil
+	}
+	return nil, fmt.Errorf("No secret key could be decrypted")
+}
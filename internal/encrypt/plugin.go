@@ -0,0 +1,251 @@
+package encrypt
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/karimsa/secrets/internal/ciphers"
+)
+
+const (
+	// PluginPrefix is prepended to a strategy name to find its plugin in PATH
+	// (i.e. --strategy foo runs secrets-cipher-foo)
+	PluginPrefix = "secrets-cipher-"
+
+	pluginProtocolVersion = 1
+)
+
+// SimplePluginCipher delegates encryption to an external plugin executable.
+//
+// The plugin is started once, and is sent one JSON request per line on its
+// stdin. It must write exactly one JSON response per line on its stdout, and
+// exit once its stdin is closed. Anything written to stderr is passed through.
+//
+// Requests contain every value in a batch:
+//
+//	{"version":1,"method":"encrypt","values":[{"value":"...","associated_data":"<base64>"}]}
+//
+// The method is either "encrypt" or "decrypt". Associated data is only given
+// when values are bound to their path (see ciphers.AuthenticatedCipher), and
+// plugins are free to ignore it. Responses contain one result per value, in
+// the same order:
+//
+//	{"results":[{"value":"..."},{"error":"..."}]}
+//
+// If a request cannot be handled at all, plugins can instead respond with a
+// top-level error:
+//
+//	{"error":"..."}
+type SimplePluginCipher struct {
+	process *pluginProcess
+}
+
+type pluginProcess struct {
+	lock   sync.Mutex
+	path   string
+	args   []string
+	cmd    *exec.Cmd
+	stdin  io.WriteCloser
+	stdout *json.Decoder
+	err    error
+}
+
+type pluginRequest struct {
+	Version int           `json:"version"`
+	Method  string        `json:"method"`
+	Values  []pluginValue `json:"values"`
+}
+
+type pluginValue struct {
+	Value          string `json:"value"`
+	AssociatedData []byte `json:"associated_data,omitempty"`
+}
+
+type pluginResponse struct {
+	Error   string         `json:"error,omitempty"`
+	Results []pluginResult `json:"results"`
+}
+
+type pluginResult struct {
+	Value string `json:"value,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+// FindPlugin returns the path of the plugin for a strategy. Strategies that
+// contain a path separator are used as the path to the plugin directly.
+func FindPlugin(strategy string) (string, error) {
+	if strings.ContainsRune(strategy, filepath.Separator) {
+		return strategy, nil
+	}
+
+	path, err := exec.LookPath(PluginPrefix + strategy)
+	if err != nil {
+		return "", fmt.Errorf("Unsupported strategy: %s (no plugin named %s%s was found)", strategy, PluginPrefix, strategy)
+	}
+	return path, nil
+}
+
+// NewPluginCipher creates a cipher that uses the plugin at the given path. The
+// plugin is not started until the first value is encrypted or decrypted.
+func NewPluginCipher(path string, args ...string) SimplePluginCipher {
+	return SimplePluginCipher{
+		process: &pluginProcess{
+			path: path,
+			args: args,
+		},
+	}
+}
+
+func (p *pluginProcess) name() string {
+	return filepath.Base(p.path)
+}
+
+func (p *pluginProcess) start() error {
+	cmd := exec.Command(p.path, p.args...)
+	cmd.Stderr = os.Stderr
+
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("Failed to start plugin %s: %s", p.name(), err)
+	}
+
+	p.cmd = cmd
+	p.stdin = stdin
+	p.stdout = json.NewDecoder(stdout)
+	return nil
+}
+
+// stop closes the plugin's stdin and waits for it to exit.
+func (p *pluginProcess) stop() error {
+	if p.cmd == nil {
+		return nil
+	}
+
+	p.stdin.Close()
+	err := p.cmd.Wait()
+	p.cmd = nil
+	return err
+}
+
+func (p *pluginProcess) call(method string, values []ciphers.BatchValue) ([]string, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if p.err != nil {
+		return nil, p.err
+	}
+	if p.cmd == nil {
+		if err := p.start(); err != nil {
+			p.err = err
+			return nil, err
+		}
+	}
+
+	request := pluginRequest{
+		Version: pluginProtocolVersion,
+		Method:  method,
+		Values:  make([]pluginValue, len(values)),
+	}
+	for i, value := range values {
+		request.Values[i] = pluginValue{
+			Value:          value.Value,
+			AssociatedData: value.AssociatedData,
+		}
+	}
+
+	var response pluginResponse
+	err := json.NewEncoder(p.stdin).Encode(request)
+	if err == nil {
+		err = p.stdout.Decode(&response)
+	}
+	if err != nil {
+		// Once the protocol is out of sync, the plugin cannot be used again
+		if exitErr := p.stop(); exitErr != nil {
+			err = exitErr
+		}
+		p.err = fmt.Errorf("Plugin %s stopped responding: %s", p.name(), err)
+		return nil, p.err
+	}
+
+	if response.Error != "" {
+		return nil, fmt.Errorf("Plugin %s failed to %s values: %s", p.name(), method, response.Error)
+	}
+	if len(response.Results) != len(values) {
+		return nil, fmt.Errorf("Plugin %s returned %d results for %d values", p.name(), len(response.Results), len(values))
+	}
+
+	results := make([]string, len(values))
+	var errs []*ciphers.BatchError
+	for i, result := range response.Results {
+		if result.Error != "" {
+			errs = append(errs, &ciphers.BatchError{Index: i, Err: fmt.Errorf("%s", result.Error)})
+		}
+		results[i] = result.Value
+	}
+	if err := ciphers.JoinBatchErrors(errs); err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+// unbatch returns the result of a batch with a single value.
+func unbatch(results []string, err error) (string, error) {
+	if batchErr, ok := err.(*ciphers.BatchError); ok {
+		return "", batchErr.Err
+	} else if err != nil {
+		return "", err
+	}
+	return results[0], nil
+}
+
+// callOne sends a batch with a single value.
+func (s SimplePluginCipher) callOne(method string, value string, associatedData []byte) (string, error) {
+	return unbatch(s.process.call(method, []ciphers.BatchValue{
+		{Value: value, AssociatedData: associatedData},
+	}))
+}
+
+func (s SimplePluginCipher) Encrypt(str string) (string, error) {
+	return s.callOne("encrypt", str, nil)
+}
+
+func (s SimplePluginCipher) EncryptWithData(str string, associatedData []byte) (string, error) {
+	return s.callOne("encrypt", str, associatedData)
+}
+
+func (s SimplePluginCipher) EncryptBatch(values []ciphers.BatchValue) ([]string, error) {
+	return s.process.call("encrypt", values)
+}
+
+func (s SimplePluginCipher) Decrypt(encrypted string) (string, error) {
+	return s.callOne("decrypt", encrypted, nil)
+}
+
+func (s SimplePluginCipher) DecryptWithData(encrypted string, associatedData []byte) (string, error) {
+	return s.callOne("decrypt", encrypted, associatedData)
+}
+
+func (s SimplePluginCipher) DecryptBatch(values []ciphers.BatchValue) ([]string, error) {
+	return s.process.call("decrypt", values)
+}
+
+// Close stops the plugin, if it was started.
+func (s SimplePluginCipher) Close() error {
+	s.process.lock.Lock()
+	defer s.process.lock.Unlock()
+
+	return s.process.stop()
+}
@@ -0,0 +1,183 @@
+package encrypt
+
+import (
+	"bufio"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/karimsa/secrets"
+)
+
+// TestPluginHelperProcess is not a real test, it is run as a fake plugin by
+// the other plugin tests. Values are "encrypted" by hex encoding them, along
+// with their associated data and the number of the request that they were
+// encrypted in.
+func TestPluginHelperProcess(t *testing.T) {
+	if os.Getenv("SECRETS_TEST_PLUGIN") != "1" {
+		return
+	}
+
+	scanner := bufio.NewScanner(os.Stdin)
+	encoder := json.NewEncoder(os.Stdout)
+	for requestNumber := 1; scanner.Scan(); requestNumber++ {
+		var request pluginRequest
+		if err := json.Unmarshal(scanner.Bytes(), &request); err != nil {
+			os.Exit(2)
+		}
+
+		response := pluginResponse{
+			Results: make([]pluginResult, len(request.Values)),
+		}
+		for i, value := range request.Values {
+			ad := hex.EncodeToString(value.AssociatedData)
+
+			switch request.Method {
+			case "encrypt":
+				if value.Value == "crash" {
+					os.Exit(1)
+				}
+				response.Results[i].Value = fmt.Sprintf("plugin#%d(%s:%s)", requestNumber, ad, hex.EncodeToString([]byte(value.Value)))
+
+			case "decrypt":
+				parts := strings.Split(strings.TrimSuffix(value.Value[strings.IndexByte(value.Value, '(')+1:], ")"), ":")
+				if len(parts) != 2 || parts[0] != ad {
+					response.Results[i].Error = "Value is bound to a different location"
+					continue
+				}
+				plainText, _ := hex.DecodeString(parts[1])
+				response.Results[i].Value = string(plainText)
+
+			default:
+				response = pluginResponse{Error: "Unsupported method: " + request.Method}
+			}
+		}
+		encoder.Encode(response)
+	}
+	os.Exit(0)
+}
+
+func newTestPlugin(t *testing.T) SimplePluginCipher {
+	t.Setenv("SECRETS_TEST_PLUGIN", "1")
+	cipher := NewPluginCipher(os.Args[0], "-test.run=^TestPluginHelperProcess$")
+	t.Cleanup(func() {
+		cipher.Close()
+	})
+	return cipher
+}
+
+func TestPluginEncrypt(t *testing.T) {
+	cipher := newTestPlugin(t)
+
+	encrypted, err := cipher.EncryptWithData("some test text", []byte("path=a"))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	decrypted, err := cipher.DecryptWithData(encrypted, []byte("path=a"))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if decrypted != "some test text" {
+		t.Error(fmt.Sprintf("Decryption failed: '%s'", decrypted))
+		return
+	}
+
+	// Errors for single values are reported by the plugin
+	if _, err := cipher.DecryptWithData(encrypted, []byte("path=b")); err == nil || !strings.Contains(err.Error(), "different location") {
+		t.Error(fmt.Errorf("Expected decryption to fail with the plugin's error: %v", err))
+		return
+	}
+
+	// Batches should be handled by one request, with results in order
+	results, err := cipher.EncryptBatch([]secrets.BatchValue{
+		{Value: "first"},
+		{Value: "second"},
+	})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if len(results) != 2 || !strings.HasPrefix(results[0], "plugin#4(") || !strings.HasPrefix(results[1], "plugin#4(") {
+		t.Error(fmt.Errorf("Expected values to be encrypted in a single request: %v", results))
+		return
+	}
+	decryptedValues, err := cipher.DecryptBatch([]secrets.BatchValue{
+		{Value: results[1]},
+		{Value: results[0]},
+	})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if decryptedValues[0] != "second" || decryptedValues[1] != "first" {
+		t.Error(fmt.Errorf("Unexpected batch results: %v", decryptedValues))
+		return
+	}
+}
+
+func TestPluginEnvFile(t *testing.T) {
+	cipher := newTestPlugin(t)
+
+	env, err := secrets.New(secrets.NewEnvOptions{
+		Format:      "dotenv",
+		Reader:      strings.NewReader("A=first\nB=second\nC=third\n"),
+		Cipher:      cipher,
+		SecurePaths: []string{".A", ".B", ".C"},
+	})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	data, err := env.Export("dotenv")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if strings.Count(string(data), "plugin#1(") != 3 {
+		t.Error(fmt.Errorf("Expected the file to be encrypted in a single request:\n%s", data))
+		return
+	}
+
+	env, err = secrets.Open(secrets.OpenEnvOptions{
+		Format:      "dotenv",
+		Reader:      strings.NewReader(string(data)),
+		Cipher:      cipher,
+		SecurePaths: []string{".A", ".B", ".C"},
+	})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	data, err = env.UnsafeRawExport("dotenv")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if string(data) != "A=first\nB=second\nC=third\n" {
+		t.Error(fmt.Errorf("Unexpected output:\n%s", data))
+		return
+	}
+}
+
+func TestPluginCrash(t *testing.T) {
+	cipher := newTestPlugin(t)
+
+	if _, err := cipher.Encrypt("crash"); err == nil || !strings.Contains(err.Error(), "stopped responding") {
+		t.Error(fmt.Errorf("Expected a crashed plugin to be reported: %v", err))
+		return
+	}
+	if _, err := cipher.Encrypt("some test text"); err == nil {
+		t.Error(fmt.Errorf("A crashed plugin should not be used again"))
+		return
+	}
+
+	if _, err := FindPlugin("does-not-exist"); err == nil || !strings.Contains(err.Error(), PluginPrefix+"does-not-exist") {
+		t.Error(fmt.Errorf("Expected missing plugins to be reported: %v", err))
+		return
+	}
+}
@@ -0,0 +1,195 @@
+package encrypt
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"filippo.io/age"
+	"filippo.io/age/agessh"
+	"golang.org/x/crypto/ssh"
+)
+
+// SSHCipherOptions configures an age cipher that uses SSH keys (ssh-ed25519 or
+// ssh-rsa) instead of age keys. Values are still age files, so they can be
+// decrypted by the standalone age tool using `age -d -i ~/.ssh/id_ed25519`.
+type SSHCipherOptions struct {
+	// Recipients are SSH public keys in authorized_keys format
+	// (i.e. "ssh-ed25519 AAAA... alice@laptop")
+	Recipients []string
+
+	// RecipientFiles are authorized_keys files (or .pub files)
+	RecipientFiles []string
+
+	// IdentityFiles are SSH private keys, used to decrypt values. When no
+	// recipients are given, values are encrypted to the identities instead.
+	IdentityFiles []string
+
+	// Passphrase is called to decrypt passphrase-protected private keys. It is
+	// only called once a value that was encrypted to the key is decrypted.
+	Passphrase func(path string) ([]byte, error)
+
+	// Armor encodes values using the age ASCII armor instead of base64
+	Armor bool
+}
+
+// DefaultSSHIdentityFiles returns the default SSH private keys of the current
+// user (~/.ssh/id_ed25519 and ~/.ssh/id_rsa) that exist.
+func DefaultSSHIdentityFiles() []string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return nil
+	}
+
+	paths := make([]string, 0, 2)
+	for _, name := range []string{"id_ed25519", "id_rsa"} {
+		path := filepath.Join(home, ".ssh", name)
+		if _, err := os.Stat(path); err == nil {
+			paths = append(paths, path)
+		}
+	}
+	return paths
+}
+
+func LoadSSHCipher(options SSHCipherOptions) (SimpleAgeCipher, error) {
+	recipients := make([]age.Recipient, 0, len(options.Recipients))
+	for _, str := range options.Recipients {
+		recipient, err := ParseSSHRecipient(str)
+		if err != nil {
+			return SimpleAgeCipher{}, err
+		}
+		recipients = append(recipients, recipient)
+	}
+
+	for _, path := range options.RecipientFiles {
+		fileRecipients, err := ReadSSHRecipientsFile(path)
+		if err != nil {
+			return SimpleAgeCipher{}, err
+		}
+		recipients = append(recipients, fileRecipients...)
+	}
+
+	identities := make([]age.Identity, 0, len(options.IdentityFiles))
+	for _, path := range options.IdentityFiles {
+		identity, err := ReadSSHIdentityFile(path, options.Passphrase)
+		if err != nil {
+			return SimpleAgeCipher{}, err
+		}
+		identities = append(identities, identity)
+	}
+
+	// Allow values to be re-encrypted (i.e. by edit) with only an identity
+	if len(recipients) == 0 {
+		for _, identity := range identities {
+			switch identity := identity.(type) {
+			case *agessh.Ed25519Identity:
+				recipients = append(recipients, identity.Recipient())
+			case *agessh.RSAIdentity:
+				recipients = append(recipients, identity.Recipient())
+			case *agessh.EncryptedSSHIdentity:
+				recipients = append(recipients, identity.Recipient())
+			}
+		}
+	}
+
+	return NewAgeCipher(recipients, identities, options.Armor)
+}
+
+// ParseSSHRecipient parses a single SSH public key in authorized_keys format.
+func ParseSSHRecipient(str string) (age.Recipient, error) {
+	publicKey, _, _, _, err := ssh.ParseAuthorizedKey([]byte(str))
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse SSH public key: %s", err)
+	}
+	return newSSHRecipient(publicKey)
+}
+
+func newSSHRecipient(publicKey ssh.PublicKey) (age.Recipient, error) {
+	switch publicKey.Type() {
+	case ssh.KeyAlgoED25519:
+		return agessh.NewEd25519Recipient(publicKey)
+	case ssh.KeyAlgoRSA:
+		return agessh.NewRSARecipient(publicKey)
+	default:
+		return nil, fmt.Errorf("Unsupported SSH key type: %s (only ssh-ed25519 and ssh-rsa are supported)", publicKey.Type())
+	}
+}
+
+// ReadSSHRecipientsFile reads SSH public keys from an authorized_keys file.
+// Blank lines and comments are ignored.
+func ReadSSHRecipientsFile(path string) ([]age.Recipient, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	recipients := make([]age.Recipient, 0, 10)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+
+		publicKey, _, _, _, err := ssh.ParseAuthorizedKey(line)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to parse SSH public key at %s:%d: %s", path, lineNumber, err)
+		}
+		recipient, err := newSSHRecipient(publicKey)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to parse SSH public key at %s:%d: %s", path, lineNumber, err)
+		}
+		recipients = append(recipients, recipient)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(recipients) == 0 {
+		return nil, fmt.Errorf("No SSH public keys found in %s", path)
+	}
+	return recipients, nil
+}
+
+// ReadSSHIdentityFile reads an SSH private key. If the key is protected by a
+// passphrase, the passphrase is only requested once a value that was encrypted
+// to the key needs to be decrypted. Keys in the legacy PEM format do not
+// include their public key, so it is read from the matching .pub file instead.
+func ReadSSHIdentityFile(path string, passphrase func(path string) ([]byte, error)) (age.Identity, error) {
+	pemBytes, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	identity, err := agessh.ParseIdentity(pemBytes)
+	if err == nil {
+		return identity, nil
+	}
+
+	missing, ok := err.(*ssh.PassphraseMissingError)
+	if !ok {
+		return nil, fmt.Errorf("Failed to read SSH private key %s: %s", path, err)
+	}
+	if passphrase == nil {
+		return nil, fmt.Errorf("SSH private key %s is protected by a passphrase", path)
+	}
+
+	publicKey := missing.PublicKey
+	if publicKey == nil {
+		publicKeyBytes, err := ioutil.ReadFile(path + ".pub")
+		if err != nil {
+			return nil, fmt.Errorf("Failed to read the public key of %s: %s", path, err)
+		}
+		publicKey, _, _, _, err = ssh.ParseAuthorizedKey(publicKeyBytes)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to read the public key of %s: %s", path, err)
+		}
+	}
+
+	return agessh.NewEncryptedSSHIdentity(publicKey, pemBytes, func() ([]byte, error) {
+		return passphrase(path)
+	})
+}
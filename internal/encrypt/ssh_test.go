@@ -0,0 +1,168 @@
+package encrypt
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// writeTestSSHKey writes an SSH private key to a temporary directory, and
+// returns its path along with the public key in authorized_keys format.
+func writeTestSSHKey(t *testing.T, key interface{}, passphrase []byte) (string, string) {
+	var block *pem.Block
+	var err error
+	if passphrase == nil {
+		block, err = ssh.MarshalPrivateKey(key, "test@secrets")
+	} else {
+		block, err = ssh.MarshalPrivateKeyWithPassphrase(key, "test@secrets", passphrase)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(t.TempDir(), "id_test")
+	if err := ioutil.WriteFile(path, pem.EncodeToMemory(block), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path, string(ssh.MarshalAuthorizedKey(signer.PublicKey()))
+}
+
+func TestSSHEncrypt(t *testing.T) {
+	_, ed25519Key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ed25519Path, ed25519Public := writeTestSSHKey(t, ed25519Key, nil)
+	rsaPath, rsaPublic := writeTestSSHKey(t, rsaKey, nil)
+
+	authorizedKeys := filepath.Join(t.TempDir(), "authorized_keys")
+	if err := ioutil.WriteFile(authorizedKeys, []byte("# team keys\n"+ed25519Public+"\n"+rsaPublic), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	data := "foobar - some hello world text blah blah"
+	encrypter, err := LoadSSHCipher(SSHCipherOptions{
+		RecipientFiles: []string{authorizedKeys},
+	})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	encrypted, err := encrypter.Encrypt(data)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	for _, path := range []string{ed25519Path, rsaPath} {
+		decrypter, err := LoadSSHCipher(SSHCipherOptions{
+			IdentityFiles: []string{path},
+		})
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		decrypted, err := decrypter.Decrypt(encrypted)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		if decrypted != data {
+			t.Error(fmt.Sprintf("Decryption failed: '%s' (%d)", decrypted, len(decrypted)))
+			return
+		}
+	}
+
+	// Values encrypted to a single key cannot be decrypted by the others
+	single, err := LoadSSHCipher(SSHCipherOptions{
+		Recipients: []string{ed25519Public},
+	})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	encrypted, err = single.Encrypt(data)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	other, err := LoadSSHCipher(SSHCipherOptions{
+		IdentityFiles: []string{rsaPath},
+	})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if decrypted, err := other.Decrypt(encrypted); err == nil {
+		t.Error(fmt.Errorf("Decryption should have failed: %s", decrypted))
+		return
+	}
+}
+
+func TestSSHEncryptedKey(t *testing.T) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path, _ := writeTestSSHKey(t, key, []byte("testing"))
+
+	if _, err := ReadSSHIdentityFile(path, nil); err == nil {
+		t.Error(fmt.Errorf("Reading a protected key should fail without a passphrase"))
+		return
+	}
+
+	prompts := 0
+	cipher, err := LoadSSHCipher(SSHCipherOptions{
+		IdentityFiles: []string{path},
+		Passphrase: func(keyPath string) ([]byte, error) {
+			if keyPath != path {
+				return nil, fmt.Errorf("Unexpected key path: %s", keyPath)
+			}
+			prompts++
+			return []byte("testing"), nil
+		},
+	})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	for _, data := range []string{"first value", "second value"} {
+		encrypted, err := cipher.Encrypt(data)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		decrypted, err := cipher.Decrypt(encrypted)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		if decrypted != data {
+			t.Error(fmt.Sprintf("Decryption failed: '%s'", decrypted))
+			return
+		}
+	}
+
+	if prompts != 1 {
+		t.Error(fmt.Errorf("Expected the passphrase to be requested once, but it was requested %d times", prompts))
+		return
+	}
+}
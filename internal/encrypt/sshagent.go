@@ -0,0 +1,305 @@
+package encrypt
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"os"
+
+	"github.com/karimsa/secrets/internal/ciphers"
+	"golang.org/x/crypto/hkdf"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+const (
+	kdfSSHAgent = "ssh-agent"
+
+	sshAgentChallenge = "secrets/v2/ssh-agent\x00"
+)
+
+// SimpleSSHAgentCipher encrypts values using a key that is held by a running
+// ssh-agent, without the private key ever being exposed to this process.
+//
+// Keys are derived by asking the agent to sign a challenge that is made up of
+// the file's salt. Since ssh-ed25519 and ssh-rsa signatures are deterministic,
+// the same key always produces the same signature for the same salt, which is
+// run through HKDF to get the master key for the file. Like symmetric
+// encryption, each value is then encrypted with its own subkey, and the agent
+// is only asked for one signature per salt.
+//
+// Values record the fingerprint of the key they were encrypted with, so any
+// key that is loaded in the agent can be used to decrypt them.
+type SimpleSSHAgentCipher struct {
+	agent     agent.Agent
+	publicKey ssh.PublicKey
+	algorithm string
+	encoding  string
+	keys      *keyCache
+}
+
+type SSHAgentCipherOptions struct {
+	// PublicKey selects the agent key that new values are encrypted with. If it
+	// is not given, the first supported key in the agent is used.
+	PublicKey ssh.PublicKey
+
+	// Algorithm is the AEAD used to encrypt new values (defaults to
+	// DefaultAlgorithm)
+	Algorithm string
+
+	// Encoding is the encoding of new values (defaults to EncodingHex).
+	// Decryption detects the encoding of each value.
+	Encoding string
+}
+
+// DialSSHAgent connects to the ssh-agent listening on SSH_AUTH_SOCK.
+func DialSSHAgent() (agent.ExtendedAgent, error) {
+	socket := os.Getenv("SSH_AUTH_SOCK")
+	if socket == "" {
+		return nil, fmt.Errorf("SSH_AUTH_SOCK is not set (is ssh-agent running?)")
+	}
+
+	conn, err := net.Dial("unix", socket)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to connect to ssh-agent: %s", err)
+	}
+	return sshAgentConn{agent.NewClient(conn), conn}, nil
+}
+
+// sshAgentConn is an ssh-agent client that owns its connection, so that
+// SimpleSSHAgentCipher can close it.
+type sshAgentConn struct {
+	agent.ExtendedAgent
+	io.Closer
+}
+
+// Close closes the connection to the ssh-agent, if the cipher was given one
+// by DialSSHAgent.
+func (s SimpleSSHAgentCipher) Close() error {
+	if closer, ok := s.agent.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+func NewSSHAgentCipher(client agent.Agent, options SSHAgentCipherOptions) (SimpleSSHAgentCipher, error) {
+	s := SimpleSSHAgentCipher{
+		agent:     client,
+		publicKey: options.PublicKey,
+		algorithm: DefaultAlgorithm,
+		encoding:  EncodingHex,
+		keys:      newKeyCache(),
+	}
+
+	if options.Algorithm != "" {
+		if _, err := newAEAD(options.Algorithm, make([]byte, dataKeyLength)); err != nil {
+			return s, err
+		}
+		s.algorithm = options.Algorithm
+	}
+
+	if options.Encoding != "" {
+		if err := checkEncoding(options.Encoding); err != nil {
+			return s, err
+		}
+		s.encoding = options.Encoding
+	}
+
+	if s.publicKey != nil {
+		if err := checkSSHAgentKey(s.publicKey); err != nil {
+			return s, err
+		}
+		fingerprint := sshKeyFingerprint(s.publicKey)
+		if _, err := s.findKey(fingerprint); err != nil {
+			if _, missing := err.(*ciphers.KeyMismatchError); missing {
+				return s, fmt.Errorf("Key is not loaded in ssh-agent: %s", fingerprint)
+			}
+			return s, err
+		}
+		return s, nil
+	}
+
+	keys, err := client.List()
+	if err != nil {
+		return s, fmt.Errorf("Failed to list ssh-agent keys: %s", err)
+	}
+	for _, key := range keys {
+		if checkSSHAgentKey(key) == nil {
+			s.publicKey = key
+			return s, nil
+		}
+	}
+	return s, fmt.Errorf("No ssh-ed25519 or ssh-rsa keys found in ssh-agent")
+}
+
+// checkSSHAgentKey verifies that a key produces deterministic signatures,
+// which is required for the derived keys to be stable.
+func checkSSHAgentKey(publicKey ssh.PublicKey) error {
+	switch publicKey.Type() {
+	case ssh.KeyAlgoED25519, ssh.KeyAlgoRSA:
+		return nil
+	default:
+		return fmt.Errorf("Unsupported ssh-agent key type: %s (only ssh-ed25519 and ssh-rsa keys produce deterministic signatures)", publicKey.Type())
+	}
+}
+
+// sshKeyFingerprint returns a short identifier for an SSH public key.
+func sshKeyFingerprint(publicKey ssh.PublicKey) string {
+	sum := sha256.Sum256(publicKey.Marshal())
+	return hex.EncodeToString(sum[:keyIDLength])
+}
+
+// findKey returns the agent key with the given fingerprint. The agent is only
+// asked for its keys once per fingerprint, and keys that are not loaded are
+// reported as a KeyMismatchError.
+func (s SimpleSSHAgentCipher) findKey(fingerprint string) (ssh.PublicKey, error) {
+	publicKey, err := s.keys.cachedKey("key:"+fingerprint, func() ([]byte, error) {
+		keys, err := s.agent.List()
+		if err != nil {
+			return nil, fmt.Errorf("Failed to list ssh-agent keys: %s", err)
+		}
+		for _, key := range keys {
+			if sshKeyFingerprint(key) == fingerprint {
+				return key.Marshal(), nil
+			}
+		}
+		return nil, &ciphers.KeyMismatchError{KeyID: fingerprint}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return ssh.ParsePublicKey(publicKey)
+}
+
+// deriveMasterKey asks the agent to sign the challenge for the given salt, and
+// derives the master key from the signature.
+func (s SimpleSSHAgentCipher) deriveMasterKey(publicKey ssh.PublicKey, salt []byte) ([]byte, error) {
+	if err := checkSSHAgentKey(publicKey); err != nil {
+		return nil, err
+	}
+
+	id := fmt.Sprintf("%s:%x", sshKeyFingerprint(publicKey), salt)
+	return s.keys.cachedKey(id, func() ([]byte, error) {
+		challenge := append([]byte(sshAgentChallenge), salt...)
+
+		var signature *ssh.Signature
+		var err error
+		if extended, ok := s.agent.(agent.ExtendedAgent); ok && publicKey.Type() == ssh.KeyAlgoRSA {
+			signature, err = extended.SignWithFlags(publicKey, challenge, agent.SignatureFlagRsaSha256)
+		} else {
+			signature, err = s.agent.Sign(publicKey, challenge)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Failed to sign with ssh-agent: %s", err)
+		}
+
+		masterKey := make([]byte, dataKeyLength)
+		if _, err := io.ReadFull(hkdf.New(sha256.New, signature.Blob, salt, []byte(sshAgentChallenge+signature.Format)), masterKey); err != nil {
+			return nil, err
+		}
+		return masterKey, nil
+	})
+}
+
+func (s SimpleSSHAgentCipher) Encrypt(str string) (string, error) {
+	return s.EncryptWithData(str, nil)
+}
+
+func (s SimpleSSHAgentCipher) EncryptWithData(str string, associatedData []byte) (string, error) {
+	return s.EncryptPadded(str, associatedData, 0)
+}
+
+// EncryptPadded encrypts a value like EncryptWithData, after padding it to the
+// given length.
+func (s SimpleSSHAgentCipher) EncryptPadded(str string, associatedData []byte, length int) (string, error) {
+	e := newEnvelope()
+	e.set("alg", s.algorithm)
+	e.setEncoding(s.encoding)
+	e.set("kdf", kdfSSHAgent)
+	e.set("key", sshKeyFingerprint(s.publicKey))
+	e.set("subkey", subkeyHKDF)
+	if len(associatedData) > 0 {
+		e.set("ad", associatedDataTag(associatedData))
+	}
+
+	salt, err := s.keys.fileSalt(func() ([]byte, error) {
+		salt := make([]byte, saltLength)
+		_, err := rand.Read(salt)
+		return salt, err
+	})
+	if err != nil {
+		return "", err
+	}
+	e.setBytes("salt", salt)
+
+	masterKey, err := s.deriveMasterKey(s.publicKey, salt)
+	if err != nil {
+		return "", err
+	}
+	return sealEnvelope(e, s.algorithm, masterKey, []byte(str), associatedData, length)
+}
+
+// PaddedLength returns the length that an encrypted value was padded to, or 0
+// if it was not padded.
+func (s SimpleSSHAgentCipher) PaddedLength(encrypted string) (int, error) {
+	return envelopePaddedLength(encrypted)
+}
+
+func (s SimpleSSHAgentCipher) Decrypt(encrypted string) (string, error) {
+	return s.DecryptWithData(encrypted, nil)
+}
+
+func (s SimpleSSHAgentCipher) DecryptWithData(encrypted string, associatedData []byte) (string, error) {
+	e, err := parseEnvelope(encrypted)
+	if err != nil {
+		return "", err
+	}
+	if e.version != envelopeVersion {
+		return "", fmt.Errorf("Unsupported envelope version: v%d", e.version)
+	}
+
+	associatedData, err = checkAssociatedData(e, associatedData)
+	if err != nil {
+		return "", err
+	}
+
+	alg, err := e.require("alg")
+	if err != nil {
+		return "", err
+	}
+	if kdf, err := e.require("kdf"); err != nil {
+		return "", err
+	} else if kdf != kdfSSHAgent {
+		return "", fmt.Errorf("Value was not encrypted with ssh-agent (kdf=%s)", kdf)
+	}
+	fingerprint, err := e.require("key")
+	if err != nil {
+		return "", err
+	}
+	salt, err := e.getBytes("salt")
+	if err != nil {
+		return "", err
+	}
+
+	publicKey, err := s.findKey(fingerprint)
+	if err != nil {
+		return "", err
+	}
+	masterKey, err := s.deriveMasterKey(publicKey, salt)
+	if err != nil {
+		return "", err
+	}
+	plainText, err := openEnvelope(e, alg, masterKey, associatedData)
+	if err != nil {
+		return "", err
+	}
+
+	if bytes.Equal(publicKey.Marshal(), s.publicKey.Marshal()) {
+		s.keys.adoptSalt(salt)
+	}
+	return string(plainText), nil
+}
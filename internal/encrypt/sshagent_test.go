@@ -0,0 +1,211 @@
+package encrypt
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"fmt"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// countingAgent counts the number of signatures and key lists that are
+// requested from an agent.
+type countingAgent struct {
+	agent.ExtendedAgent
+	signatures int
+	lists      int
+}
+
+func (a *countingAgent) List() ([]*agent.Key, error) {
+	a.lists++
+	return a.ExtendedAgent.List()
+}
+
+func (a *countingAgent) Sign(key ssh.PublicKey, data []byte) (*ssh.Signature, error) {
+	a.signatures++
+	return a.ExtendedAgent.Sign(key, data)
+}
+
+func (a *countingAgent) SignWithFlags(key ssh.PublicKey, data []byte, flags agent.SignatureFlags) (*ssh.Signature, error) {
+	a.signatures++
+	return a.ExtendedAgent.SignWithFlags(key, data, flags)
+}
+
+func newTestAgent(t *testing.T, keys ...interface{}) *countingAgent {
+	keyring := agent.NewKeyring()
+	for _, key := range keys {
+		if err := keyring.Add(agent.AddedKey{PrivateKey: key}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return &countingAgent{ExtendedAgent: keyring.(agent.ExtendedAgent)}
+}
+
+func testPublicKey(t *testing.T, key interface{}) ssh.PublicKey {
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signer.PublicKey()
+}
+
+func TestSSHAgentEncrypt(t *testing.T) {
+	_, ed25519Key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, key := range []interface{}{ed25519Key, rsaKey} {
+		client := newTestAgent(t, key)
+		cipher, err := NewSSHAgentCipher(client, SSHAgentCipherOptions{})
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		values := []string{"first value", "second value", "third value"}
+		encrypted := make([]string, len(values))
+		for i, value := range values {
+			encrypted[i], err = cipher.EncryptWithData(value, []byte(fmt.Sprintf("path=%d", i)))
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if !strings.Contains(encrypted[i], ",kdf=ssh-agent,") {
+				t.Error(fmt.Errorf("Unexpected envelope: %s", encrypted[i]))
+				return
+			}
+		}
+
+		// Decrypting with a new cipher should ask the agent for the same key
+		decrypter, err := NewSSHAgentCipher(client, SSHAgentCipherOptions{})
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		client.lists = 0
+		for i, value := range values {
+			decrypted, err := decrypter.DecryptWithData(encrypted[i], []byte(fmt.Sprintf("path=%d", i)))
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if decrypted != value {
+				t.Error(fmt.Sprintf("Decryption failed: '%s'", decrypted))
+				return
+			}
+		}
+
+		if client.signatures != 2 {
+			t.Error(fmt.Errorf("Expected one signature per cipher, but got %d", client.signatures))
+			return
+		}
+		if client.lists != 1 {
+			t.Error(fmt.Errorf("Expected the agent's keys to be listed once, but got %d", client.lists))
+			return
+		}
+
+		// Agents without the key cannot decrypt values
+		_, otherKey, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		other, err := NewSSHAgentCipher(newTestAgent(t, otherKey), SSHAgentCipherOptions{})
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		if decrypted, err := other.DecryptWithData(encrypted[0], []byte("path=0")); err == nil {
+			t.Error(fmt.Errorf("Decryption should have failed: %s", decrypted))
+			return
+		}
+	}
+}
+
+func TestSSHAgentKeySelection(t *testing.T) {
+	_, firstKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, secondKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := newTestAgent(t, firstKey, secondKey)
+
+	cipher, err := NewSSHAgentCipher(client, SSHAgentCipherOptions{
+		PublicKey: testPublicKey(t, secondKey),
+	})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	encrypted, err := cipher.Encrypt("some test text")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if !strings.Contains(encrypted, ",key="+sshKeyFingerprint(testPublicKey(t, secondKey))+",") {
+		t.Error(fmt.Errorf("Value was not encrypted with the selected key: %s", encrypted))
+		return
+	}
+
+	// The key is found using the fingerprint in the value
+	decrypter, err := NewSSHAgentCipher(client, SSHAgentCipherOptions{
+		PublicKey: testPublicKey(t, firstKey),
+	})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	decrypted, err := decrypter.Decrypt(encrypted)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if decrypted != "some test text" {
+		t.Error(fmt.Sprintf("Decryption failed: '%s'", decrypted))
+		return
+	}
+
+	// Keys that are not loaded in the agent are rejected
+	_, missingKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewSSHAgentCipher(client, SSHAgentCipherOptions{
+		PublicKey: testPublicKey(t, missingKey),
+	}); err == nil {
+		t.Error(fmt.Errorf("Selecting a key that is not in the agent should fail"))
+		return
+	}
+}
+
+func TestSSHAgentUnsupportedKey(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := newTestAgent(t, key)
+
+	if _, err := NewSSHAgentCipher(client, SSHAgentCipherOptions{}); err == nil {
+		t.Error(fmt.Errorf("Agents with only ecdsa keys should be rejected"))
+		return
+	}
+	if _, err := NewSSHAgentCipher(client, SSHAgentCipherOptions{
+		PublicKey: testPublicKey(t, key),
+	}); err == nil {
+		t.Error(fmt.Errorf("ecdsa keys should be rejected"))
+		return
+	}
+}
@@ -0,0 +1,325 @@
+package encrypt
+
+import (
+	"bufio"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	"github.com/karimsa/secrets/internal/ciphers"
+	"golang.org/x/crypto/hkdf"
+)
+
+const (
+	// DefaultStreamChunkSize is the amount of plaintext in each chunk of an
+	// encrypted stream
+	DefaultStreamChunkSize = 64 * 1024
+
+	// maxStreamChunkSize bounds the chunk size that will be accepted from
+	// encrypted streams, so that a malicious stream cannot exhaust memory
+	maxStreamChunkSize = 16 * 1024 * 1024
+
+	streamChunked   = "chunked"
+	streamPrefix    = envelopePrefix + "v2,stream="
+	streamNonceSize = 16
+
+	// base64LineLength is the length of the lines that base64 streams are
+	// wrapped at
+	base64LineLength = 76
+)
+
+// StreamOptions configure how EncryptStream encrypts new streams.
+type StreamOptions struct {
+	// Algorithm is the AEAD used to encrypt each chunk (defaults to
+	// DefaultAlgorithm)
+	Algorithm string
+
+	// ChunkSize is the amount of plaintext in each chunk (defaults to
+	// DefaultStreamChunkSize)
+	ChunkSize int
+
+	// Base64 writes the chunks as base64 text instead of binary
+	Base64 bool
+}
+
+// EncryptStream encrypts everything read from r and writes it to w, using a
+// constant amount of memory. This is the STREAM construction used by age: a
+// random file key is encrypted using the given cipher and stored in a header
+// line, and the input is split into chunks that are each encrypted with a key
+// derived from the file key. The nonce of every chunk contains its index and
+// whether it is the last chunk, so chunks cannot be reordered, dropped or
+// truncated without being noticed.
+func EncryptStream(cipher ciphers.SimpleCipher, r io.Reader, w io.Writer, options StreamOptions) error {
+	if options.Algorithm == "" {
+		options.Algorithm = DefaultAlgorithm
+	}
+	if options.ChunkSize == 0 {
+		options.ChunkSize = DefaultStreamChunkSize
+	}
+	if options.ChunkSize < 1 || options.ChunkSize > maxStreamChunkSize {
+		return fmt.Errorf("Invalid chunk size: %d (must be between 1 and %d)", options.ChunkSize, maxStreamChunkSize)
+	}
+
+	fileKey := make([]byte, dataKeyLength)
+	if _, err := rand.Read(fileKey); err != nil {
+		return err
+	}
+	defer wipeBytes(fileKey)
+	wrappedKey, err := cipher.Encrypt(hex.EncodeToString(fileKey))
+	if err != nil {
+		return fmt.Errorf("Failed to encrypt file key: %s", err)
+	}
+
+	nonce := make([]byte, streamNonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+
+	// Base64 streams also use base64 for the params of their header
+	e := newEnvelope()
+	e.set("stream", streamChunked)
+	e.set("alg", options.Algorithm)
+	e.setInt("chunk", options.ChunkSize)
+	if options.Base64 {
+		e.setEncoding(EncodingBase64)
+	}
+	e.setBytes("key", []byte(wrappedKey))
+	e.setBytes("nonce", nonce)
+	if _, err := io.WriteString(w, e.String()+"\n"); err != nil {
+		return err
+	}
+
+	aead, err := newStreamAEAD(e, fileKey)
+	if err != nil {
+		return err
+	}
+
+	if options.Base64 {
+		wrapped := &lineWriter{w: w, length: base64LineLength}
+		encoder := base64.NewEncoder(base64.StdEncoding, wrapped)
+		if err := aead.seal(bufio.NewReader(r), encoder, options.ChunkSize); err != nil {
+			return err
+		}
+		if err := encoder.Close(); err != nil {
+			return err
+		}
+		return wrapped.Close()
+	}
+	return aead.seal(bufio.NewReader(r), w, options.ChunkSize)
+}
+
+// DecryptStream decrypts a stream created by EncryptStream, and writes the
+// plaintext to w as each chunk is verified. Files that were encrypted as a
+// single value by older versions are decrypted using the cipher directly.
+func DecryptStream(cipher ciphers.SimpleCipher, r io.Reader, w io.Writer) error {
+	reader := bufio.NewReader(r)
+	if prefix, _ := reader.Peek(len(streamPrefix)); string(prefix) != streamPrefix {
+		encrypted, err := ioutil.ReadAll(reader)
+		if err != nil {
+			return err
+		}
+		decrypted, err := cipher.Decrypt(string(encrypted))
+		if err != nil {
+			return err
+		}
+		_, err = io.WriteString(w, decrypted)
+		return err
+	}
+
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return fmt.Errorf("Encrypted file is truncated")
+	}
+	e, err := parseEnvelope(line[:len(line)-1])
+	if err != nil {
+		return err
+	}
+	if e.version != envelopeVersion {
+		return fmt.Errorf("Unsupported envelope version: v%d", e.version)
+	}
+	if stream, _ := e.get("stream"); stream != streamChunked {
+		return fmt.Errorf("Unsupported stream format: %s", stream)
+	}
+	chunkSize, err := e.getInt("chunk")
+	if err != nil {
+		return err
+	}
+	if chunkSize < 1 || chunkSize > maxStreamChunkSize {
+		return fmt.Errorf("Invalid chunk size: %d", chunkSize)
+	}
+
+	wrappedKey, err := e.getBytes("key")
+	if err != nil {
+		return err
+	}
+	keyHex, err := cipher.Decrypt(string(wrappedKey))
+	if err != nil {
+		return fmt.Errorf("Failed to decrypt file key: %s", err)
+	}
+	fileKey, err := hex.DecodeString(keyHex)
+	if err != nil || len(fileKey) != dataKeyLength {
+		return fmt.Errorf("Failed to decrypt file key: invalid key")
+	}
+	defer wipeBytes(fileKey)
+
+	aead, err := newStreamAEAD(e, fileKey)
+	if err != nil {
+		return err
+	}
+
+	switch enc, _ := e.get("enc"); enc {
+	case "":
+		return aead.open(reader, w, chunkSize)
+	case encodingB64:
+		return aead.open(bufio.NewReader(base64.NewDecoder(base64.StdEncoding, reader)), w, chunkSize)
+	default:
+		return fmt.Errorf("Unsupported encoding: %s", enc)
+	}
+}
+
+// streamAEAD encrypts the chunks of a stream. Each chunk is authenticated
+// along with the header of the stream.
+type streamAEAD struct {
+	aead   cipher.AEAD
+	header []byte
+}
+
+func newStreamAEAD(e *envelope, fileKey []byte) (*streamAEAD, error) {
+	algorithm, err := e.require("alg")
+	if err != nil {
+		return nil, err
+	}
+	nonce, err := e.getBytes("nonce")
+	if err != nil {
+		return nil, err
+	}
+
+	key := make([]byte, dataKeyLength)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, fileKey, nonce, []byte("secrets/v2/stream/"+algorithm)), key); err != nil {
+		return nil, err
+	}
+	defer wipeBytes(key)
+
+	aead, err := newAEAD(algorithm, key)
+	if err != nil {
+		return nil, err
+	}
+	return &streamAEAD{aead: aead, header: e.header()}, nil
+}
+
+// chunkNonce is the big-endian index of the chunk, followed by a byte that is
+// set for the last chunk.
+func (s *streamAEAD) chunkNonce(index uint64, last bool) []byte {
+	nonce := make([]byte, s.aead.NonceSize())
+	binary.BigEndian.PutUint64(nonce[len(nonce)-9:], index)
+	if last {
+		nonce[len(nonce)-1] = 1
+	}
+	return nonce
+}
+
+func (s *streamAEAD) seal(r *bufio.Reader, w io.Writer, chunkSize int) error {
+	chunk := make([]byte, chunkSize)
+	sealed := make([]byte, 0, chunkSize+s.aead.Overhead())
+	defer wipeBytes(chunk)
+
+	for index := uint64(0); ; index++ {
+		n, err := io.ReadFull(r, chunk)
+		last := err == io.EOF || err == io.ErrUnexpectedEOF
+		if err != nil && !last {
+			return err
+		}
+		if !last {
+			if _, err := r.Peek(1); err == io.EOF {
+				last = true
+			}
+		}
+
+		sealed = s.aead.Seal(sealed[:0], s.chunkNonce(index, last), chunk[:n], s.header)
+		if _, err := w.Write(sealed); err != nil {
+			return err
+		}
+		if last {
+			return nil
+		}
+	}
+}
+
+func (s *streamAEAD) open(r *bufio.Reader, w io.Writer, chunkSize int) error {
+	sealed := make([]byte, chunkSize+s.aead.Overhead())
+	chunk := make([]byte, 0, chunkSize)
+	defer wipeBytes(chunk[:cap(chunk)])
+
+	for index := uint64(0); ; index++ {
+		n, err := io.ReadFull(r, sealed)
+		if err == io.EOF {
+			return fmt.Errorf("Encrypted file is truncated")
+		}
+		last := err == io.ErrUnexpectedEOF
+		if err != nil && !last {
+			return err
+		}
+		if !last {
+			if _, err := r.Peek(1); err == io.EOF {
+				last = true
+			}
+		}
+
+		chunk, err = s.aead.Open(chunk[:0], s.chunkNonce(index, last), sealed[:n], s.header)
+		if err != nil {
+			return fmt.Errorf("Failed to decrypt chunk #%d (the file may be corrupted or truncated)", index)
+		}
+		if _, err := w.Write(chunk); err != nil {
+			return err
+		}
+		if last {
+			return nil
+		}
+	}
+}
+
+// lineWriter wraps the text written to it into lines of the given length.
+type lineWriter struct {
+	w      io.Writer
+	length int
+	column int
+}
+
+func (l *lineWriter) Write(data []byte) (int, error) {
+	written := 0
+	for len(data) > 0 {
+		n := l.length - l.column
+		if n > len(data) {
+			n = len(data)
+		}
+		if _, err := l.w.Write(data[:n]); err != nil {
+			return written, err
+		}
+		written += n
+		l.column += n
+		data = data[n:]
+
+		if l.column == l.length {
+			if _, err := l.w.Write([]byte("\n")); err != nil {
+				return written, err
+			}
+			l.column = 0
+		}
+	}
+	return written, nil
+}
+
+// Close ends the last line.
+func (l *lineWriter) Close() error {
+	if l.column == 0 {
+		return nil
+	}
+	_, err := l.w.Write([]byte("\n"))
+	return err
+}
@@ -0,0 +1,102 @@
+package encrypt
+
+import (
+	"bytes"
+	"crypto/rand"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestStream(t *testing.T) {
+	cipher, err := NewSymmetricCipherWithOptions([]byte("testing"), SymmetricCipherOptions{
+		KDF: KDFParams{Time: 1, Memory: 64, Threads: 1},
+	})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	for _, size := range []int{0, 1, 15, 16, 17, 48, 100} {
+		for _, base64 := range []bool{false, true} {
+			plainText := make([]byte, size)
+			if _, err := rand.Read(plainText); err != nil {
+				t.Error(err)
+				return
+			}
+
+			var encrypted bytes.Buffer
+			err := EncryptStream(cipher, bytes.NewReader(plainText), &encrypted, StreamOptions{
+				ChunkSize: 16,
+				Base64:    base64,
+			})
+			if err != nil {
+				t.Error(err)
+				return
+			}
+
+			var decrypted bytes.Buffer
+			if err := DecryptStream(cipher, bytes.NewReader(encrypted.Bytes()), &decrypted); err != nil {
+				t.Error(fmt.Errorf("Failed to decrypt %d bytes (base64: %t): %s", size, base64, err))
+				return
+			}
+			if !bytes.Equal(decrypted.Bytes(), plainText) {
+				t.Error(fmt.Errorf("Decrypted %d bytes (base64: %t) incorrectly", size, base64))
+				return
+			}
+		}
+	}
+}
+
+func TestStreamTampering(t *testing.T) {
+	cipher, err := NewSymmetricCipherWithOptions([]byte("testing"), SymmetricCipherOptions{
+		KDF: KDFParams{Time: 1, Memory: 64, Threads: 1},
+	})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	var encrypted bytes.Buffer
+	if err := EncryptStream(cipher, strings.NewReader(strings.Repeat("x", 48)), &encrypted, StreamOptions{ChunkSize: 16}); err != nil {
+		t.Error(err)
+		return
+	}
+	data := encrypted.Bytes()
+	body := bytes.IndexByte(data, '\n') + 1
+	chunk := 16 + 16
+
+	for name, tampered := range map[string][]byte{
+		"truncated at a chunk": data[:body+2*chunk],
+		"truncated in a chunk": data[:body+2*chunk+5],
+		"missing every chunk":  data[:body],
+		"reordered chunks":     append(append(append(append([]byte{}, data[:body]...), data[body+chunk:body+2*chunk]...), data[body:body+chunk]...), data[body+2*chunk:]...),
+		"extra data":           append(append([]byte{}, data...), 'x'),
+		"modified header":      bytes.Replace(data, []byte("chunk=16"), []byte("chunk=17"), 1),
+		"modified chunk":       append(append(append([]byte{}, data[:body+3]...), data[body+3]^1), data[body+4:]...),
+	} {
+		if err := DecryptStream(cipher, bytes.NewReader(tampered), &bytes.Buffer{}); err == nil {
+			t.Error(fmt.Errorf("Expected a stream with %s to fail to decrypt", name))
+			return
+		}
+	}
+}
+
+func TestStreamLegacyFile(t *testing.T) {
+	cipher := NewSymmetricCipher([]byte("testing"))
+	encrypted, err := cipher.Encrypt("whole file")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	var decrypted bytes.Buffer
+	if err := DecryptStream(cipher, strings.NewReader(encrypted), &decrypted); err != nil {
+		t.Error(err)
+		return
+	}
+	if decrypted.String() != "whole file" {
+		t.Error(fmt.Errorf("Unexpected output: %s", decrypted.String()))
+		return
+	}
+}
@@ -0,0 +1,258 @@
+package encrypt
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/karimsa/secrets/internal/ciphers"
+)
+
+const defaultVaultMount = "transit"
+
+// SimpleVaultCipher encrypts values using the transit secrets engine of
+// HashiCorp Vault. Values are stored as the ciphertexts returned by Vault
+// (i.e. "vault:v1:..."), and every value in a file is sent to Vault in a single
+// batch request.
+type SimpleVaultCipher struct {
+	client    *http.Client
+	address   string
+	token     string
+	namespace string
+	mount     string
+	key       string
+	context   bool
+}
+
+type VaultCipherOptions struct {
+	// Address of the Vault server (defaults to VAULT_ADDR)
+	Address string
+
+	// Token used to authenticate with Vault (defaults to VAULT_TOKEN, or the
+	// token stored by `vault login` in ~/.vault-token)
+	Token string
+
+	// Namespace of the transit engine (defaults to VAULT_NAMESPACE)
+	Namespace string
+
+	// Mount is the path that the transit engine is mounted at (defaults to
+	// "transit")
+	Mount string
+
+	// Key is the name of the transit key to encrypt values with
+	Key string
+
+	// Context binds values to their path, by sending it as the context of
+	// each value. This requires the transit key to be created with
+	// derived=true. Without it, values are not bound to their path.
+	Context bool
+
+	// Client is used to send requests to Vault (defaults to a client with a
+	// 30s timeout)
+	Client *http.Client
+}
+
+type vaultBatchItem struct {
+	Plaintext  string `json:"plaintext,omitempty"`
+	Ciphertext string `json:"ciphertext,omitempty"`
+	Context    string `json:"context,omitempty"`
+	Error      string `json:"error,omitempty"`
+}
+
+type vaultRequest struct {
+	BatchInput []vaultBatchItem `json:"batch_input"`
+}
+
+type vaultResponse struct {
+	Errors []string `json:"errors"`
+	Data   struct {
+		BatchResults []vaultBatchItem `json:"batch_results"`
+	} `json:"data"`
+}
+
+func NewVaultCipher(options VaultCipherOptions) (SimpleVaultCipher, error) {
+	if options.Address == "" {
+		options.Address = os.Getenv("VAULT_ADDR")
+	}
+	if options.Address == "" {
+		return SimpleVaultCipher{}, fmt.Errorf("A Vault address is required (set VAULT_ADDR)")
+	}
+	if _, err := url.Parse(options.Address); err != nil {
+		return SimpleVaultCipher{}, fmt.Errorf("Invalid Vault address: %s", err)
+	}
+
+	if options.Token == "" {
+		options.Token = os.Getenv("VAULT_TOKEN")
+	}
+	if options.Token == "" {
+		if home, err := os.UserHomeDir(); err == nil {
+			if token, err := ioutil.ReadFile(filepath.Join(home, ".vault-token")); err == nil {
+				options.Token = strings.TrimSpace(string(token))
+			}
+		}
+	}
+	if options.Token == "" {
+		return SimpleVaultCipher{}, fmt.Errorf("A Vault token is required (set VAULT_TOKEN, or run `vault login`)")
+	}
+
+	if options.Namespace == "" {
+		options.Namespace = os.Getenv("VAULT_NAMESPACE")
+	}
+	if options.Mount == "" {
+		options.Mount = defaultVaultMount
+	}
+	if options.Key == "" {
+		return SimpleVaultCipher{}, fmt.Errorf("A transit key name is required")
+	}
+	if options.Client == nil {
+		options.Client = &http.Client{Timeout: 30 * time.Second}
+	}
+
+	return SimpleVaultCipher{
+		client:    options.Client,
+		address:   strings.TrimSuffix(options.Address, "/"),
+		token:     options.Token,
+		namespace: options.Namespace,
+		mount:     strings.Trim(options.Mount, "/"),
+		key:       options.Key,
+		context:   options.Context,
+	}, nil
+}
+
+// call sends a batch of items to the given transit endpoint (i.e. encrypt or
+// decrypt), and returns the results in the same order.
+func (s SimpleVaultCipher) call(endpoint string, items []vaultBatchItem) ([]vaultBatchItem, error) {
+	body, err := json.Marshal(vaultRequest{BatchInput: items})
+	if err != nil {
+		return nil, err
+	}
+
+	requestURL := fmt.Sprintf("%s/v1/%s/%s/%s", s.address, s.mount, endpoint, url.PathEscape(s.key))
+	req, err := http.NewRequest(http.MethodPost, requestURL, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Vault-Token", s.token)
+	if s.namespace != "" {
+		req.Header.Set("X-Vault-Namespace", s.namespace)
+	}
+
+	res, err := s.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to reach Vault: %s", err)
+	}
+	defer res.Body.Close()
+
+	var response vaultResponse
+	if err := json.NewDecoder(res.Body).Decode(&response); err != nil {
+		return nil, fmt.Errorf("Unexpected response from Vault (%s): %s", res.Status, err)
+	}
+
+	// Vault responds with an error status if any item in the batch fails, but
+	// still includes the results of every item
+	results := response.Data.BatchResults
+	if len(results) == 0 {
+		if len(response.Errors) > 0 {
+			return nil, fmt.Errorf("Vault failed to %s values: %s", endpoint, strings.Join(response.Errors, ", "))
+		}
+		return nil, fmt.Errorf("Unexpected response from Vault (%s)", res.Status)
+	}
+	if len(results) != len(items) {
+		return nil, fmt.Errorf("Vault returned %d results for %d values", len(results), len(items))
+	}
+	var errs []*ciphers.BatchError
+	for i, result := range results {
+		if result.Error != "" {
+			errs = append(errs, &ciphers.BatchError{Index: i, Err: fmt.Errorf("%s", result.Error)})
+		}
+	}
+	if err := ciphers.JoinBatchErrors(errs); err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+func (s SimpleVaultCipher) contextOf(associatedData []byte) string {
+	if !s.context || len(associatedData) == 0 {
+		return ""
+	}
+	return base64.StdEncoding.EncodeToString(associatedData)
+}
+
+func (s SimpleVaultCipher) Encrypt(str string) (string, error) {
+	return s.EncryptWithData(str, nil)
+}
+
+func (s SimpleVaultCipher) EncryptWithData(str string, associatedData []byte) (string, error) {
+	return unbatch(s.EncryptBatch([]ciphers.BatchValue{
+		{Value: str, AssociatedData: associatedData},
+	}))
+}
+
+func (s SimpleVaultCipher) EncryptBatch(values []ciphers.BatchValue) ([]string, error) {
+	items := make([]vaultBatchItem, len(values))
+	for i, value := range values {
+		items[i] = vaultBatchItem{
+			Plaintext: base64.StdEncoding.EncodeToString([]byte(value.Value)),
+			Context:   s.contextOf(value.AssociatedData),
+		}
+	}
+
+	results, err := s.call("encrypt", items)
+	if err != nil {
+		return nil, err
+	}
+
+	ciphertexts := make([]string, len(results))
+	for i, result := range results {
+		ciphertexts[i] = result.Ciphertext
+	}
+	return ciphertexts, nil
+}
+
+func (s SimpleVaultCipher) Decrypt(encrypted string) (string, error) {
+	return s.DecryptWithData(encrypted, nil)
+}
+
+func (s SimpleVaultCipher) DecryptWithData(encrypted string, associatedData []byte) (string, error) {
+	return unbatch(s.DecryptBatch([]ciphers.BatchValue{
+		{Value: encrypted, AssociatedData: associatedData},
+	}))
+}
+
+func (s SimpleVaultCipher) DecryptBatch(values []ciphers.BatchValue) ([]string, error) {
+	items := make([]vaultBatchItem, len(values))
+	for i, value := range values {
+		if !strings.HasPrefix(value.Value, "vault:") {
+			return nil, &ciphers.BatchError{Index: i, Err: fmt.Errorf("Value is not a Vault ciphertext")}
+		}
+		items[i] = vaultBatchItem{
+			Ciphertext: value.Value,
+			Context:    s.contextOf(value.AssociatedData),
+		}
+	}
+
+	results, err := s.call("decrypt", items)
+	if err != nil {
+		return nil, err
+	}
+
+	plainTexts := make([]string, len(results))
+	for i, result := range results {
+		plainText, err := base64.StdEncoding.DecodeString(result.Plaintext)
+		if err != nil {
+			return nil, &ciphers.BatchError{Index: i, Err: fmt.Errorf("Unexpected plaintext from Vault: %s", err)}
+		}
+		plainTexts[i] = string(plainText)
+	}
+	return plainTexts, nil
+}
@@ -0,0 +1,178 @@
+package encrypt
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/karimsa/secrets"
+)
+
+// newTestVault starts a stand-in for the transit engine of Vault. Ciphertexts
+// are the base64 encoded context and plaintext, and every request is recorded.
+func newTestVault(t *testing.T) (*httptest.Server, *[]string) {
+	requests := []string{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, r.URL.Path)
+		encoder := json.NewEncoder(w)
+
+		if r.Header.Get("X-Vault-Token") != "test-token" {
+			w.WriteHeader(http.StatusForbidden)
+			encoder.Encode(map[string][]string{"errors": {"permission denied"}})
+			return
+		}
+
+		var request vaultRequest
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		var response vaultResponse
+		failed := false
+		for _, item := range request.BatchInput {
+			var result vaultBatchItem
+			switch r.URL.Path {
+			case "/v1/transit/encrypt/app":
+				result.Ciphertext = "vault:v1:" + item.Context + ":" + item.Plaintext
+			case "/v1/transit/decrypt/app":
+				parts := strings.Split(strings.TrimPrefix(item.Ciphertext, "vault:v1:"), ":")
+				if len(parts) != 2 || parts[0] != item.Context {
+					result.Error = "cipher: message authentication failed"
+					failed = true
+				} else {
+					result.Plaintext = parts[1]
+				}
+			default:
+				w.WriteHeader(http.StatusNotFound)
+				encoder.Encode(map[string][]string{"errors": {"no handler for route"}})
+				return
+			}
+			response.Data.BatchResults = append(response.Data.BatchResults, result)
+		}
+
+		if failed {
+			w.WriteHeader(http.StatusBadRequest)
+		}
+		encoder.Encode(response)
+	}))
+	t.Cleanup(server.Close)
+	return server, &requests
+}
+
+func TestVaultEncrypt(t *testing.T) {
+	server, requests := newTestVault(t)
+	t.Setenv("VAULT_ADDR", server.URL)
+	t.Setenv("VAULT_TOKEN", "test-token")
+
+	cipher, err := NewVaultCipher(VaultCipherOptions{
+		Key:     "app",
+		Context: true,
+	})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	env, err := secrets.New(secrets.NewEnvOptions{
+		Format:      "dotenv",
+		Reader:      strings.NewReader("A=first\nB=second\nC=third\n"),
+		Cipher:      cipher,
+		SecurePaths: []string{".A", ".B", ".C"},
+	})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	data, err := env.Export("dotenv")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if strings.Count(string(data), "=vault:v1:") != 3 {
+		t.Error(fmt.Errorf("Expected Vault ciphertexts to be stored in place:\n%s", data))
+		return
+	}
+
+	env, err = secrets.Open(secrets.OpenEnvOptions{
+		Format:      "dotenv",
+		Reader:      strings.NewReader(string(data)),
+		Cipher:      cipher,
+		SecurePaths: []string{".A", ".B", ".C"},
+	})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	raw, err := env.UnsafeRawExport("dotenv")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if string(raw) != "A=first\nB=second\nC=third\n" {
+		t.Error(fmt.Errorf("Unexpected output:\n%s", raw))
+		return
+	}
+
+	if len(*requests) != 2 || (*requests)[0] != "/v1/transit/encrypt/app" || (*requests)[1] != "/v1/transit/decrypt/app" {
+		t.Error(fmt.Errorf("Expected a single batch request per file: %v", *requests))
+		return
+	}
+
+	// Values are bound to their path through the context
+	lines := strings.Split(string(data), "\n")
+	swapped := "A=" + lines[1][2:] + "\nB=" + lines[0][2:] + "\nC=" + lines[2][2:] + "\n"
+	_, err = secrets.Open(secrets.OpenEnvOptions{
+		Format:      "dotenv",
+		Reader:      strings.NewReader(swapped),
+		Cipher:      cipher,
+		SecurePaths: []string{".A", ".B", ".C"},
+	})
+	if err == nil || !strings.Contains(err.Error(), "message authentication failed") {
+		t.Error(fmt.Errorf("Swapped values should fail to decrypt: %v", err))
+		return
+	}
+}
+
+func TestVaultErrors(t *testing.T) {
+	server, _ := newTestVault(t)
+
+	cipher, err := NewVaultCipher(VaultCipherOptions{
+		Address: server.URL,
+		Token:   "bad-token",
+		Key:     "app",
+	})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if _, err := cipher.Encrypt("some test text"); err == nil || !strings.Contains(err.Error(), "permission denied") {
+		t.Error(fmt.Errorf("Expected Vault's error to be reported: %v", err))
+		return
+	}
+
+	cipher, err = NewVaultCipher(VaultCipherOptions{
+		Address: server.URL,
+		Token:   "test-token",
+		Key:     "app",
+	})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if _, err := cipher.Decrypt(base64.StdEncoding.EncodeToString([]byte("not vault"))); err == nil {
+		t.Error(fmt.Errorf("Values that are not Vault ciphertexts should be rejected"))
+		return
+	}
+
+	t.Setenv("VAULT_ADDR", "")
+	t.Setenv("HOME", t.TempDir())
+	if _, err := NewVaultCipher(VaultCipherOptions{Key: "app"}); err == nil {
+		t.Error(fmt.Errorf("A Vault address should be required"))
+		return
+	}
+}
@@ -8,9 +8,11 @@ import (
 	"io"
 	"io/ioutil"
 	"regexp"
+	"sort"
 	"strings"
 
 	orderedJson "github.com/iancoleman/orderedmap"
+	pathReader "github.com/karimsa/secrets/internal/path"
 )
 
 type OrderedMap struct {
@@ -52,7 +54,14 @@ func (om OrderedMap) Export(format string) ([]byte, error) {
 	case "dotenv":
 		output := ""
 		for _, key := range om.KeyOrder["."] {
-			output += fmt.Sprintf("%s=%s\n", key, om.Values[key].(string))
+			value := om.Values[key].(string)
+
+			// The parser is line-based, so a multi-line value would be
+			// cut off when the file is read back
+			if strings.ContainsRune(value, '\n') {
+				return nil, fmt.Errorf("Value of %s spans multiple lines, which is not supported by dotenv files", key)
+			}
+			output += fmt.Sprintf("%s=%s\n", key, value)
 		}
 		return []byte(output), nil
 
@@ -83,6 +92,59 @@ func pathJoin(path, key string) string {
 	return keyPath
 }
 
+// keysAt returns the keys of the map at the given path in their original
+// order, or in sorted order if the map has no key order.
+func (om OrderedMap) keysAt(currentPath string, currentMap map[string]interface{}) []string {
+	keys, keysExist := om.KeyOrder[currentPath]
+	if keysExist && len(keys) == len(currentMap) {
+		return keys
+	}
+
+	keys = make([]string, 0, len(currentMap))
+	for key := range currentMap {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Entry is a single value in an OrderedMap. Empty maps and lists are entries
+// of their own, so that the entries describe the whole structure of the map.
+type Entry struct {
+	Path  pathReader.Path
+	Value interface{}
+}
+
+// Entries returns every value in the map, in the order they are exported.
+func (om OrderedMap) Entries() []Entry {
+	var entries []Entry
+	om.appendEntries(&entries, ".", pathReader.Path{}, om.Values)
+	return entries
+}
+
+func (om OrderedMap) appendEntries(entries *[]Entry, currentPath string, path pathReader.Path, val interface{}) {
+	switch v := val.(type) {
+	case map[string]interface{}:
+		if len(v) == 0 {
+			*entries = append(*entries, Entry{Path: path, Value: v})
+		}
+		for _, key := range om.keysAt(currentPath, v) {
+			om.appendEntries(entries, pathJoin(currentPath, key), path.AppendKey(key), v[key])
+		}
+
+	case []interface{}:
+		if len(v) == 0 {
+			*entries = append(*entries, Entry{Path: path, Value: v})
+		}
+		for i, elm := range v {
+			om.appendEntries(entries, fmt.Sprintf("%s[%d]", currentPath, i), path.AppendIndex(i), elm)
+		}
+
+	default:
+		*entries = append(*entries, Entry{Path: path, Value: v})
+	}
+}
+
 func (om OrderedMap) toJSONItem(val interface{}, currentPath string) interface{} {
 	switch v := val.(type) {
 	case []interface{}:
@@ -97,10 +159,10 @@ func (om OrderedMap) toJSONItem(val interface{}, currentPath string) interface{}
 
 	case map[string]interface{}:
 		outJson := orderedJson.New()
-		for key, elm := range v {
+		for _, key := range om.keysAt(currentPath, v) {
 			outJson.Set(key, om.toJSONItem(
-				elm,
-				fmt.Sprintf("%s.%s", currentPath, key),
+				v[key],
+				pathJoin(currentPath, key),
 			))
 		}
 		return outJson
@@ -124,7 +186,7 @@ func (om OrderedMap) toJSON(currentPath string, currentMap map[string]interface{
 	for _, key := range keys {
 		outJson.Set(key, om.toJSONItem(
 			currentMap[key],
-			fmt.Sprintf("%s.%s", currentPath, key),
+			pathJoin(currentPath, key),
 		))
 	}
 
@@ -109,3 +109,79 @@ func TestParseDotenv(t *testing.T) {
 		return
 	}
 }
+
+func TestExportMultilineDotenv(t *testing.T) {
+	doc, err := Parse("yaml", strings.NewReader("hello: |\n  multi\n  line\n"))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	buff, err := doc.Export("yaml")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if parsed, err := Parse("yaml", bytes.NewReader(buff)); err != nil || parsed.Values["hello"] != "multi\nline\n" {
+		t.Error(fmt.Errorf("Failed to round trip a multi-line value (%v):\n%s", err, buff))
+		return
+	}
+
+	// Dotenv files cannot hold the same value, so exporting it fails rather
+	// than writing a file that cannot be read back
+	if buff, err := doc.Export("dotenv"); err == nil {
+		t.Error(fmt.Errorf("Expected a multi-line value to be rejected:\n%s", buff))
+		return
+	}
+}
+
+func TestEntries(t *testing.T) {
+	configStr := strings.Join([]string{
+		"kind: List",
+		"spec:",
+		"- data:",
+		"    TEST: stuff",
+		"    HELLO: world",
+		"  kind: ConfigMap",
+		"empty: []",
+		"",
+	}, "\n")
+	doc, err := Parse("yaml", strings.NewReader(configStr))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	var entries []string
+	for _, entry := range doc.Entries() {
+		entries = append(entries, fmt.Sprintf("%s=%v", entry.Path, entry.Value))
+	}
+	expected := "['kind']=List,['spec'][0]['data']['TEST']=stuff,['spec'][0]['data']['HELLO']=world,['spec'][0]['kind']=ConfigMap,['empty']=[]"
+	if strings.Join(entries, ",") != expected {
+		t.Error(fmt.Errorf("Unexpected entries: %s", strings.Join(entries, ",")))
+		return
+	}
+}
+
+func TestExportNestedJSON(t *testing.T) {
+	doc, err := Parse("json", strings.NewReader(`{"b":{"z":1,"y":2,"x":{"c":3,"a":4}},"a":5}`))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	// Nested maps keep their order, so that exports are stable
+	buff, err := doc.Export("json")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	var compact bytes.Buffer
+	if err := json.Compact(&compact, buff); err != nil {
+		t.Error(err)
+		return
+	}
+	if compact.String() != `{"b":{"z":1,"y":2,"x":{"c":3,"a":4}},"a":5}` {
+		t.Error(fmt.Errorf("Failed to preserve nested key order:\n%s", buff))
+		return
+	}
+}
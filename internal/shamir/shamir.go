@@ -0,0 +1,147 @@
+package shamir
+
+import (
+	"crypto/rand"
+	"fmt"
+)
+
+// The arithmetic below is done in GF(2^8), using the same reducing polynomial
+// as AES (x^8 + x^4 + x^3 + x + 1). Multiplication and division use log/exp
+// tables built from the generator 3.
+var (
+	expTable [255]byte
+	logTable [256]byte
+)
+
+func init() {
+	x := byte(1)
+	for i := 0; i < 255; i++ {
+		expTable[i] = x
+		logTable[x] = byte(i)
+
+		// x *= 3
+		high := x & 0x80
+		x2 := x << 1
+		if high != 0 {
+			x2 ^= 0x1b
+		}
+		x ^= x2
+	}
+}
+
+func add(a, b byte) byte {
+	return a ^ b
+}
+
+func mul(a, b byte) byte {
+	if a == 0 || b == 0 {
+		return 0
+	}
+	return expTable[(int(logTable[a])+int(logTable[b]))%255]
+}
+
+func div(a, b byte) byte {
+	if b == 0 {
+		panic("shamir: division by zero")
+	}
+	if a == 0 {
+		return 0
+	}
+	return expTable[(int(logTable[a])-int(logTable[b])+255)%255]
+}
+
+// evaluate computes the polynomial with the given coefficients at x, where
+// coefficients[0] is the constant term.
+func evaluate(coefficients []byte, x byte) byte {
+	result := byte(0)
+	for i := len(coefficients) - 1; i >= 0; i-- {
+		result = add(mul(result, x), coefficients[i])
+	}
+	return result
+}
+
+// Split divides a secret into the given number of parts, any threshold of
+// which can be combined to recover it. Fewer parts reveal nothing about the
+// secret. Each part is one byte longer than the secret, since its last byte is
+// the x coordinate of the part.
+func Split(secret []byte, parts, threshold int) ([][]byte, error) {
+	if len(secret) == 0 {
+		return nil, fmt.Errorf("Cannot split an empty secret")
+	}
+	if threshold < 2 {
+		return nil, fmt.Errorf("Threshold must be at least 2")
+	}
+	if parts < threshold {
+		return nil, fmt.Errorf("Number of shares (%d) cannot be less than the threshold (%d)", parts, threshold)
+	}
+	if parts > 255 {
+		return nil, fmt.Errorf("Number of shares cannot be more than 255")
+	}
+
+	output := make([][]byte, parts)
+	for i := range output {
+		output[i] = make([]byte, len(secret)+1)
+		output[i][len(secret)] = byte(i + 1)
+	}
+
+	coefficients := make([]byte, threshold)
+	for i, b := range secret {
+		coefficients[0] = b
+		if _, err := rand.Read(coefficients[1:]); err != nil {
+			return nil, err
+		}
+
+		for _, part := range output {
+			part[i] = evaluate(coefficients, part[len(secret)])
+		}
+	}
+	return output, nil
+}
+
+// Combine recovers a secret from parts created by Split. At least threshold
+// parts must be given, otherwise the result is meaningless (there is no way to
+// tell without some other check of the secret).
+func Combine(parts [][]byte) ([]byte, error) {
+	if len(parts) < 2 {
+		return nil, fmt.Errorf("At least 2 shares are required")
+	}
+
+	length := len(parts[0])
+	if length < 2 {
+		return nil, fmt.Errorf("Shares are too short")
+	}
+
+	xs := make([]byte, len(parts))
+	seen := map[byte]bool{}
+	for i, part := range parts {
+		if len(part) != length {
+			return nil, fmt.Errorf("All shares must be the same length")
+		}
+
+		xs[i] = part[length-1]
+		if xs[i] == 0 {
+			return nil, fmt.Errorf("Invalid share #%d", i+1)
+		}
+		if seen[xs[i]] {
+			return nil, fmt.Errorf("Duplicate share #%d", i+1)
+		}
+		seen[xs[i]] = true
+	}
+
+	// Lagrange interpolation at x = 0
+	secret := make([]byte, length-1)
+	for i := range secret {
+		value := byte(0)
+		for j, part := range parts {
+			basis := byte(1)
+			for k := range parts {
+				if k != j {
+					basis = mul(basis, div(xs[k], add(xs[k], xs[j])))
+				}
+			}
+			value = add(value, mul(part[i], basis))
+		}
+		secret[i] = value
+	}
+	return secret, nil
+}
@@ -0,0 +1,89 @@
+package shamir
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+)
+
+func TestFieldArithmetic(t *testing.T) {
+	for a := 1; a < 256; a++ {
+		for b := 1; b < 256; b++ {
+			product := mul(byte(a), byte(b))
+			if div(product, byte(b)) != byte(a) {
+				t.Error(fmt.Errorf("(%d * %d) / %d != %d", a, b, b, a))
+				return
+			}
+		}
+	}
+
+	// 0x57 * 0x83 = 0xc1 is the example from the AES specification
+	if mul(0x57, 0x83) != 0xc1 {
+		t.Error(fmt.Errorf("Unexpected product: %x", mul(0x57, 0x83)))
+		return
+	}
+}
+
+func TestSplitCombine(t *testing.T) {
+	secret := []byte("some test secret")
+	parts, err := Split(secret, 5, 3)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if len(parts) != 5 {
+		t.Error(fmt.Errorf("Expected 5 parts, but got %d", len(parts)))
+		return
+	}
+
+	// Every combination of 3 or more parts should recover the secret
+	for i := 0; i < 5; i++ {
+		for j := i + 1; j < 5; j++ {
+			for k := j + 1; k < 5; k++ {
+				combined, err := Combine([][]byte{parts[k], parts[i], parts[j]})
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				if !bytes.Equal(combined, secret) {
+					t.Error(fmt.Errorf("Parts %d, %d, %d recovered: %q", i, j, k, combined))
+					return
+				}
+			}
+		}
+	}
+	combined, err := Combine(parts)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if !bytes.Equal(combined, secret) {
+		t.Error(fmt.Errorf("All parts recovered: %q", combined))
+		return
+	}
+
+	// Fewer parts should not
+	combined, err = Combine(parts[:2])
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if bytes.Equal(combined, secret) {
+		t.Error(fmt.Errorf("2 parts should not recover the secret"))
+		return
+	}
+
+	if _, err := Combine([][]byte{parts[0], parts[0], parts[1]}); err == nil {
+		t.Error(fmt.Errorf("Duplicate parts should be rejected"))
+		return
+	}
+}
+
+func TestSplitParams(t *testing.T) {
+	for _, params := range [][2]int{{1, 1}, {2, 3}, {256, 3}} {
+		if _, err := Split([]byte("secret"), params[0], params[1]); err == nil {
+			t.Error(fmt.Errorf("Expected split with %d shares and threshold %d to fail", params[0], params[1]))
+			return
+		}
+	}
+}
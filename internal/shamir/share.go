@@ -0,0 +1,119 @@
+package shamir
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const (
+	sharePrefix = "secrets-share:v1"
+	keyIDLength = 4
+)
+
+// Share is a single part of a key that was split by SplitKey. Along with the
+// part itself, each share records the threshold needed to recover the key,
+// and a short identifier of the key so that shares of different keys are not
+// combined by mistake.
+//
+// Shares are encoded as text:
+//
+//	secrets-share:v1:k=<threshold>:id=<key id>:<part>
+type Share struct {
+	Threshold int
+	KeyID     []byte
+	Part      []byte
+}
+
+func keyID(key []byte) []byte {
+	sum := sha256.Sum256(key)
+	return sum[:keyIDLength]
+}
+
+// SplitKey splits a key into the given number of shares, any threshold of
+// which can recover it.
+func SplitKey(key []byte, shares, threshold int) ([]Share, error) {
+	parts, err := Split(key, shares, threshold)
+	if err != nil {
+		return nil, err
+	}
+
+	id := keyID(key)
+	output := make([]Share, len(parts))
+	for i, part := range parts {
+		output[i] = Share{
+			Threshold: threshold,
+			KeyID:     id,
+			Part:      part,
+		}
+	}
+	return output, nil
+}
+
+// CombineKey recovers a key from its shares. Unlike Combine, it verifies that
+// enough shares were given, and that they recover the original key.
+func CombineKey(shares []Share) ([]byte, error) {
+	if len(shares) == 0 {
+		return nil, fmt.Errorf("No shares were given")
+	}
+
+	parts := make([][]byte, len(shares))
+	for i, share := range shares {
+		if share.Threshold != shares[0].Threshold || !bytes.Equal(share.KeyID, shares[0].KeyID) {
+			return nil, fmt.Errorf("Share #%d belongs to a different key", i+1)
+		}
+		parts[i] = share.Part
+	}
+	if len(shares) < shares[0].Threshold {
+		return nil, fmt.Errorf("%d shares are required to recover the key (got %d)", shares[0].Threshold, len(shares))
+	}
+
+	key, err := Combine(parts)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(keyID(key), shares[0].KeyID) {
+		return nil, fmt.Errorf("Shares did not recover the key (one of them may be corrupted)")
+	}
+	return key, nil
+}
+
+func (s Share) String() string {
+	return fmt.Sprintf("%s:k=%d:id=%s:%s", sharePrefix, s.Threshold, hex.EncodeToString(s.KeyID), hex.EncodeToString(s.Part))
+}
+
+// ParseShare parses a share that was encoded by Share.String. Surrounding
+// whitespace is ignored.
+func ParseShare(str string) (Share, error) {
+	str = strings.TrimSpace(str)
+	if !strings.HasPrefix(str, sharePrefix+":") {
+		return Share{}, fmt.Errorf("Not a valid share (expected it to start with %s)", sharePrefix)
+	}
+
+	fields := strings.Split(str[len(sharePrefix)+1:], ":")
+	if len(fields) != 3 || !strings.HasPrefix(fields[0], "k=") || !strings.HasPrefix(fields[1], "id=") {
+		return Share{}, fmt.Errorf("Not a valid share")
+	}
+
+	threshold, err := strconv.Atoi(fields[0][2:])
+	if err != nil || threshold < 2 || threshold > 255 {
+		return Share{}, fmt.Errorf("Invalid threshold in share: %s", fields[0][2:])
+	}
+	id, err := hex.DecodeString(fields[1][3:])
+	if err != nil || len(id) != keyIDLength {
+		return Share{}, fmt.Errorf("Invalid key id in share: %s", fields[1][3:])
+	}
+	part, err := hex.DecodeString(fields[2])
+	if err != nil || len(part) < 2 {
+		return Share{}, fmt.Errorf("Invalid data in share")
+	}
+
+	return Share{
+		Threshold: threshold,
+		KeyID:     id,
+		Part:      part,
+	}, nil
+}
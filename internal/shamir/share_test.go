@@ -0,0 +1,93 @@
+package shamir
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestShareEncoding(t *testing.T) {
+	key := []byte("0123456789abcdef0123456789abcdef")
+	shares, err := SplitKey(key, 3, 2)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	encoded := shares[2].String()
+	if !strings.HasPrefix(encoded, "secrets-share:v1:k=2:id=") {
+		t.Error(fmt.Errorf("Unexpected share: %s", encoded))
+		return
+	}
+
+	parsed, err := ParseShare(encoded + "\n")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	combined, err := CombineKey([]Share{shares[0], parsed})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if !bytes.Equal(combined, key) {
+		t.Error(fmt.Errorf("Unexpected key: %q", combined))
+		return
+	}
+
+	for _, invalid := range []string{
+		"",
+		"hello world",
+		"secrets-share:v1:k=1:id=00000000:0101",
+		"secrets-share:v1:k=2:id=00:0101",
+		"secrets-share:v1:k=2:id=00000000:zz",
+	} {
+		if _, err := ParseShare(invalid); err == nil {
+			t.Error(fmt.Errorf("Expected share to be invalid: %q", invalid))
+			return
+		}
+	}
+}
+
+func TestCombineKey(t *testing.T) {
+	key := []byte("0123456789abcdef0123456789abcdef")
+	shares, err := SplitKey(key, 5, 3)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if _, err := CombineKey(shares[:2]); err == nil || !strings.Contains(err.Error(), "3 shares are required") {
+		t.Error(fmt.Errorf("Expected too few shares to be reported: %v", err))
+		return
+	}
+
+	otherShares, err := SplitKey([]byte("another key of the same length!!"), 5, 3)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if _, err := CombineKey([]Share{shares[0], shares[1], otherShares[2]}); err == nil {
+		t.Error(fmt.Errorf("Shares of different keys should not be combined"))
+		return
+	}
+
+	corrupted := shares[2]
+	corrupted.Part = append([]byte{}, corrupted.Part...)
+	corrupted.Part[0] ^= 1
+	if _, err := CombineKey([]Share{shares[0], shares[1], corrupted}); err == nil {
+		t.Error(fmt.Errorf("Corrupted shares should be detected"))
+		return
+	}
+
+	combined, err := CombineKey([]Share{shares[4], shares[1], shares[3]})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if !bytes.Equal(combined, key) {
+		t.Error(fmt.Errorf("Unexpected key: %q", combined))
+		return
+	}
+}
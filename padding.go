@@ -0,0 +1,102 @@
+package secrets
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/karimsa/secrets/internal/ciphers"
+)
+
+// PaddingCipher is implemented by ciphers that can pad values before they are
+// encrypted, so that the length of an encrypted value does not reveal the
+// length of the value. Padding is recorded in the encrypted value, and removed
+// when it is decrypted.
+type PaddingCipher = ciphers.PaddingCipher
+
+// PaddingPolicy decides the length that values are padded to before they are
+// encrypted. The zero policy does not pad values.
+type PaddingPolicy struct {
+	// Buckets pads each value up to the smallest bucket that it fits in.
+	// Values that are longer than the largest bucket are padded up to a
+	// multiple of it.
+	Buckets []int
+
+	// MaxLength pads every value to the same length, and values that are
+	// longer cannot be encrypted
+	MaxLength int
+}
+
+// ParsePaddingPolicy parses a policy of the form "buckets:16,64,256",
+// "max:256", or "none".
+func ParsePaddingPolicy(str string) (PaddingPolicy, error) {
+	kind, args := str, ""
+	if i := strings.Index(str, ":"); i != -1 {
+		kind, args = str[:i], str[i+1:]
+	}
+
+	switch kind {
+	case "none":
+		if args != "" {
+			break
+		}
+		return PaddingPolicy{}, nil
+
+	case "max":
+		length, err := strconv.Atoi(args)
+		if err != nil || length < 1 {
+			return PaddingPolicy{}, fmt.Errorf("Invalid padding length: %q", args)
+		}
+		return PaddingPolicy{MaxLength: length}, nil
+
+	case "buckets":
+		var policy PaddingPolicy
+		for _, arg := range strings.Split(args, ",") {
+			bucket, err := strconv.Atoi(strings.TrimSpace(arg))
+			if err != nil || bucket < 1 {
+				return PaddingPolicy{}, fmt.Errorf("Invalid padding bucket: %q", arg)
+			}
+			policy.Buckets = append(policy.Buckets, bucket)
+		}
+		sort.Ints(policy.Buckets)
+		return policy, nil
+	}
+	return PaddingPolicy{}, fmt.Errorf("Invalid padding policy: %q (expected buckets:<lengths>, max:<length> or none)", str)
+}
+
+func (p PaddingPolicy) String() string {
+	if p.MaxLength > 0 {
+		return fmt.Sprintf("max:%d", p.MaxLength)
+	}
+	if len(p.Buckets) > 0 {
+		buckets := make([]string, len(p.Buckets))
+		for i, bucket := range p.Buckets {
+			buckets[i] = strconv.Itoa(bucket)
+		}
+		return "buckets:" + strings.Join(buckets, ",")
+	}
+	return "none"
+}
+
+// PaddedLength returns the length that a value of the given length is padded
+// to, which is 0 if the value is not padded.
+func (p PaddingPolicy) PaddedLength(length int) (int, error) {
+	if p.MaxLength > 0 {
+		if length > p.MaxLength {
+			return 0, fmt.Errorf("Value is too long to be padded: %d bytes (must be at most %d)", length, p.MaxLength)
+		}
+		return p.MaxLength, nil
+	}
+
+	if len(p.Buckets) == 0 {
+		return 0, nil
+	}
+	for _, bucket := range p.Buckets {
+		if length <= bucket {
+			return bucket, nil
+		}
+	}
+	largest := p.Buckets[len(p.Buckets)-1]
+	return (length + largest - 1) / largest * largest, nil
+}
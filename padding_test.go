@@ -0,0 +1,210 @@
+package secrets
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// paddedCipher records the length that each value is padded to.
+type paddedCipher struct {
+	badCipher
+}
+
+func (paddedCipher) EncryptPadded(str string, data []byte, length int) (string, error) {
+	return fmt.Sprintf("encrypt(%s)#%d", str, length), nil
+}
+
+func (paddedCipher) PaddedLength(str string) (int, error) {
+	i := strings.LastIndex(str, "#")
+	if i == -1 {
+		return 0, nil
+	}
+	return strconv.Atoi(str[i+1:])
+}
+
+func (paddedCipher) Decrypt(str string) (string, error) {
+	if i := strings.LastIndex(str, "#"); i != -1 {
+		str = str[:i]
+	}
+	return badCipher{}.Decrypt(str)
+}
+
+func TestParsePaddingPolicy(t *testing.T) {
+	for str, expected := range map[string]string{
+		"none":               "none",
+		"max:64":             "max:64",
+		"buckets:256,16,64":  "buckets:16,64,256",
+		"buckets:32":         "buckets:32",
+		"buckets: 16, 64":    "buckets:16,64",
+		"max:0":              "",
+		"max:":               "",
+		"buckets:16,sixteen": "",
+		"none:16":            "",
+		"pad":                "",
+	} {
+		policy, err := ParsePaddingPolicy(str)
+		if expected == "" {
+			if err == nil {
+				t.Error(fmt.Errorf("Expected %q to be invalid, but got: %s", str, policy))
+				return
+			}
+			continue
+		}
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		if policy.String() != expected {
+			t.Error(fmt.Errorf("Expected %q to parse as %q, but got: %q", str, expected, policy))
+			return
+		}
+	}
+}
+
+func TestPaddedLength(t *testing.T) {
+	buckets := PaddingPolicy{Buckets: []int{16, 64}}
+	for length, expected := range map[int]int{
+		0:   16,
+		4:   16,
+		16:  16,
+		17:  64,
+		64:  64,
+		65:  128,
+		200: 256,
+	} {
+		padded, err := buckets.PaddedLength(length)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		if padded != expected {
+			t.Error(fmt.Errorf("Expected %d bytes to be padded to %d, but got: %d", length, expected, padded))
+			return
+		}
+	}
+
+	max := PaddingPolicy{MaxLength: 32}
+	if padded, err := max.PaddedLength(4); err != nil || padded != 32 {
+		t.Error(fmt.Errorf("Expected 4 bytes to be padded to 32, but got: %d (%v)", padded, err))
+		return
+	}
+	if _, err := max.PaddedLength(33); err == nil {
+		t.Error(fmt.Errorf("Values longer than the max length should not be padded"))
+		return
+	}
+
+	if padded, err := (PaddingPolicy{}).PaddedLength(100); err != nil || padded != 0 {
+		t.Error(fmt.Errorf("Values should not be padded by default, but got: %d (%v)", padded, err))
+		return
+	}
+}
+
+func TestPathPadding(t *testing.T) {
+	env, err := New(NewEnvOptions{
+		Format:      "dotenv",
+		Reader:      strings.NewReader("PIN=1234\nKEY=some-long-key\nNAME=bob\n"),
+		Cipher:      paddedCipher{},
+		SecurePaths: []string{".PIN", ".KEY", ".NAME"},
+		Padding:     PaddingPolicy{Buckets: []int{8}},
+		PathPadding: map[string]PaddingPolicy{
+			".KEY":  {MaxLength: 64},
+			".NAME": {},
+		},
+	})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	data, err := env.Export("dotenv")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	expected := "PIN=encrypt(1234)#8\nKEY=encrypt(some-long-key)#64\nNAME=encrypt(bob)\n"
+	if string(data) != expected {
+		t.Error(fmt.Errorf("Unexpected output:\n%s", data))
+		return
+	}
+
+	// Ciphers that cannot pad values should fail instead of leaking lengths
+	env, err = New(NewEnvOptions{
+		Format:      "dotenv",
+		Reader:      strings.NewReader("PIN=1234\n"),
+		Cipher:      badCipher{},
+		SecurePaths: []string{".PIN"},
+		Padding:     PaddingPolicy{MaxLength: 8},
+	})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if _, err := env.Export("dotenv"); err == nil || !strings.Contains(err.Error(), "does not support padding") {
+		t.Error(fmt.Errorf("Expected padding to fail: %v", err))
+		return
+	}
+}
+
+func TestPaddingPolicyChange(t *testing.T) {
+	encrypted := "PIN=encrypt(1234)#8\nKEY=encrypt(a-much-longer-signing-key)#64\n"
+	for _, test := range []struct {
+		padding  PaddingPolicy
+		expected string
+	}{
+		// Values that are padded to the same length are kept
+		{
+			padding:  PaddingPolicy{Buckets: []int{8, 64}},
+			expected: encrypted,
+		},
+		// Values that are padded to a different length are re-encrypted,
+		// even though they did not change
+		{
+			padding:  PaddingPolicy{Buckets: []int{16, 64}},
+			expected: "PIN=encrypt(1234)#16\nKEY=encrypt(a-much-longer-signing-key)#64\n",
+		},
+		// Opening a file without a policy does not strip its padding
+		{
+			padding:  PaddingPolicy{},
+			expected: encrypted,
+		},
+	} {
+		env, err := Open(OpenEnvOptions{
+			Format:      "dotenv",
+			Reader:      strings.NewReader(encrypted),
+			Cipher:      paddedCipher{},
+			SecurePaths: []string{".PIN", ".KEY"},
+			Padding:     test.padding,
+		})
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		data, err := env.Export("dotenv")
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		if string(data) != test.expected {
+			t.Error(fmt.Errorf("Unexpected output with padding %s:\n%s", test.padding, data))
+			return
+		}
+	}
+
+	// Unchanged values that the new policy cannot pad fail to export
+	env, err := Open(OpenEnvOptions{
+		Format:      "dotenv",
+		Reader:      strings.NewReader(encrypted),
+		Cipher:      paddedCipher{},
+		SecurePaths: []string{".PIN", ".KEY"},
+		Padding:     PaddingPolicy{MaxLength: 8},
+	})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if _, err := env.Export("dotenv"); err == nil {
+		t.Error(fmt.Errorf("Expected values longer than the max length to fail"))
+		return
+	}
+}
@@ -4,15 +4,129 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"sort"
+	"strings"
 
+	"github.com/karimsa/secrets/internal/ciphers"
 	"github.com/karimsa/secrets/internal/logger"
 	"github.com/karimsa/secrets/internal/orderedmap"
 	pathReader "github.com/karimsa/secrets/internal/path"
 )
 
-type SimpleCipher interface {
-	Encrypt(raw string) (string, error)
-	Decrypt(encrypted string) (string, error)
+// SimpleCipher encrypts and decrypts single values.
+type SimpleCipher = ciphers.SimpleCipher
+
+// KeyManager protects data keys using a master key that is held elsewhere
+// (i.e. by a key management service). Ciphers that use a KeyManager only store
+// wrapped data keys alongside encrypted values, and the master key never
+// leaves the KeyManager.
+type KeyManager = ciphers.KeyManager
+
+// AuthenticatedCipher is implemented by ciphers that can bind a ciphertext to
+// associated data, which must then be given again to decrypt it. EnvFile binds
+// every value to its path (and optionally the file name), so that encrypted
+// values cannot be moved or copied to other keys without being noticed.
+type AuthenticatedCipher = ciphers.AuthenticatedCipher
+
+// Rewrapper is implemented by ciphers that can re-encrypt the key protecting a
+// value (i.e. for a new set of recipients) without touching the value itself.
+type Rewrapper = ciphers.Rewrapper
+
+// BatchCipher is implemented by ciphers that are more efficient when given
+// many values at once (i.e. because every call is a round trip to another
+// process or service). EnvFile encrypts or decrypts all of the values in a
+// file using a single call.
+type BatchCipher = ciphers.BatchCipher
+
+// BatchValue is a single value given to a BatchCipher, along with the data
+// that it is bound to and the length that it is padded to.
+type BatchValue = ciphers.BatchValue
+
+// BatchError is returned by a BatchCipher when a single value in a batch
+// could not be encrypted or decrypted.
+type BatchError = ciphers.BatchError
+
+// BatchErrors is returned by a BatchCipher when more than one value in a batch
+// could not be encrypted or decrypted.
+type BatchErrors = ciphers.BatchErrors
+
+// JoinBatchErrors returns the errors of the values in a batch that failed as a
+// single error, which is nil if no values failed.
+func JoinBatchErrors(errs []*BatchError) error {
+	return ciphers.JoinBatchErrors(errs)
+}
+
+// KeyMismatchError is returned by ciphers that can tell that a value was
+// encrypted with a different key than their own, rather than being corrupted.
+type KeyMismatchError = ciphers.KeyMismatchError
+
+// PathError is a value that could not be decrypted.
+type PathError struct {
+	Path string
+	Err  error
+}
+
+// OpenError is returned by Open when values could not be decrypted. Rather
+// than stopping at the first value, every value in the file is attempted so
+// that values which were encrypted with a different key can be told apart
+// from values that are corrupted.
+type OpenError struct {
+	// Total is the number of encrypted values in the file
+	Total    int
+	Failures []PathError
+}
+
+// KeyMismatches returns the paths of values that were encrypted with a
+// different key, grouped by the id of their key.
+func (err *OpenError) KeyMismatches() (map[string][]string, []string) {
+	paths := map[string][]string{}
+	keyIDs := []string{}
+	for _, failure := range err.Failures {
+		if mismatch, ok := failure.Err.(*KeyMismatchError); ok {
+			if _, seen := paths[mismatch.KeyID]; !seen {
+				keyIDs = append(keyIDs, mismatch.KeyID)
+			}
+			paths[mismatch.KeyID] = append(paths[mismatch.KeyID], failure.Path)
+		}
+	}
+	return paths, keyIDs
+}
+
+func (err *OpenError) Error() string {
+	paths, keyIDs := err.KeyMismatches()
+	mismatched := 0
+	for _, keyID := range keyIDs {
+		mismatched += len(paths[keyID])
+	}
+
+	// A single corrupted value is reported on its own
+	if mismatched == 0 && len(err.Failures) == 1 {
+		return fmt.Sprintf("Failed to decrypt value at %s: %s", err.Failures[0].Path, err.Failures[0].Err)
+	}
+
+	var msg strings.Builder
+	if mismatched > 0 {
+		if mismatched == err.Total {
+			fmt.Fprintf(&msg, "All %d values were encrypted with a different key (is the key correct?):", mismatched)
+		} else {
+			fmt.Fprintf(&msg, "%d of %d values were encrypted with a different key:", mismatched, err.Total)
+		}
+		for _, keyID := range keyIDs {
+			fmt.Fprintf(&msg, "\n\tkey %s: %s", keyID, strings.Join(paths[keyID], ", "))
+		}
+	}
+	if others := len(err.Failures) - mismatched; others > 0 {
+		if mismatched > 0 {
+			msg.WriteString("\n")
+		}
+		fmt.Fprintf(&msg, "Failed to decrypt %d of %d values:", others, err.Total)
+		for _, failure := range err.Failures {
+			if _, ok := failure.Err.(*KeyMismatchError); !ok {
+				fmt.Fprintf(&msg, "\n\t%s: %s", failure.Path, failure.Err)
+			}
+		}
+	}
+	return msg.String()
 }
 
 type EnvFile struct {
@@ -22,6 +136,19 @@ type EnvFile struct {
 	cipher             SimpleCipher
 	securePaths        []pathReader.Path
 	lastEncryptedValue map[string]string
+	fileName           string
+	padding            PaddingPolicy
+	pathPadding        []pathPadding
+
+	// integrity adds an integrity MAC to the file when it is exported
+	integrity           bool
+	integrityKey        []byte
+	wrappedIntegrityKey string
+}
+
+type pathPadding struct {
+	path   pathReader.Path
+	policy PaddingPolicy
 }
 
 type NewEnvOptions struct {
@@ -30,6 +157,20 @@ type NewEnvOptions struct {
 	Cipher      SimpleCipher
 	LogLevel    logger.LogLevel
 	SecurePaths []string
+
+	// FileName, when set, is bound to every encrypted value along with its
+	// path, so that values cannot be copied between files
+	FileName string
+
+	// Padding is the padding policy of every value in the file, unless the
+	// value's path has its own policy in PathPadding
+	Padding     PaddingPolicy
+	PathPadding map[string]PaddingPolicy
+
+	// Integrity adds a MAC over the whole file when it is exported, which
+	// covers values that are not encrypted, as well as the keys of the file
+	// and their order
+	Integrity bool
 }
 
 func makeSecurePaths(paths []string) ([]pathReader.Path, error) {
@@ -46,6 +187,18 @@ func makeSecurePaths(paths []string) ([]pathReader.Path, error) {
 	return parsedPaths, nil
 }
 
+func makePathPadding(policies map[string]PaddingPolicy) ([]pathPadding, error) {
+	parsed := make([]pathPadding, 0, len(policies))
+	for strPath, policy := range policies {
+		path, err := pathReader.New(strPath)
+		if err != nil {
+			return nil, err
+		}
+		parsed = append(parsed, pathPadding{path: path, policy: policy})
+	}
+	return parsed, nil
+}
+
 func New(options NewEnvOptions) (*EnvFile, error) {
 	rawValues, err := orderedmap.Parse(options.Format, options.Reader)
 	if err != nil {
@@ -59,6 +212,10 @@ func New(options NewEnvOptions) (*EnvFile, error) {
 	if err != nil {
 		return nil, err
 	}
+	paddedPaths, err := makePathPadding(options.PathPadding)
+	if err != nil {
+		return nil, err
+	}
 
 	return &EnvFile{
 		logger:             logger,
@@ -67,6 +224,10 @@ func New(options NewEnvOptions) (*EnvFile, error) {
 		cipher:             options.Cipher,
 		securePaths:        securePaths,
 		lastEncryptedValue: map[string]string{},
+		fileName:           options.FileName,
+		padding:            options.Padding,
+		pathPadding:        paddedPaths,
+		integrity:          options.Integrity,
 	}, nil
 }
 
@@ -76,6 +237,22 @@ type OpenEnvOptions struct {
 	Cipher      SimpleCipher
 	SecurePaths []string
 	LogLevel    logger.LogLevel
+
+	// FileName must match the name that values were bound to when they
+	// were encrypted (see NewEnvOptions)
+	FileName string
+
+	// Padding and PathPadding apply to values that are changed, and to
+	// unchanged values that were padded to a different length (see
+	// NewEnvOptions)
+	Padding     PaddingPolicy
+	PathPadding map[string]PaddingPolicy
+
+	// Files that have an integrity MAC are always verified, and keep it
+	// when they are exported. Integrity adds one to files that do not have
+	// it yet, and RequireIntegrity fails to open them instead.
+	Integrity        bool
+	RequireIntegrity bool
 }
 
 func Open(options OpenEnvOptions) (*EnvFile, error) {
@@ -88,6 +265,10 @@ func Open(options OpenEnvOptions) (*EnvFile, error) {
 	if err != nil {
 		return nil, err
 	}
+	paddedPaths, err := makePathPadding(options.PathPadding)
+	if err != nil {
+		return nil, err
+	}
 
 	env := &EnvFile{
 		logger: logger.New(options.LogLevel),
@@ -99,6 +280,14 @@ func Open(options OpenEnvOptions) (*EnvFile, error) {
 		cipher:             options.Cipher,
 		securePaths:        securePaths,
 		lastEncryptedValue: map[string]string{},
+		fileName:           options.FileName,
+		padding:            options.Padding,
+		pathPadding:        paddedPaths,
+		integrity:          options.Integrity,
+	}
+
+	if err := env.openIntegrity(&encryptedValues, options.RequireIntegrity); err != nil {
+		return nil, err
 	}
 
 	// Populate lastEncryptedValue
@@ -110,25 +299,227 @@ func Open(options OpenEnvOptions) (*EnvFile, error) {
 		env.lastEncryptedValue[path.String()] = val
 	}
 
-	res, err := env.encryptOrDecryptPaths(
-		encryptedValues.Values,
-		pathReader.Path{},
-		func(path pathReader.Path, encrypted string) (string, error) {
-			dec, err := options.Cipher.Decrypt(encrypted)
+	res, err := env.mapPathsInBatch(encryptedValues.Values, nil, "decrypt", env.batchCipher().DecryptBatch)
+	if err != nil {
+		return nil, err
+	}
+	env.oldRawValues = env.collectSecureValues(res)
+	env.rawValues.Values = res.(map[string]interface{})
+
+	return env, nil
+}
+
+// associatedData returns the data that the value at the given path is bound
+// to when encrypted.
+func (env *EnvFile) associatedData(path pathReader.Path) []byte {
+	data := "path=" + path.String()
+	if env.fileName != "" {
+		data += "\x00file=" + env.fileName
+	}
+	return []byte(data)
+}
+
+// paddedLength returns the length that the value at the given path is padded
+// to when encrypted.
+func (env *EnvFile) paddedLength(path pathReader.Path, val string) (int, error) {
+	policy := env.padding
+	for _, padded := range env.pathPadding {
+		if padded.path.Equals(path) {
+			policy = padded.policy
+		}
+	}
+
+	length, err := policy.PaddedLength(len(val))
+	if err != nil {
+		return 0, fmt.Errorf("Failed to encrypt value at %s: %s", path, err)
+	}
+	if _, ok := env.cipher.(PaddingCipher); length > 0 && !ok {
+		return 0, fmt.Errorf("Cipher does not support padding values: %T", env.cipher)
+	}
+	return length, nil
+}
+
+// keepsPadding reports whether an unchanged value is padded to the length that
+// the current padding policy pads it to. The policy is not stored in the file,
+// so values that were encrypted under a different policy must be re-encrypted
+// for it to apply to them. Values that no policy applies to keep their
+// padding, so that opening a file without a policy does not strip it.
+func (env *EnvFile) keepsPadding(path pathReader.Path, val, encrypted string) bool {
+	cipher, ok := env.cipher.(PaddingCipher)
+	if !ok {
+		return true
+	}
+
+	// Values that cannot be padded are re-encrypted, so that the error is
+	// reported when they are
+	expected, err := env.paddedLength(path, val)
+	if err != nil {
+		return false
+	}
+	if expected == 0 {
+		return true
+	}
+	actual, err := cipher.PaddedLength(encrypted)
+	return err == nil && actual == expected
+}
+
+// batchCipher returns the cipher as a BatchCipher. Ciphers that do not support
+// batches have each value encrypted or decrypted on its own.
+func (env *EnvFile) batchCipher() BatchCipher {
+	if cipher, ok := env.cipher.(BatchCipher); ok {
+		return cipher
+	}
+	return sequentialBatchCipher{env.cipher}
+}
+
+type sequentialBatchCipher struct {
+	cipher SimpleCipher
+}
+
+func (c sequentialBatchCipher) EncryptBatch(values []BatchValue) ([]string, error) {
+	results := make([]string, len(values))
+	for i, value := range values {
+		var err error
+		if cipher, ok := c.cipher.(PaddingCipher); ok && value.PadTo > 0 {
+			results[i], err = cipher.EncryptPadded(value.Value, value.AssociatedData, value.PadTo)
+		} else if cipher, ok := c.cipher.(AuthenticatedCipher); ok {
+			results[i], err = cipher.EncryptWithData(value.Value, value.AssociatedData)
+		} else {
+			results[i], err = c.cipher.Encrypt(value.Value)
+		}
+		if err != nil {
+			return nil, &BatchError{Index: i, Err: err}
+		}
+	}
+	return results, nil
+}
+
+// DecryptBatch attempts every value, even once one has failed, so that every
+// failure can be reported.
+func (c sequentialBatchCipher) DecryptBatch(values []BatchValue) ([]string, error) {
+	results := make([]string, len(values))
+	var errs []*BatchError
+	for i, value := range values {
+		var err error
+		if cipher, ok := c.cipher.(AuthenticatedCipher); ok {
+			results[i], err = cipher.DecryptWithData(value.Value, value.AssociatedData)
+		} else {
+			results[i], err = c.cipher.Decrypt(value.Value)
+		}
+		if err != nil {
+			errs = append(errs, &BatchError{Index: i, Err: err})
+		}
+	}
+	if err := JoinBatchErrors(errs); err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+// mapPathsInBatch maps every secure value in two passes. The first pass
+// collects the values, skipping any that keepValue (if given) resolves on its
+// own, and gives the rest to mapBatch in a single call. The second pass fills
+// in the results.
+func (env *EnvFile) mapPathsInBatch(
+	input interface{},
+	keepValue func(pathReader.Path, string) (string, bool),
+	action string,
+	mapBatch func([]BatchValue) ([]string, error),
+) (interface{}, error) {
+	results := map[string]string{}
+	pendingPaths := []pathReader.Path{}
+	pendingValues := []BatchValue{}
+
+	_, err := env.encryptOrDecryptPaths(input, pathReader.Path{}, func(path pathReader.Path, val string) (string, error) {
+		if keepValue != nil {
+			if res, ok := keepValue(path, val); ok {
+				results[path.String()] = res
+				return val, nil
+			}
+		}
+
+		value := BatchValue{
+			Value:          val,
+			AssociatedData: env.associatedData(path),
+		}
+		if action == "encrypt" {
+			var err error
+			value.PadTo, err = env.paddedLength(path, val)
 			if err != nil {
 				return "", err
 			}
+		}
 
-			env.oldRawValues[path.String()] = dec
-			return dec, nil
-		},
-	)
+		pendingPaths = append(pendingPaths, path)
+		pendingValues = append(pendingValues, value)
+		return val, nil
+	})
 	if err != nil {
 		return nil, err
 	}
-	env.rawValues.Values = res.(map[string]interface{})
 
-	return env, nil
+	if len(pendingValues) > 0 {
+		batch, err := mapBatch(pendingValues)
+		if failures := env.pathErrors(err, pendingPaths); len(failures) > 0 {
+			if action == "decrypt" {
+				return nil, &OpenError{Total: len(pendingValues), Failures: failures}
+			}
+			return nil, fmt.Errorf("Failed to %s value at %s: %s", action, failures[0].Path, failures[0].Err)
+		} else if err != nil {
+			return nil, fmt.Errorf("Failed to %s values: %s", action, err)
+		}
+		if len(batch) != len(pendingValues) {
+			return nil, fmt.Errorf("Failed to %s values: expected %d results, but got %d", action, len(pendingValues), len(batch))
+		}
+
+		for i, path := range pendingPaths {
+			results[path.String()] = batch[i]
+		}
+	}
+
+	return env.encryptOrDecryptPaths(input, pathReader.Path{}, func(path pathReader.Path, val string) (string, error) {
+		return results[path.String()], nil
+	})
+}
+
+// pathErrors maps the errors of a batch to the paths of the values that
+// failed, sorted by path. Errors that are not for specific values are not
+// mapped.
+func (env *EnvFile) pathErrors(err error, paths []pathReader.Path) []PathError {
+	var errs []*BatchError
+	switch err := err.(type) {
+	case *BatchError:
+		errs = []*BatchError{err}
+	case BatchErrors:
+		errs = err
+	}
+
+	failures := make([]PathError, 0, len(errs))
+	for _, batchErr := range errs {
+		if batchErr.Index < 0 || batchErr.Index >= len(paths) {
+			return nil
+		}
+		failures = append(failures, PathError{
+			Path: paths[batchErr.Index].String(),
+			Err:  batchErr.Err,
+		})
+	}
+
+	// Values are collected in map order, which is random
+	sort.SliceStable(failures, func(i, j int) bool {
+		return failures[i].Path < failures[j].Path
+	})
+	return failures
+}
+
+// collectSecureValues returns the value of every secure path, keyed by path.
+func (env *EnvFile) collectSecureValues(input interface{}) map[string]string {
+	values := map[string]string{}
+	env.encryptOrDecryptPaths(input, pathReader.Path{}, func(path pathReader.Path, val string) (string, error) {
+		values[path.String()] = val
+		return val, nil
+	})
+	return values
 }
 
 func (env *EnvFile) isSecurePath(compared pathReader.Path) bool {
@@ -203,6 +594,43 @@ func (env *EnvFile) encryptOrDecryptPaths(untypedInput interface{}, currentPath
 	}
 }
 
+// Rewrap re-wraps the key of every encrypted value using the current cipher,
+// which must implement Rewrapper. Values are not re-encrypted, so the next
+// export only changes the wrapped keys.
+func (env *EnvFile) Rewrap() error {
+	rewrapper, ok := env.cipher.(Rewrapper)
+	if !ok {
+		return fmt.Errorf("Cipher does not support re-wrapping keys: %T", env.cipher)
+	}
+
+	for path, encrypted := range env.lastEncryptedValue {
+		rewrapped, err := rewrapper.Rewrap(encrypted)
+		if err != nil {
+			return fmt.Errorf("Failed to re-wrap value at %s: %s", path, err)
+		}
+		env.lastEncryptedValue[path] = rewrapped
+	}
+
+	if env.wrappedIntegrityKey != "" {
+		rewrapped, err := rewrapper.Rewrap(env.wrappedIntegrityKey)
+		if err != nil {
+			return fmt.Errorf("Failed to re-wrap integrity MAC key: %s", err)
+		}
+		env.wrappedIntegrityKey = rewrapped
+	}
+	return nil
+}
+
+// Rekey switches the file to a new cipher. Every secure value is re-encrypted
+// using the new cipher on the next export, regardless of whether it changed.
+func (env *EnvFile) Rekey(cipher SimpleCipher) {
+	env.cipher = cipher
+	env.oldRawValues = map[string]string{}
+	env.lastEncryptedValue = map[string]string{}
+	env.integrityKey = nil
+	env.wrappedIntegrityKey = ""
+}
+
 func (env *EnvFile) UpdateFrom(format string, reader io.Reader) error {
 	updatedValues, err := orderedmap.Parse(format, reader)
 	if err != nil {
@@ -230,23 +658,45 @@ func (env *EnvFile) exportWithMapper(format string, mapValue func(pathReader.Pat
 }
 
 func (env *EnvFile) Export(format string) ([]byte, error) {
-	return env.exportWithMapper(format, func(path pathReader.Path, val string) (string, error) {
-		oldVal, ok := env.oldRawValues[path.String()]
-		lastEnc, hasEnc := env.getLastEncryptedValue(path)
+	encrypted := orderedmap.OrderedMap{
+		KeyOrder: env.rawValues.KeyOrder,
+	}
+	res, err := env.mapPathsInBatch(
+		env.rawValues.Values,
+		func(path pathReader.Path, val string) (string, bool) {
+			oldVal, ok := env.oldRawValues[path.String()]
+			lastEnc, hasEnc := env.getLastEncryptedValue(path)
+
+			if ok && hasEnc && val == oldVal {
+				if env.keepsPadding(path, val, lastEnc) {
+					env.logger.Debugf("Keeping value at: %s (unchanged)", path)
+					return lastEnc, true
+				}
+				env.logger.Debugf("Re-encrypting value at: %s (padding changed)", path)
+				return "", false
+			}
 
-		if ok && hasEnc && val == oldVal {
-			env.logger.Debugf("Keeping value at: %s (unchanged)", path)
-			return lastEnc, nil
-		}
+			reason := "added"
+			if hasEnc {
+				reason = "changed"
+			}
 
-		reason := "added"
-		if hasEnc {
-			reason = "changed"
+			env.logger.Debugf("Re-encrypting value at: %s (%s)", path, reason)
+			return "", false
+		},
+		"encrypt",
+		env.batchCipher().EncryptBatch,
+	)
+	if err != nil {
+		return nil, err
+	}
+	encrypted.Values = res.(map[string]interface{})
+	if env.integrity {
+		if err := env.sealIntegrity(&encrypted); err != nil {
+			return nil, err
 		}
-
-		env.logger.Debugf("Re-encrypting value at: %s (%s)", path, reason)
-		return env.cipher.Encrypt(val)
-	})
+	}
+	return encrypted.Export(format)
 }
 
 func (env *EnvFile) UnsafeRawExport(format string) ([]byte, error) {
@@ -42,6 +42,57 @@ func (badCipher) Decrypt(str string) (string, error) {
 	return str, nil
 }
 
+type boundCipher struct {
+	badCipher
+}
+
+func (boundCipher) EncryptWithData(str string, data []byte) (string, error) {
+	return fmt.Sprintf("encrypt(%s|%s)", data, str), nil
+}
+func (boundCipher) DecryptWithData(str string, data []byte) (string, error) {
+	prefix := fmt.Sprintf("encrypt(%s|", data)
+	if !strings.HasPrefix(str, prefix) {
+		return "", fmt.Errorf("Value is bound to a different location")
+	}
+	return str[len(prefix) : len(str)-1], nil
+}
+
+type rewrapCipher struct {
+	badCipher
+	generation int
+}
+
+func (c rewrapCipher) Rewrap(str string) (string, error) {
+	return fmt.Sprintf("%s#%d", str, c.generation), nil
+}
+
+// batchCipher records every batch it is given, and fails to decrypt values
+// that are not wrapped by badCipher.
+type batchCipher struct {
+	badCipher
+	batches *[]int
+}
+
+func (c batchCipher) EncryptBatch(values []BatchValue) ([]string, error) {
+	*c.batches = append(*c.batches, len(values))
+	results := make([]string, len(values))
+	for i, value := range values {
+		results[i], _ = c.Encrypt(value.Value)
+	}
+	return results, nil
+}
+func (c batchCipher) DecryptBatch(values []BatchValue) ([]string, error) {
+	*c.batches = append(*c.batches, len(values))
+	results := make([]string, len(values))
+	for i, value := range values {
+		if !strings.HasPrefix(value.Value, "encrypt(") {
+			return nil, &BatchError{Index: i, Err: fmt.Errorf("Value is not encrypted")}
+		}
+		results[i], _ = c.Decrypt(value.Value)
+	}
+	return results, nil
+}
+
 func TestDecryptPaths(t *testing.T) {
 	text, err := (&randCipher{}).Encrypt("level")
 	if err != nil {
@@ -426,3 +477,265 @@ func TestNestedYAML(t *testing.T) {
 		return
 	}
 }
+
+func TestRewrap(t *testing.T) {
+	handler, err := Open(
+		OpenEnvOptions{
+			Format: "yaml",
+			Reader: strings.NewReader("hello: encrypt(world)\na: test\n"),
+			Cipher: rewrapCipher{generation: 2},
+			SecurePaths: []string{
+				".hello",
+			},
+		},
+	)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if err := handler.Rewrap(); err != nil {
+		t.Error(err)
+		return
+	}
+
+	data, err := handler.Export("yaml")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if string(data) != "hello: encrypt(world)#2\na: test\n" {
+		t.Error(fmt.Errorf("Unexpected re-wrapped output:\n%s", data))
+		return
+	}
+
+	handler.cipher = badCipher{}
+	if err := handler.Rewrap(); err == nil {
+		t.Error(fmt.Errorf("Rewrap should fail for ciphers that do not support it"))
+		return
+	}
+}
+
+func TestBindPaths(t *testing.T) {
+	handler, err := New(
+		NewEnvOptions{
+			Format: "dotenv",
+			Reader: strings.NewReader("A=first\nB=second\n"),
+			Cipher: boundCipher{},
+			SecurePaths: []string{
+				".A",
+				".B",
+			},
+			FileName: ".env",
+		},
+	)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	data, err := handler.Export("dotenv")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if string(data) != "A=encrypt(path=['A']\x00file=.env|first)\nB=encrypt(path=['B']\x00file=.env|second)\n" {
+		t.Error(fmt.Errorf("Unexpected output:\n%q", data))
+		return
+	}
+
+	open := func(input string, fileName string) error {
+		_, err := Open(
+			OpenEnvOptions{
+				Format: "dotenv",
+				Reader: strings.NewReader(input),
+				Cipher: boundCipher{},
+				SecurePaths: []string{
+					".A",
+					".B",
+				},
+				FileName: fileName,
+			},
+		)
+		return err
+	}
+
+	if err := open(string(data), ".env"); err != nil {
+		t.Error(err)
+		return
+	}
+
+	lines := strings.Split(string(data), "\n")
+	swapped := "A=" + lines[1][2:] + "\nB=" + lines[0][2:] + "\n"
+	if err := open(swapped, ".env"); err == nil || !strings.Contains(err.Error(), "different location") {
+		t.Error(fmt.Errorf("Swapped values should fail to decrypt: %v", err))
+		return
+	}
+
+	if err := open(string(data), ".env.production"); err == nil {
+		t.Error(fmt.Errorf("Values copied from another file should fail to decrypt"))
+		return
+	}
+}
+
+func TestRekey(t *testing.T) {
+	handler, err := Open(
+		OpenEnvOptions{
+			Format: "yaml",
+			Reader: strings.NewReader("hello: encrypt(world)\na: encrypt(test)\nb: stuff\n"),
+			Cipher: badCipher{},
+			SecurePaths: []string{
+				".hello",
+				".a",
+			},
+		},
+	)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	handler.Rekey(&randCipher{})
+
+	data, err := handler.Export("yaml")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	values := map[string]interface{}{}
+	if err := yaml.Unmarshal(data, &values); err != nil {
+		t.Error(err)
+		return
+	}
+	for key, expected := range map[string]string{"hello": "world", "a": "test"} {
+		if decrypted, err := (&randCipher{}).Decrypt(values[key].(string)); err != nil || decrypted != expected {
+			t.Error(fmt.Errorf("Value at %s was not rekeyed:\n%s", key, data))
+			return
+		}
+	}
+	if values["b"].(string) != "stuff" {
+		t.Error(fmt.Errorf("Insecure value was changed:\n%s", data))
+		return
+	}
+}
+
+func TestBatchCipher(t *testing.T) {
+	batches := []int{}
+	open := func(input string) (*EnvFile, error) {
+		return Open(
+			OpenEnvOptions{
+				Format: "yaml",
+				Reader: strings.NewReader(input),
+				Cipher: batchCipher{batches: &batches},
+				SecurePaths: []string{
+					".a",
+					".b",
+					".c",
+				},
+			},
+		)
+	}
+
+	handler, err := open("a: encrypt(first)\nb: encrypt(second)\nc: encrypt(third)\nd: stuff\n")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if len(batches) != 1 || batches[0] != 3 {
+		t.Error(fmt.Errorf("Expected values to be decrypted in a single batch: %v", batches))
+		return
+	}
+
+	if err := handler.UpdateFrom("yaml", strings.NewReader("a: first\nb: changed\nc: also changed\nd: stuff\n")); err != nil {
+		t.Error(err)
+		return
+	}
+	data, err := handler.Export("yaml")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if string(data) != "a: encrypt(first)\nb: encrypt(changed)\nc: encrypt(also changed)\nd: stuff\n" {
+		t.Error(fmt.Errorf("Unexpected output:\n%s", data))
+		return
+	}
+	if len(batches) != 2 || batches[1] != 2 {
+		t.Error(fmt.Errorf("Expected only changed values to be encrypted in a single batch: %v", batches))
+		return
+	}
+
+	// Errors should report which path failed
+	_, err = open("a: encrypt(first)\nb: second\nc: encrypt(third)\n")
+	if err == nil || !strings.Contains(err.Error(), "['b']") {
+		t.Error(fmt.Errorf("Expected error to report the path that failed: %v", err))
+		return
+	}
+}
+
+// keyedCipher prefixes values with the id of its key, and reports values with
+// another key as a KeyMismatchError.
+type keyedCipher struct {
+	keyID string
+}
+
+func (c keyedCipher) Encrypt(str string) (string, error) {
+	return c.keyID + ":" + str, nil
+}
+func (c keyedCipher) Decrypt(str string) (string, error) {
+	parts := strings.SplitN(str, ":", 2)
+	if len(parts) != 2 {
+		return "", fmt.Errorf("Failed to decrypt value")
+	}
+	if parts[0] != c.keyID {
+		return "", &KeyMismatchError{KeyID: parts[0]}
+	}
+	return parts[1], nil
+}
+
+func TestOpenErrors(t *testing.T) {
+	open := func(input string) error {
+		_, err := Open(OpenEnvOptions{
+			Format:      "dotenv",
+			Reader:      strings.NewReader(input),
+			Cipher:      keyedCipher{keyID: "a"},
+			SecurePaths: []string{".A", ".B", ".C", ".D"},
+		})
+		return err
+	}
+
+	err := open("A=a:1\nB=b:2\nC=c:3\nD=b:4\n")
+	openErr, ok := err.(*OpenError)
+	if !ok {
+		t.Error(fmt.Errorf("Expected an OpenError: %v", err))
+		return
+	}
+	if len(openErr.Failures) != 3 || openErr.Total != 4 {
+		t.Error(fmt.Errorf("Expected every failure to be reported: %+v", openErr))
+		return
+	}
+	expected := "3 of 4 values were encrypted with a different key:\n\tkey b: ['B'], ['D']\n\tkey c: ['C']"
+	if err.Error() != expected {
+		t.Error(fmt.Errorf("Unexpected error:\n%s", err))
+		return
+	}
+
+	err = open("A=b:1\nB=b:2\nC=b:3\nD=b:4\n")
+	if err == nil || !strings.HasPrefix(err.Error(), "All 4 values were encrypted with a different key") {
+		t.Error(fmt.Errorf("Unexpected error: %v", err))
+		return
+	}
+
+	err = open("A=a:1\nB=corrupted\nC=c:3\nD=a:4\n")
+	expected = "1 of 4 values were encrypted with a different key:\n\tkey c: ['C']\nFailed to decrypt 1 of 4 values:\n\t['B']: Failed to decrypt value"
+	if err == nil || err.Error() != expected {
+		t.Error(fmt.Errorf("Unexpected error:\n%v", err))
+		return
+	}
+
+	err = open("A=a:1\nB=corrupted\nC=a:3\nD=a:4\n")
+	if err == nil || err.Error() != "Failed to decrypt value at ['B']: Failed to decrypt value" {
+		t.Error(fmt.Errorf("Unexpected error: %v", err))
+		return
+	}
+}